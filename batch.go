@@ -0,0 +1,227 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultBatchMaxRecords    = 1000
+	defaultBatchMaxBytes      = 1 << 20
+	defaultBatchFlushInterval = time.Second
+	defaultBatchQueueSize     = 64
+
+	compressionGzip = "gzip"
+)
+
+var errBatcherClosed = errors.New("forward batcher is closed")
+
+// BatchConfig sets when buffered records of a tag are flushed: after
+// MaxRecords records, MaxBytes encoded bytes or FlushInterval, whichever
+// comes first.
+type BatchConfig struct {
+	MaxRecords    int
+	MaxBytes      int
+	FlushInterval time.Duration
+	Compression   string
+	QueueSize     int
+}
+
+// forwardChunk is a PackedForward event stream of size entries of one tag.
+type forwardChunk struct {
+	tag        string
+	id         string
+	entries    []byte
+	size       int
+	compressed bool
+	ack        bool
+}
+
+type chunkSender interface {
+	postChunk(chunk *forwardChunk) error
+}
+
+// ForwardBatcher buffers records per tag and sends them to sender in
+// PackedForward or, with gzip compression, CompressedPackedForward mode.
+// Post only encodes the record; chunks are sent by a background worker
+// according to delivery config. Chunks not fitting in the worker queue go
+// to the fallback right away.
+type ForwardBatcher struct {
+	sender    chunkSender
+	cfg       BatchConfig
+	delivery  DeliveryConfig
+	tagPrefix string
+	subSecond bool
+
+	mu     sync.Mutex
+	chunks map[string]*forwardChunk
+	closed bool
+
+	worker *retryWorker
+}
+
+func NewForwardBatcher(
+	sender chunkSender, forward ForwardConfig, cfg BatchConfig, delivery DeliveryConfig,
+) *ForwardBatcher {
+	if cfg.MaxRecords <= 0 {
+		cfg.MaxRecords = defaultBatchMaxRecords
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = defaultBatchMaxBytes
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = defaultBatchFlushInterval
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultBatchQueueSize
+	}
+	if delivery.MaxAttempts <= 0 {
+		delivery.MaxAttempts = 1
+	}
+	if delivery.RetryWait <= 0 {
+		delivery.RetryWait = defaultDeliveryRetryWait
+	}
+
+	publishDeliveryStats()
+	b := &ForwardBatcher{
+		sender:    sender,
+		cfg:       cfg,
+		delivery:  delivery,
+		tagPrefix: forward.TagPrefix,
+		subSecond: forward.SubSecondPrecision,
+		chunks:    map[string]*forwardChunk{},
+	}
+	b.worker = newRetryWorker(b, cfg.QueueSize, cfg.FlushInterval, retryPolicy{
+		maxAttempts: delivery.MaxAttempts,
+		initialWait: delivery.RetryWait,
+		maxWait:     delivery.MaxRetryWait,
+		maxRetries:  cfg.QueueSize,
+	}, &deliveryCounters)
+
+	return b
+}
+
+func (b *ForwardBatcher) Post(tag string, record map[string]interface{}) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return errBatcherClosed
+	}
+
+	chunk, ok := b.chunks[tag]
+	if !ok {
+		chunk = &forwardChunk{tag: tag, id: newChunkID(), ack: b.delivery.requireAck()}
+		b.chunks[tag] = chunk
+	}
+	chunk.entries = encodeEntry(chunk.entries, time.Now(), record, b.subSecond)
+	chunk.size++
+
+	if chunk.size < b.cfg.MaxRecords && len(chunk.entries) < b.cfg.MaxBytes {
+		b.mu.Unlock()
+		return nil
+	}
+
+	delete(b.chunks, tag)
+	b.mu.Unlock()
+	if b.worker.enqueue(chunk) {
+		return nil
+	}
+
+	return b.fallback(chunk, errors.New("forward batch queue is full"))
+}
+
+// Close flushes buffered records and waits until they are sent.
+func (b *ForwardBatcher) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.mu.Unlock()
+
+	b.worker.close()
+
+	if closer, ok := b.sender.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// take removes all buffered chunks.
+func (b *ForwardBatcher) take() []interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	chunks := make([]interface{}, 0, len(b.chunks))
+	for tag, chunk := range b.chunks {
+		chunks = append(chunks, chunk)
+		delete(b.chunks, tag)
+	}
+
+	return chunks
+}
+
+// attempt compresses a chunk if configured and sends it. Every failure is
+// retried.
+func (b *ForwardBatcher) attempt(item interface{}) (interface{}, time.Duration, error) {
+	chunk := item.(*forwardChunk)
+	if b.cfg.Compression == compressionGzip && !chunk.compressed {
+		compressed, err := gzipBytes(chunk.entries)
+		if err == nil {
+			chunk.entries, chunk.compressed = compressed, true
+		}
+	}
+
+	if err := b.sender.postChunk(chunk); err != nil {
+		return chunk, 0, err
+	}
+	atomic.AddInt64(&deliveryCounters.SentRecords, int64(chunk.size))
+
+	return nil, 0, nil
+}
+
+// drop hands a chunk out of attempts to the fallback.
+func (b *ForwardBatcher) drop(item interface{}, err error) {
+	if err := b.fallback(item.(*forwardChunk), err); err != nil {
+		fmt.Printf("krakend-fluentd-request-logger: %v \n", err)
+	}
+}
+
+// fallback writes a chunk that could not be delivered because of err to
+// FallbackDir if it is set, and returns an error if the chunk is lost.
+func (b *ForwardBatcher) fallback(chunk *forwardChunk, err error) error {
+	if b.delivery.FallbackDir != "" {
+		spoolErr := spoolChunk(b.delivery.FallbackDir, forwardTag(b.tagPrefix, chunk.tag), chunk)
+		if spoolErr == nil {
+			atomic.AddInt64(&deliveryCounters.SpooledChunks, 1)
+			atomic.AddInt64(&deliveryCounters.SpooledRecords, int64(chunk.size))
+			fmt.Printf("krakend-fluentd-request-logger: %d records of '%s' spooled: %v \n", chunk.size, chunk.tag, err)
+			return nil
+		}
+		err = fmt.Errorf("%v, spool failed: %v", err, spoolErr)
+	}
+
+	atomic.AddInt64(&deliveryCounters.LostRecords, int64(chunk.size))
+
+	return fmt.Errorf("%d records of '%s' lost: %v", chunk.size, chunk.tag, err)
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
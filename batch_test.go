@@ -0,0 +1,238 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// chunkRecorder is a chunkSender keeping sent chunks and failing the
+// first failures sends.
+type chunkRecorder struct {
+	mu       sync.Mutex
+	chunks   []*forwardChunk
+	failures int
+	attempts int
+}
+
+func (r *chunkRecorder) postChunk(chunk *forwardChunk) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.attempts++
+	if r.attempts <= r.failures {
+		return io.ErrUnexpectedEOF
+	}
+	r.chunks = append(r.chunks, chunk)
+
+	return nil
+}
+
+func (r *chunkRecorder) sent() []*forwardChunk {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]*forwardChunk(nil), r.chunks...)
+}
+
+// decodeEntries decodes a PackedForward event stream into records.
+func decodeEntries(t *testing.T, entries []byte) []map[string]interface{} {
+	t.Helper()
+
+	var records []map[string]interface{}
+	reader := msgp.NewReader(bytes.NewReader(entries))
+	for {
+		value, err := reader.ReadIntf()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, ok := value.([]interface{})
+		if !ok || len(entry) != 2 {
+			t.Fatalf("entry = %v, want [time, record]", value)
+		}
+		record, _ := entry[1].(map[string]interface{})
+		records = append(records, record)
+	}
+}
+
+func TestEncodePackedForward(t *testing.T) {
+	entries := encodeEntry(nil, time.Unix(100, 0), map[string]interface{}{"n": 1}, false)
+
+	tests := []struct {
+		name  string
+		chunk forwardChunk
+		want  map[string]interface{}
+	}{
+		{
+			name:  "plain",
+			chunk: forwardChunk{entries: entries, size: 1},
+			want:  map[string]interface{}{"size": int64(1)},
+		},
+		{
+			name:  "compressed with ack",
+			chunk: forwardChunk{entries: entries, size: 1, compressed: true, ack: true, id: "chunk-1"},
+			want:  map[string]interface{}{"size": int64(1), "compressed": "gzip", "chunk": "chunk-1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, _, err := msgp.ReadIntfBytes(encodePackedForward("krakend.access", &tt.chunk))
+			if err != nil {
+				t.Fatal(err)
+			}
+			message, _ := value.([]interface{})
+			if len(message) != 3 || message[0] != "krakend.access" {
+				t.Fatalf("message = %v", value)
+			}
+			if !bytes.Equal(message[1].([]byte), entries) {
+				t.Errorf("entries = %v, want %v", message[1], entries)
+			}
+			if !reflect.DeepEqual(message[2], tt.want) {
+				t.Errorf("options = %v, want %v", message[2], tt.want)
+			}
+		})
+	}
+}
+
+func TestAppendEventTime(t *testing.T) {
+	moment := time.Unix(0x01020304, 0x05060708)
+
+	if got := appendEventTime(nil, moment, false); !bytes.Equal(got, msgp.AppendInt64(nil, 0x01020304)) {
+		t.Errorf("integer time = %x", got)
+	}
+
+	want := []byte{0xd7, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	if got := appendEventTime(nil, moment, true); !bytes.Equal(got, want) {
+		t.Errorf("EventTime = %x, want %x", got, want)
+	}
+}
+
+func TestAppendValue(t *testing.T) {
+	record := map[string]interface{}{
+		"string": "s",
+		"nested": map[string]interface{}{"list": []interface{}{1, "two"}},
+		"time":   time.Duration(5),
+		"other":  struct{ A int }{1},
+	}
+
+	value, _, err := msgp.ReadIntfBytes(appendRecord(nil, record))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"string": "s",
+		"nested": map[string]interface{}{"list": []interface{}{int64(1), "two"}},
+		"time":   "5ns",
+		"other":  "{1}",
+	}
+	if !reflect.DeepEqual(value, want) {
+		t.Errorf("record = %#v, want %#v", value, want)
+	}
+}
+
+func TestForwardBatcher(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         BatchConfig
+		records     int
+		wantChunks  []int
+		compression bool
+	}{
+		{
+			name:       "flushed by max records",
+			cfg:        BatchConfig{MaxRecords: 2, FlushInterval: time.Hour},
+			records:    5,
+			wantChunks: []int{2, 2, 1},
+		},
+		{
+			name:       "flushed by max bytes",
+			cfg:        BatchConfig{MaxRecords: 100, MaxBytes: 1, FlushInterval: time.Hour},
+			records:    2,
+			wantChunks: []int{1, 1},
+		},
+		{
+			name:        "gzip",
+			cfg:         BatchConfig{MaxRecords: 10, Compression: compressionGzip, FlushInterval: time.Hour},
+			records:     3,
+			wantChunks:  []int{3},
+			compression: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &chunkRecorder{}
+			batcher := NewForwardBatcher(sender, ForwardConfig{}, tt.cfg, DeliveryConfig{})
+			for i := 0; i < tt.records; i++ {
+				if err := batcher.Post("access", map[string]interface{}{"n": i}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			batcher.Close()
+
+			chunks := sender.sent()
+			if len(chunks) != len(tt.wantChunks) {
+				t.Fatalf("chunks = %d, want %d", len(chunks), len(tt.wantChunks))
+			}
+			n := int64(0)
+			for i, chunk := range chunks {
+				if chunk.size != tt.wantChunks[i] || chunk.compressed != tt.compression {
+					t.Errorf("chunk %d: size %d, compressed %v", i, chunk.size, chunk.compressed)
+				}
+				entries := chunk.entries
+				if chunk.compressed {
+					reader, err := gzip.NewReader(bytes.NewReader(entries))
+					if err != nil {
+						t.Fatal(err)
+					}
+					entries, _ = io.ReadAll(reader)
+				}
+				for _, record := range decodeEntries(t, entries) {
+					if record["n"] != n {
+						t.Errorf("record n = %v, want %d", record["n"], n)
+					}
+					n++
+				}
+			}
+		})
+	}
+}
+
+func TestForwardBatcherFlushInterval(t *testing.T) {
+	sender := &chunkRecorder{}
+	batcher := NewForwardBatcher(sender, ForwardConfig{}, BatchConfig{FlushInterval: 10 * time.Millisecond}, DeliveryConfig{})
+	defer batcher.Close()
+
+	batcher.Post("access", map[string]interface{}{"n": 1})
+	batcher.Post("audit", map[string]interface{}{"n": 2})
+
+	deadline := time.Now().Add(time.Second)
+	for len(sender.sent()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if chunks := sender.sent(); len(chunks) != 2 {
+		t.Errorf("chunks = %d, want one per tag", len(chunks))
+	}
+}
+
+func TestForwardBatcherClosed(t *testing.T) {
+	batcher := NewForwardBatcher(&chunkRecorder{}, ForwardConfig{}, BatchConfig{}, DeliveryConfig{})
+	batcher.Close()
+
+	if err := batcher.Post("access", map[string]interface{}{}); err != errBatcherClosed {
+		t.Errorf("Post() after Close() error = %v, want %v", err, errBatcherClosed)
+	}
+	if err := batcher.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+}
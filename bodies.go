@@ -0,0 +1,336 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var graphQLKeys = map[string]struct{}{
+	"query":         {},
+	"variables":     {},
+	"operationName": {},
+	"extensions":    {},
+}
+
+var graphQLOperationPattern = regexp.MustCompile(`^\s*(query|mutation|subscription)\b\s*([_A-Za-z][_0-9A-Za-z]*)?`)
+
+// MaskBodyByContentType masks body according to its media type:
+// JSON (including GraphQL requests), form-urlencoded, multipart and XML.
+// Multipart bodies are always summarized so file contents are never logged.
+func MaskBodyByContentType(contentType, body string, rules []MaskRule) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+
+	switch {
+	case mediaType == "multipart/form-data":
+		return SummarizeMultipart(body, params["boundary"], rules)
+	case len(rules) == 0:
+		return body
+	case mediaType == "application/x-www-form-urlencoded":
+		return MaskForm(body, rules)
+	case mediaType == "application/graphql":
+		return summarizeGraphQL(map[string]interface{}{"query": body}, rules)
+	case isXMLMediaType(mediaType):
+		return MaskXML(body, rules)
+	case isJSONMediaType(mediaType):
+		if graphQLRequest, ok := asGraphQLRequest(body); ok {
+			return summarizeGraphQL(graphQLRequest, rules)
+		}
+	}
+
+	return MaskBody(body, rules)
+}
+
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func isXMLMediaType(mediaType string) bool {
+	return mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml")
+}
+
+// MaskForm masks values of form-urlencoded fields matched by rules,
+// keeping field order and encoding of untouched fields.
+func MaskForm(body string, rules []MaskRule) string {
+	pairs := strings.Split(body, "&")
+	for i, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		name, err := url.QueryUnescape(kv[0])
+		if err != nil {
+			continue
+		}
+		rule, ok := matchMaskRule(rules, []PathElement{{Key: name}})
+		if !ok {
+			continue
+		}
+
+		value, err := url.QueryUnescape(kv[1])
+		if err != nil {
+			value = kv[1]
+		}
+		masked, keep := rule.strategy().Mask(value)
+		if !keep {
+			pairs[i] = ""
+			continue
+		}
+		pairs[i] = kv[0] + "=" + strings.ReplaceAll(url.QueryEscape(masked), "%2A", "*")
+	}
+
+	return strings.Join(removeEmpty(pairs), "&")
+}
+
+// SummarizeMultipart replaces a multipart body with a JSON summary:
+// form field values (masked by rules) and file parts described by
+// field name, file name, size and content type.
+func SummarizeMultipart(body, boundary string, rules []MaskRule) string {
+	if boundary == "" {
+		return "<multipart body omitted: no boundary>"
+	}
+
+	fields := map[string]interface{}{}
+	var files []interface{}
+
+	reader := multipart.NewReader(strings.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fields["<error>"] = err.Error()
+			break
+		}
+
+		content, err := io.ReadAll(part)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			fields["<error>"] = err.Error()
+			break
+		}
+
+		if part.FileName() != "" {
+			files = append(files, map[string]interface{}{
+				"field":        part.FormName(),
+				"filename":     part.FileName(),
+				"size":         len(content),
+				"content_type": part.Header.Get("Content-Type"),
+			})
+			continue
+		}
+
+		value := string(content)
+		if rule, ok := matchMaskRule(rules, []PathElement{{Key: part.FormName()}}); ok {
+			masked, keep := rule.strategy().Mask(value)
+			if !keep {
+				continue
+			}
+			value = masked
+		}
+		fields[part.FormName()] = value
+	}
+
+	summary := map[string]interface{}{"fields": fields}
+	if len(files) > 0 {
+		summary["files"] = files
+	}
+
+	result, err := toString(summary)
+	if err != nil {
+		return "<multipart body omitted>"
+	}
+
+	return result
+}
+
+// MaskXML masks text of elements and values of attributes matched by rules
+// and returns the original document with only those values replaced.
+// Element paths are built from local names, attributes are addressed
+// with "@" prefix: "Envelope.Body.Login.password", "user.@id".
+func MaskXML(body string, rules []MaskRule) string {
+	type replacement struct {
+		start, end int64
+		value      string
+	}
+
+	var (
+		path         []PathElement
+		replacements []replacement
+	)
+
+	// malformed or truncated documents are cut at the first error
+	// so values after it can't leak unmasked
+	size := int64(len(body))
+	decoder := xml.NewDecoder(strings.NewReader(body))
+	decoder.Strict = false
+	for {
+		start := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			size = start
+			break
+		}
+		end := decoder.InputOffset()
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			path = appendPath(path, PathElement{Key: t.Name.Local})
+			for _, attr := range t.Attr {
+				rule, ok := matchMaskRule(rules, appendPath(path, PathElement{Key: "@" + attr.Name.Local}))
+				if !ok {
+					continue
+				}
+				valueStart, valueEnd, found := findAttrValue(body[start:end], attr.Name)
+				if !found {
+					continue
+				}
+				masked, _ := rule.strategy().Mask(attr.Value)
+				replacements = append(replacements, replacement{start + valueStart, start + valueEnd, escapeXML(masked)})
+			}
+		case xml.EndElement:
+			if len(path) > 0 {
+				path = path[:len(path)-1]
+			}
+		case xml.CharData:
+			if strings.TrimSpace(string(t)) == "" {
+				continue
+			}
+			rule, ok := matchMaskRule(rules, path)
+			if !ok {
+				continue
+			}
+			masked, _ := rule.strategy().Mask(string(t))
+			replacements = append(replacements, replacement{start, end, escapeXML(masked)})
+		}
+	}
+
+	var result strings.Builder
+	last := int64(0)
+	for _, r := range replacements {
+		result.WriteString(body[last:r.start])
+		result.WriteString(r.value)
+		last = r.end
+	}
+	result.WriteString(body[last:size])
+	if size < int64(len(body)) {
+		result.WriteString("<truncated>")
+	}
+
+	return result.String()
+}
+
+// findAttrValue locates the value of attribute name (without quotes)
+// inside a raw start tag.
+func findAttrValue(tag string, name xml.Name) (int64, int64, bool) {
+	qualified := name.Local
+	if name.Space != "" {
+		qualified = name.Space + ":" + name.Local
+	}
+
+	pattern := regexp.MustCompile(`\s` + regexp.QuoteMeta(qualified) + `\s*=\s*("[^"]*"|'[^']*')`)
+	loc := pattern.FindStringSubmatchIndex(tag)
+	if loc == nil {
+		return 0, 0, false
+	}
+
+	return int64(loc[2] + 1), int64(loc[3] - 1), true
+}
+
+func escapeXML(s string) string {
+	var buffer bytes.Buffer
+	_ = xml.EscapeText(&buffer, []byte(s))
+
+	return buffer.String()
+}
+
+func asGraphQLRequest(body string) (map[string]interface{}, bool) {
+	value, err := toJSONValue(body)
+	if err != nil {
+		return nil, false
+	}
+
+	request, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	if _, ok := request["query"].(string); !ok {
+		return nil, false
+	}
+	for key := range request {
+		if _, ok := graphQLKeys[key]; !ok {
+			return nil, false
+		}
+	}
+
+	return request, true
+}
+
+// summarizeGraphQL logs operation type and name with masked variables
+// instead of the query text, which may contain inline literals.
+func summarizeGraphQL(request map[string]interface{}, rules []MaskRule) string {
+	query, _ := request["query"].(string)
+	operationType := "query"
+	operationName, _ := request["operationName"].(string)
+
+	if match := graphQLOperationPattern.FindStringSubmatch(query); match != nil {
+		operationType = match[1]
+		if operationName == "" {
+			operationName = match[2]
+		}
+	}
+
+	summary := map[string]interface{}{
+		"operationType": operationType,
+		"operationName": operationName,
+	}
+
+	if variables, ok := request["variables"]; ok && variables != nil {
+		masked, keep := maskValue(variables, nil, rules)
+		if keep {
+			summary["variables"] = masked
+		}
+	}
+
+	result, err := toString(summary)
+	if err != nil {
+		return fmt.Sprintf("<graphql %s %s>", operationType, operationName)
+	}
+
+	return result
+}
+
+func matchMaskRule(rules []MaskRule, path []PathElement) (MaskRule, bool) {
+	for _, rule := range rules {
+		if full, _ := rule.selector.Match(path); full {
+			return rule, true
+		}
+	}
+
+	return MaskRule{}, false
+}
+
+func removeEmpty(items []string) []string {
+	result := items[:0]
+	for _, item := range items {
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
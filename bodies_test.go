@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMaskBodyByContentType(t *testing.T) {
+	rules := newMaskRules(t, "redact", "password", "Envelope.user.@token", "$..pin", "card.number")
+
+	multipart := strings.Join([]string{
+		"--b",
+		`Content-Disposition: form-data; name="user"`,
+		"",
+		"bob",
+		"--b",
+		`Content-Disposition: form-data; name="password"`,
+		"",
+		"secret",
+		"--b",
+		`Content-Disposition: form-data; name="avatar"; filename="a.png"`,
+		"Content-Type: image/png",
+		"",
+		"PNGDATA",
+		"--b--",
+		"",
+	}, "\r\n")
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{
+			name:        "json",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"password":"p","user":"u"}`,
+			want:        `{"password":"[REDACTED]","user":"u"}`,
+		},
+		{
+			name:        "json suffix",
+			contentType: "application/vnd.api+json",
+			body:        `{"password":"p"}`,
+			want:        `{"password":"[REDACTED]"}`,
+		},
+		{
+			name:        "form keeps order and encoding",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "user=a+b&password=s%26cret&x=%2F",
+			want:        "user=a+b&password=%5BREDACTED%5D&x=%2F",
+		},
+		{
+			name:        "multipart summary never logs files",
+			contentType: "multipart/form-data; boundary=b",
+			body:        multipart,
+			want:        `{"fields":{"password":"[REDACTED]","user":"bob"},"files":[{"content_type":"image/png","field":"avatar","filename":"a.png","size":7}]}`,
+		},
+		{
+			name:        "multipart without boundary",
+			contentType: "multipart/form-data",
+			body:        multipart,
+			want:        "<multipart body omitted: no boundary>",
+		},
+		{
+			name:        "xml element and attribute",
+			contentType: "text/xml",
+			body:        `<Envelope><Body><Login><pin>1&amp;2</pin></Login></Body><user token='t1' id="1"/></Envelope>`,
+			want:        `<Envelope><Body><Login><pin>[REDACTED]</pin></Login></Body><user token='[REDACTED]' id="1"/></Envelope>`,
+		},
+		{
+			name:        "malformed xml is cut",
+			contentType: "application/xml",
+			body:        `<a><pin>1</pin><!-- <pin>2</pin></a>`,
+			want:        `<a><pin>[REDACTED]</pin><truncated>`,
+		},
+		{
+			name:        "graphql json request",
+			contentType: "application/json",
+			body:        `{"query":"mutation Pay($card: Card) { pay(card: $card) }","variables":{"card":{"number":"4111"}}}`,
+			want:        `{"operationName":"Pay","operationType":"mutation","variables":{"card":{"number":"[REDACTED]"}}}`,
+		},
+		{
+			name:        "graphql query text",
+			contentType: "application/graphql",
+			body:        `query Me { me { password } }`,
+			want:        `{"operationName":"Me","operationType":"query"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MaskBodyByContentType(tt.contentType, tt.body, rules); got != tt.want {
+				t.Errorf("MaskBodyByContentType() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaskBodyByContentTypeWithoutRules(t *testing.T) {
+	body := "user=a&password=p"
+	if got := MaskBodyByContentType("application/x-www-form-urlencoded", body, nil); got != body {
+		t.Errorf("body without rules changed: %s", got)
+	}
+}
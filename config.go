@@ -1,8 +1,12 @@
 package handler
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -11,9 +15,41 @@ import (
 	"github.com/luraproject/lura/v2/logging"
 )
 
+// MaskRule masks the header, cookie or body field addressed by Field with
+// Strategy, the "partial" strategy if nil. Body fields are matched by a
+// selector compiled by NewMaskRule; a rule made otherwise masks no body
+// field.
+type MaskRule struct {
+	Field    string
+	Strategy MaskStrategy
+	selector Selector
+}
+
+// NewMaskRule makes a rule masking field with strategy. Field is a header
+// or cookie name or a body selector like "user.password".
+func NewMaskRule(field string, strategy MaskStrategy, caseInsensitive bool) (MaskRule, error) {
+	selector, err := ParseSelector(field, caseInsensitive)
+	if err != nil {
+		return MaskRule{}, err
+	}
+
+	return MaskRule{Field: field, Strategy: strategy, selector: selector}, nil
+}
+
+func (r MaskRule) strategy() MaskStrategy {
+	if r.Strategy == nil {
+		return partialStrategy
+	}
+
+	return r.Strategy
+}
+
 type MaskConfig struct {
-	Request  map[string][]string
-	Response map[string][]string
+	Request         map[string][]string
+	Response        map[string][]string
+	CaseInsensitive bool
+	rules           map[string][]MaskRule
+	strategies      map[string]MaskStrategy
 }
 
 type BodyLoggerConfig struct {
@@ -22,15 +58,31 @@ type BodyLoggerConfig struct {
 }
 
 type FluentLoggerConfig struct {
-	FluentTag    string
-	FluentConfig fluent.Config
-	Skip         map[string]struct{}
-	logger       logging.Logger
-	JWTClaims    map[string]struct{}
-	FlatHeaders  map[string]struct{}
-	Response     BodyLoggerConfig
-	Request      BodyLoggerConfig
-	Mask         MaskConfig
+	FluentTag        string
+	FluentConfig     fluent.Config
+	Skip             map[string]struct{}
+	logger           logging.Logger
+	JWTClaims        JWTClaimsConfig
+	FlatHeaders      map[string]string
+	Response         BodyLoggerConfig
+	Request          BodyLoggerConfig
+	Mask             MaskConfig
+	Projection       ProjectionConfig
+	Redact           *Scanner
+	Headers          HeadersConfig
+	JWTVerifier      *JWTVerifier
+	JWTTokenSources  []TokenSource
+	Consumer         ConsumerConfig
+	Enrichers        EnricherChain
+	Repanic          bool
+	ForwardTLS       *tls.Config
+	ForwardSecurity  *ForwardSecurity
+	ForwardServers   []ForwardServer
+	ForwardBalancing ForwardBalancing
+	ForwardBatch     *BatchConfig
+	ForwardDelivery  *DeliveryConfig
+	enrichersConfig  map[string]interface{}
+	sinksConfig      []map[string]interface{}
 }
 
 func printOutConfigError(key string, err error) {
@@ -84,6 +136,27 @@ func ConvertToBool(key string, cfg map[string]interface{}) bool {
 	return false
 }
 
+// ConvertToDuration reads a duration string like "5s" or an integer
+// number of nanoseconds as the rest of fluentd timeouts.
+func ConvertToDuration(key string, cfg map[string]interface{}) time.Duration {
+	err := errors.New("no value found")
+	value, ok := cfg[key]
+	if ok {
+		if s, isString := value.(string); isString {
+			var d time.Duration
+			d, err = time.ParseDuration(s)
+			if err == nil {
+				return d
+			}
+		} else {
+			return time.Duration(ConvertToInt(key, cfg))
+		}
+	}
+	printOutConfigError(key, err)
+
+	return 0
+}
+
 func (f *FluentLoggerConfig) setFluentHost(cfg map[string]interface{}) {
 	f.FluentConfig.FluentHost = ConvertToString("fluent_host", cfg)
 }
@@ -137,11 +210,249 @@ func (f *FluentLoggerConfig) setForceStopAsyncSend(cfg map[string]interface{}) {
 }
 
 func (f *FluentLoggerConfig) setSubSecondPrecision(cfg map[string]interface{}) {
-	f.FluentConfig.ForceStopAsyncSend = ConvertToBool("sub_second_precision", cfg)
+	f.FluentConfig.SubSecondPrecision = ConvertToBool("sub_second_precision", cfg)
 }
 
 func (f *FluentLoggerConfig) setRequestAck(cfg map[string]interface{}) {
-	f.FluentConfig.ForceStopAsyncSend = ConvertToBool("request_ack", cfg)
+	f.FluentConfig.RequestAck = ConvertToBool("request_ack", cfg)
+}
+
+func (f *FluentLoggerConfig) setForwardTLS(cfg map[string]interface{}) {
+	key := "tls"
+
+	tlsConfig, ok := cfg[key]
+	if !ok {
+		return
+	}
+
+	tlsConfigMap, ok := tlsConfig.(map[string]interface{})
+	if !ok {
+		printOutConfigError(key, errors.New("can't convert config to right type"))
+		return
+	}
+
+	forwardTLS, err := parseTLSConfig(tlsConfigMap)
+	if err != nil {
+		printOutConfigError(key, err)
+		return
+	}
+
+	f.ForwardTLS = forwardTLS
+}
+
+// parseTLSConfig reads "ca_file", "cert_file", "key_file", "server_name"
+// and "insecure_skip_verify" of a "tls" section.
+func parseTLSConfig(tlsConfigMap map[string]interface{}) (*tls.Config, error) {
+	options := map[string]string{}
+	for _, option := range []string{"ca_file", "cert_file", "key_file", "server_name"} {
+		if _, ok := tlsConfigMap[option]; ok {
+			options[option] = ConvertToString(option, tlsConfigMap)
+		}
+	}
+	insecure := false
+	if _, ok := tlsConfigMap["insecure_skip_verify"]; ok {
+		insecure = ConvertToBool("insecure_skip_verify", tlsConfigMap)
+	}
+
+	return NewForwardTLSConfig(
+		options["ca_file"], options["cert_file"], options["key_file"], options["server_name"], insecure,
+	)
+}
+
+func (f *FluentLoggerConfig) setForwardSecurity(cfg map[string]interface{}) {
+	key := "security"
+
+	securityConfig, ok := cfg[key]
+	if !ok {
+		return
+	}
+
+	securityConfigMap, ok := securityConfig.(map[string]interface{})
+	if !ok {
+		printOutConfigError(key, errors.New("can't convert config to right type"))
+		return
+	}
+
+	secretConfig := map[string]interface{}{}
+	if sharedKeyEnv, ok := securityConfigMap["shared_key_env"]; ok {
+		secretConfig["secret_env"] = sharedKeyEnv
+	}
+	if sharedKey, ok := securityConfigMap["shared_key"]; ok {
+		secretConfig["secret"] = sharedKey
+	}
+	sharedKey, err := readSecret(secretConfig)
+	if err != nil {
+		printOutConfigError(key+".shared_key", err)
+		return
+	}
+
+	security := &ForwardSecurity{SharedKey: string(sharedKey)}
+	if _, ok := securityConfigMap["self_hostname"]; ok {
+		security.SelfHostname = ConvertToString("self_hostname", securityConfigMap)
+	} else if hostname, err := os.Hostname(); err == nil {
+		security.SelfHostname = hostname
+	}
+	if _, ok := securityConfigMap["username"]; ok {
+		security.Username = ConvertToString("username", securityConfigMap)
+	}
+	if _, ok := securityConfigMap["password_env"]; ok {
+		security.Password = os.Getenv(ConvertToString("password_env", securityConfigMap))
+	} else if _, ok := securityConfigMap["password"]; ok {
+		security.Password = ConvertToString("password", securityConfigMap)
+	}
+
+	f.ForwardSecurity = security
+}
+
+func (f *FluentLoggerConfig) setForwardServers(cfg map[string]interface{}) {
+	key := "servers"
+
+	servers, ok := cfg[key]
+	if !ok {
+		return
+	}
+
+	serversSlice, ok := servers.([]interface{})
+	if !ok {
+		printOutConfigError(key, errors.New("can't convert config to right type"))
+		return
+	}
+
+	var result []ForwardServer
+	for i, entry := range serversSlice {
+		serverConfigMap, ok := entry.(map[string]interface{})
+		if !ok {
+			printOutConfigError(fmt.Sprintf("%s[%d]", key, i), errors.New("can't convert config to right type"))
+			continue
+		}
+
+		server := ForwardServer{}
+		if _, ok := serverConfigMap["host"]; ok {
+			server.Host = ConvertToString("host", serverConfigMap)
+		}
+		if _, ok := serverConfigMap["port"]; ok {
+			server.Port = ConvertToInt("port", serverConfigMap)
+		}
+		if _, ok := serverConfigMap["network"]; ok {
+			server.Network = ConvertToString("network", serverConfigMap)
+		}
+		if _, ok := serverConfigMap["socket_path"]; ok {
+			server.SocketPath = ConvertToString("socket_path", serverConfigMap)
+		}
+		if _, ok := serverConfigMap["weight"]; ok {
+			server.Weight = ConvertToInt("weight", serverConfigMap)
+		}
+		if _, ok := serverConfigMap["standby"]; ok {
+			server.Standby = ConvertToBool("standby", serverConfigMap)
+		}
+		result = append(result, server)
+	}
+
+	f.ForwardServers = result
+}
+
+func (f *FluentLoggerConfig) setForwardBalancing(cfg map[string]interface{}) {
+	if _, ok := cfg["balancing"]; ok {
+		strategy := ConvertToString("balancing", cfg)
+		switch strategy {
+		case balancingRoundRobin, balancingLeastPending:
+			f.ForwardBalancing.Strategy = strategy
+		default:
+			printOutConfigError("balancing", fmt.Errorf("unknown strategy '%s'", strategy))
+		}
+	}
+
+	healthConfigMap, ok := cfg["health"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	if _, ok := healthConfigMap["backoff"]; ok {
+		f.ForwardBalancing.Backoff = ConvertToDuration("backoff", healthConfigMap)
+	}
+	if _, ok := healthConfigMap["max_backoff"]; ok {
+		f.ForwardBalancing.MaxBackoff = ConvertToDuration("max_backoff", healthConfigMap)
+	}
+}
+
+func (f *FluentLoggerConfig) setForwardBatch(cfg map[string]interface{}) {
+	key := "batch"
+
+	batchConfig, ok := cfg[key]
+	if !ok {
+		return
+	}
+
+	batchConfigMap, ok := batchConfig.(map[string]interface{})
+	if !ok {
+		printOutConfigError(key, errors.New("can't convert config to right type"))
+		return
+	}
+
+	batch := &BatchConfig{}
+	if _, ok := batchConfigMap["max_records"]; ok {
+		batch.MaxRecords = ConvertToInt("max_records", batchConfigMap)
+	}
+	if _, ok := batchConfigMap["max_bytes"]; ok {
+		batch.MaxBytes = ConvertToInt("max_bytes", batchConfigMap)
+	}
+	if _, ok := batchConfigMap["flush_interval"]; ok {
+		batch.FlushInterval = ConvertToDuration("flush_interval", batchConfigMap)
+	}
+	if _, ok := batchConfigMap["queue_size"]; ok {
+		batch.QueueSize = ConvertToInt("queue_size", batchConfigMap)
+	}
+	if _, ok := batchConfigMap["compression"]; ok {
+		batch.Compression = ConvertToString("compression", batchConfigMap)
+		if batch.Compression != compressionGzip {
+			printOutConfigError(key+".compression", fmt.Errorf("unknown compression '%s'", batch.Compression))
+			batch.Compression = ""
+		}
+	}
+
+	f.ForwardBatch = batch
+}
+
+func (f *FluentLoggerConfig) setForwardDelivery(cfg map[string]interface{}) {
+	key := "delivery"
+
+	deliveryConfig, ok := cfg[key]
+	if !ok {
+		return
+	}
+
+	deliveryConfigMap, ok := deliveryConfig.(map[string]interface{})
+	if !ok {
+		printOutConfigError(key, errors.New("can't convert config to right type"))
+		return
+	}
+
+	delivery := &DeliveryConfig{Mode: deliveryAtMostOnce}
+	if _, ok := deliveryConfigMap["mode"]; ok {
+		mode := ConvertToString("mode", deliveryConfigMap)
+		switch mode {
+		case deliveryAtMostOnce, deliveryAtLeastOnce:
+			delivery.Mode = mode
+		default:
+			printOutConfigError(key+".mode", fmt.Errorf("unknown mode '%s'", mode))
+		}
+	}
+	if delivery.requireAck() {
+		delivery.MaxAttempts = defaultDeliveryMaxAttempts
+	}
+	if _, ok := deliveryConfigMap["ack_timeout"]; ok {
+		delivery.AckTimeout = ConvertToDuration("ack_timeout", deliveryConfigMap)
+	}
+	if _, ok := deliveryConfigMap["max_attempts"]; ok {
+		delivery.MaxAttempts = ConvertToInt("max_attempts", deliveryConfigMap)
+	}
+	if _, ok := deliveryConfigMap["retry_wait"]; ok {
+		delivery.RetryWait = ConvertToDuration("retry_wait", deliveryConfigMap)
+	}
+	if _, ok := deliveryConfigMap["fallback_dir"]; ok {
+		delivery.FallbackDir = ConvertToString("fallback_dir", deliveryConfigMap)
+	}
+
+	f.ForwardDelivery = delivery
 }
 
 func (f *FluentLoggerConfig) setTag(cfg map[string]interface{}) {
@@ -175,6 +486,12 @@ func (f *FluentLoggerConfig) SetFluentConfig(cfg map[string]interface{}) error {
 	f.setSubSecondPrecision(fluentConfigMap)
 	f.setRequestAck(fluentConfigMap)
 	f.setTag(fluentConfigMap)
+	f.setForwardTLS(fluentConfigMap)
+	f.setForwardSecurity(fluentConfigMap)
+	f.setForwardServers(fluentConfigMap)
+	f.setForwardBalancing(fluentConfigMap)
+	f.setForwardBatch(fluentConfigMap)
+	f.setForwardDelivery(fluentConfigMap)
 
 	return nil
 }
@@ -195,18 +512,304 @@ func (f *FluentLoggerConfig) SetSkipConfig(cfg map[string]interface{}) error {
 
 func (f *FluentLoggerConfig) SetJWTClaimsConfig(cfg map[string]interface{}) error {
 	claims, ok := cfg["include_jwt_claims"]
-	claimsMap := map[string]struct{}{}
+	f.JWTClaims = JWTClaimsConfig{}
 
 	if !ok {
-		f.JWTClaims = claimsMap
 		return errors.New("no 'include_jwt_claims' key found")
 	}
-	sliceToMap(claims.([]interface{}), claimsMap)
-	f.JWTClaims = claimsMap
+
+	claimsSlice, ok := claims.([]interface{})
+	if !ok {
+		return errors.New("can't convert 'include_jwt_claims' to right type")
+	}
+
+	for _, entry := range claimsSlice {
+		claim, err := f.parseJWTClaim(entry)
+		if err != nil {
+			printOutConfigError("include_jwt_claims", err)
+			continue
+		}
+		f.JWTClaims.Claims = append(f.JWTClaims.Claims, claim)
+	}
+
+	if _, ok := cfg["jwt_claims_prefix"]; ok {
+		f.JWTClaims.Prefix = ConvertToString("jwt_claims_prefix", cfg)
+	}
+	if _, ok := cfg["jwt_claims_field"]; ok {
+		field := ConvertToString("jwt_claims_field", cfg)
+		if isRecordField(nil, field) {
+			printOutConfigError("jwt_claims_field", fmt.Errorf("'%s' is a record field", field))
+		} else {
+			f.JWTClaims.Field = field
+		}
+	}
 
 	return nil
 }
 
+// parseJWTClaim accepts a claim name or an object
+// {"claim": "realm_access.roles", "name": "roles", "strategy": ...}.
+func (f *FluentLoggerConfig) parseJWTClaim(entry interface{}) (JWTClaim, error) {
+	claim := JWTClaim{}
+
+	switch e := entry.(type) {
+	case string:
+		claim.Claim = e
+	case map[string]interface{}:
+		name, ok := e["claim"].(string)
+		if !ok {
+			return claim, errors.New("no 'claim' key found")
+		}
+		claim.Claim = name
+		if n, ok := e["name"]; ok {
+			claim.Name = fmt.Sprintf("%v", n)
+		}
+		if ref, ok := e["strategy"]; ok {
+			claim.Strategy = resolveMaskStrategy(
+				fmt.Sprintf("jwt claim strategy of '%s'", name), ref, f.Mask.strategies,
+			)
+		}
+	default:
+		return claim, errors.New("claim should be a string or an object")
+	}
+
+	if claim.Name == "" {
+		claim.Name = claim.Claim
+	}
+	if selector, err := ParseSelector(claim.Claim, false); err == nil {
+		claim.selector = &selector
+	}
+
+	return claim, nil
+}
+
+func (f *FluentLoggerConfig) setJWTVerificationConfig(cfg map[string]interface{}) {
+	key := "jwt_verification"
+
+	verificationConfig, ok := cfg[key]
+	if !ok {
+		return
+	}
+
+	verificationConfigMap, ok := verificationConfig.(map[string]interface{})
+	if !ok {
+		printOutConfigError(key, errors.New("can't convert config to right type"))
+		return
+	}
+
+	verifier := &JWTVerifier{Unverified: unverifiedClaimsDrop, keys: map[string]interface{}{}}
+
+	if _, ok := verificationConfigMap["jwks_file"]; ok {
+		keys, err := LoadJWKS(ConvertToString("jwks_file", verificationConfigMap))
+		if err != nil {
+			printOutConfigError(key+".jwks_file", err)
+		} else {
+			verifier.keys = keys
+		}
+	}
+	if _, ok := verificationConfigMap["pem_file"]; ok {
+		pemKey, err := LoadPEMPublicKey(ConvertToString("pem_file", verificationConfigMap))
+		if err != nil {
+			printOutConfigError(key+".pem_file", err)
+		} else {
+			verifier.pemKey = pemKey
+		}
+	}
+	if _, ok := verificationConfigMap["hmac_secret_env"]; ok {
+		secret, err := readSecret(map[string]interface{}{"secret_env": verificationConfigMap["hmac_secret_env"]})
+		if err != nil {
+			printOutConfigError(key+".hmac_secret_env", err)
+		} else {
+			verifier.hmacSecret = secret
+		}
+	}
+	if _, ok := verificationConfigMap["issuer"]; ok {
+		verifier.Issuer = ConvertToString("issuer", verificationConfigMap)
+	}
+	switch audience := verificationConfigMap["audience"].(type) {
+	case string:
+		verifier.Audience = []string{audience}
+	case []interface{}:
+		verifier.Audience = interfaceSliceToStrings(audience)
+	}
+	if _, ok := verificationConfigMap["unverified_claims"]; ok {
+		verifier.Unverified = ConvertToString("unverified_claims", verificationConfigMap)
+		if verifier.Unverified != unverifiedClaimsDrop && verifier.Unverified != unverifiedClaimsMark {
+			printOutConfigError(key+".unverified_claims", fmt.Errorf("unknown value '%s'", verifier.Unverified))
+			verifier.Unverified = unverifiedClaimsDrop
+		}
+	}
+
+	f.JWTVerifier = verifier
+}
+
+func (f *FluentLoggerConfig) setJWTTokenSourcesConfig(cfg map[string]interface{}) {
+	key := "jwt_token_sources"
+	f.JWTTokenSources = defaultTokenSources
+
+	sources, ok := cfg[key]
+	if !ok {
+		return
+	}
+
+	sourcesSlice, ok := sources.([]interface{})
+	if !ok {
+		printOutConfigError(key, errors.New("can't convert config to right type"))
+		return
+	}
+
+	var result []TokenSource
+	for _, entry := range sourcesSlice {
+		sourceMap, ok := entry.(map[string]interface{})
+		if !ok {
+			printOutConfigError(key, errors.New("token source should be an object"))
+			continue
+		}
+
+		source := TokenSource{}
+		for field, target := range map[string]*string{
+			"header": &source.Header, "scheme": &source.Scheme, "cookie": &source.Cookie, "query": &source.Query,
+		} {
+			if _, ok := sourceMap[field]; ok {
+				*target = ConvertToString(field, sourceMap)
+			}
+		}
+		if source.Header == "" && source.Cookie == "" && source.Query == "" {
+			printOutConfigError(key, errors.New("token source needs 'header', 'cookie' or 'query' key"))
+			continue
+		}
+		if source.Cookie != "" {
+			f.maskSecret("request.cookies", source.Cookie)
+		}
+		if source.Query != "" {
+			f.maskSecret("request.query", source.Query)
+		}
+		result = append(result, source)
+	}
+
+	f.JWTTokenSources = result
+}
+
+func (f *FluentLoggerConfig) setConsumerConfig(cfg map[string]interface{}) {
+	key := "consumer"
+
+	consumerConfig, ok := cfg[key]
+	if !ok {
+		return
+	}
+
+	consumerConfigMap, ok := consumerConfig.(map[string]interface{})
+	if !ok {
+		printOutConfigError(key, errors.New("can't convert config to right type"))
+		return
+	}
+
+	if _, ok := consumerConfigMap["hmac_secret_env"]; ok {
+		secret, err := readSecret(map[string]interface{}{"secret_env": consumerConfigMap["hmac_secret_env"]})
+		if err != nil {
+			printOutConfigError(key+".hmac_secret_env", err)
+		} else {
+			f.Consumer.secret = secret
+		}
+	}
+
+	sources, ok := consumerConfigMap["sources"].([]interface{})
+	if !ok {
+		printOutConfigError(key+".sources", errors.New("no sources found"))
+		return
+	}
+
+	for _, entry := range sources {
+		sourceMap, ok := entry.(map[string]interface{})
+		if !ok {
+			printOutConfigError(key+".sources", errors.New("source should be an object"))
+			continue
+		}
+
+		source := IdentitySource{Type: fmt.Sprintf("%v", sourceMap["type"]), IDClaim: "sub"}
+		for field, target := range map[string]*string{
+			"id_claim": &source.IDClaim, "name_claim": &source.NameClaim, "header": &source.Header, "query": &source.Query,
+		} {
+			if _, ok := sourceMap[field]; ok {
+				*target = ConvertToString(field, sourceMap)
+			}
+		}
+
+		switch source.Type {
+		case consumerTypeMTLS, consumerTypeBasic:
+		case consumerTypeJWT:
+			if f.JWTVerifier == nil {
+				printOutConfigError(key+".sources", errors.New("'jwt' source needs 'jwt_verification'"))
+				continue
+			}
+		case consumerTypeAPIKey:
+			if f.Consumer.secret == nil {
+				printOutConfigError(key+".sources", errors.New("'api_key' source needs 'hmac_secret_env'"))
+				continue
+			}
+			if source.Header != "" {
+				f.maskSecret("request.headers", source.Header)
+			}
+			if source.Query != "" {
+				f.maskSecret("request.query", source.Query)
+			}
+		default:
+			printOutConfigError(key+".sources", fmt.Errorf("unknown source type '%s'", source.Type))
+			continue
+		}
+		f.Consumer.Sources = append(f.Consumer.Sources, source)
+	}
+}
+
+func (f *FluentLoggerConfig) setEnrichersConfig(cfg map[string]interface{}) {
+	key := "enrichers"
+	f.enrichersConfig = map[string]interface{}{}
+
+	enrichersConfig, ok := cfg[key]
+	if !ok {
+		return
+	}
+
+	enrichersConfigMap, ok := enrichersConfig.(map[string]interface{})
+	if !ok {
+		printOutConfigError(key, errors.New("can't convert config to right type"))
+		return
+	}
+
+	f.enrichersConfig = enrichersConfigMap
+}
+
+func (f *FluentLoggerConfig) setSinksConfig(cfg map[string]interface{}) {
+	key := "sinks"
+
+	sinks, ok := cfg[key]
+	if !ok {
+		return
+	}
+
+	sinksSlice, ok := sinks.([]interface{})
+	if !ok {
+		printOutConfigError(key, errors.New("can't convert config to right type"))
+		return
+	}
+
+	for i, entry := range sinksSlice {
+		sinkConfigMap, ok := entry.(map[string]interface{})
+		if !ok {
+			printOutConfigError(fmt.Sprintf("%s[%d]", key, i), errors.New("can't convert config to right type"))
+			continue
+		}
+		f.sinksConfig = append(f.sinksConfig, sinkConfigMap)
+	}
+}
+
+func (f *FluentLoggerConfig) setRepanicConfig(cfg map[string]interface{}) {
+	f.Repanic = true
+	if _, ok := cfg["repanic"]; ok {
+		f.Repanic = ConvertToBool("repanic", cfg)
+	}
+}
+
 func (f *FluentLoggerConfig) setBodyLoggingOptions(cfg map[string]interface{}) error {
 	// 30 Mb
 	defaultBodyLimit := int64(30)
@@ -233,7 +836,6 @@ func (f *FluentLoggerConfig) setBodyLoggingOptions(cfg map[string]interface{}) e
 	if err != nil {
 		f.Request.allowedContentTypes = defaultAllowedContentTypes
 	} else {
-		delete(requestContentTypes, "multipart/form-data")
 		f.Request.allowedContentTypes = requestContentTypes
 	}
 
@@ -241,7 +843,6 @@ func (f *FluentLoggerConfig) setBodyLoggingOptions(cfg map[string]interface{}) e
 	if err != nil {
 		f.Response.allowedContentTypes = defaultAllowedContentTypes
 	} else {
-		delete(requestContentTypes, "multipart/form-data")
 		f.Response.allowedContentTypes = responseContentTypes
 	}
 
@@ -302,14 +903,36 @@ func (f *FluentLoggerConfig) setMaskConfig(cfg map[string]interface{}) {
 		return
 	}
 
-	f.Mask.Request = f.setMaskingConfig(maskConfig, "request")
-	f.Mask.Response = f.setMaskingConfig(maskConfig, "response")
+	maskConfigMap, ok := maskConfig.(map[string]interface{})
+	if !ok {
+		printOutConfigError(key, errors.New("can't convert config to right type"))
+		return
+	}
+
+	if _, ok := maskConfigMap["case_insensitive"]; ok {
+		f.Mask.CaseInsensitive = ConvertToBool("case_insensitive", maskConfigMap)
+	}
+
+	named := map[string]MaskStrategy{}
+	if strategies, ok := maskConfigMap["strategies"].(map[string]interface{}); ok {
+		named = parseMaskStrategies(strategies)
+	}
+	defaultStrategy := resolveMaskStrategy("mask.default_strategy", defaultMaskStrategy, named)
+	if ref, ok := maskConfigMap["default_strategy"]; ok {
+		defaultStrategy = resolveMaskStrategy("mask.default_strategy", ref, named)
+	}
+
+	f.Mask.strategies = named
+	f.Mask.rules = map[string][]MaskRule{}
+	f.Mask.Request = f.setMaskingConfig(maskConfigMap, "request", defaultStrategy, named)
+	f.Mask.Response = f.setMaskingConfig(maskConfigMap, "response", defaultStrategy, named)
 }
 
-func (f *FluentLoggerConfig) setMaskingConfig(cfg interface{}, key string) map[string][]string {
+func (f *FluentLoggerConfig) setMaskingConfig(
+	cfg map[string]interface{}, key string, defaultStrategy MaskStrategy, named map[string]MaskStrategy,
+) map[string][]string {
 	result := make(map[string][]string)
-	maskConfigMap := cfg.(map[string]interface{})
-	config, ok := maskConfigMap[key]
+	config, ok := cfg[key]
 
 	if !ok {
 		printOutConfigError(
@@ -317,25 +940,93 @@ func (f *FluentLoggerConfig) setMaskingConfig(cfg interface{}, key string) map[s
 		)
 		return result
 	}
-	configConfigMap := config.(map[string]interface{})
-	for k, v := range stringInterfaceToStringString(configConfigMap) {
-		name := strings.Join([]string{key, k}, ".")
-		result[name] = v
+	configConfigMap, ok := config.(map[string]interface{})
+	if !ok {
+		printOutConfigError(fmt.Sprintf("mask.%s", key), errors.New("can't convert config to right type"))
+		return result
+	}
+
+	for target, entries := range configConfigMap {
+		name := strings.Join([]string{key, target}, ".")
+		entriesSlice, ok := entries.([]interface{})
+		if !ok {
+			printOutConfigError(fmt.Sprintf("mask.%s", name), errors.New("can't convert config to right type"))
+			continue
+		}
+
+		for _, entry := range entriesSlice {
+			rule, err := parseMaskRule(entry, defaultStrategy, named)
+			if err != nil {
+				printOutConfigError(fmt.Sprintf("mask.%s", name), err)
+				continue
+			}
+			if target == "body" {
+				rule.selector, err = ParseSelector(rule.Field, f.Mask.CaseInsensitive)
+				if err != nil {
+					printOutConfigError(fmt.Sprintf("mask.%s", name), err)
+					continue
+				}
+			}
+			result[name] = append(result[name], rule.Field)
+			f.Mask.rules[name] = append(f.Mask.rules[name], rule)
+		}
 	}
 
 	return result
 }
 
-func stringInterfaceToStringString(data map[string]interface{}) map[string][]string {
-	requestMaskMap := map[string][]string{}
-	for k1, v1 := range data {
-		var maskSlice []string
-		for _, v2 := range v1.([]interface{}) {
-			maskSlice = append(maskSlice, v2.(string))
+// parseMaskRule accepts either a field name, masked with the default
+// strategy, or an object {"field": "...", "strategy": "name" | {...}}.
+func parseMaskRule(entry interface{}, defaultStrategy MaskStrategy, named map[string]MaskStrategy) (MaskRule, error) {
+	switch e := entry.(type) {
+	case string:
+		return MaskRule{Field: e, Strategy: defaultStrategy}, nil
+	case map[string]interface{}:
+		field, ok := e["field"].(string)
+		if !ok {
+			return MaskRule{}, errors.New("no 'field' key found")
+		}
+		rule := MaskRule{Field: field, Strategy: defaultStrategy}
+		if ref, ok := e["strategy"]; ok {
+			rule.Strategy = resolveMaskStrategy(fmt.Sprintf("mask strategy of '%s'", field), ref, named)
+		}
+		return rule, nil
+	}
+
+	return MaskRule{}, errors.New("mask entry should be a string or an object")
+}
+
+// maskSecret masks values of the header, cookie or parameter name in
+// target, like "request.query", with the "redact" strategy unless a rule
+// for it is configured.
+func (f *FluentLoggerConfig) maskSecret(target, name string) {
+	headers := target == "request.headers"
+	for _, rule := range f.Mask.rules[target] {
+		if rule.Field == name || headers && strings.EqualFold(rule.Field, name) || !headers && rule.Field == "*" {
+			return
 		}
-		requestMaskMap[k1] = maskSlice
 	}
-	return requestMaskMap
+	if f.Mask.rules == nil {
+		f.Mask.rules = map[string][]MaskRule{}
+	}
+	redact, _ := newRedactStrategy(map[string]interface{}{})
+	f.Mask.rules[target] = append(f.Mask.rules[target], MaskRule{Field: name, Strategy: redact})
+}
+
+// logsQuery reports whether records get "request.query". Query strings
+// often carry tokens, so they are logged only when scanned by redact or
+// masked by "mask.request.query".
+func (f *FluentLoggerConfig) logsQuery() bool {
+	return f.Redact.enabled("request.query") || len(f.Mask.Request["request.query"]) > 0
+}
+
+func interfaceSliceToStrings(items []interface{}) []string {
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		result = append(result, fmt.Sprintf("%v", item))
+	}
+
+	return result
 }
 
 func sliceToMap(skipSlice []interface{}, skipMap map[string]struct{}) {
@@ -345,3 +1036,265 @@ func sliceToMap(skipSlice []interface{}, skipMap map[string]struct{}) {
 		}
 	}
 }
+
+func (f *FluentLoggerConfig) setHeadersConfig(cfg map[string]interface{}) {
+	key := "headers"
+
+	headersConfig, ok := cfg[key]
+	if !ok {
+		return
+	}
+
+	headersConfigMap, ok := headersConfig.(map[string]interface{})
+	if !ok {
+		printOutConfigError(key, errors.New("can't convert config to right type"))
+		return
+	}
+
+	f.Headers.Request = parseHeaderFilter(headersConfigMap, "request")
+	f.Headers.Response = parseHeaderFilter(headersConfigMap, "response")
+}
+
+func parseHeaderFilter(cfg map[string]interface{}, key string) HeaderFilter {
+	filter := HeaderFilter{}
+	filterConfig, ok := cfg[key].(map[string]interface{})
+	if !ok {
+		return filter
+	}
+
+	if allow, ok := filterConfig["allow"].([]interface{}); ok {
+		filter.Allow = interfaceSliceToStrings(allow)
+	}
+	if deny, ok := filterConfig["deny"].([]interface{}); ok {
+		filter.Deny = interfaceSliceToStrings(deny)
+	}
+
+	return filter
+}
+
+func (f *FluentLoggerConfig) setFlatHeadersConfig(cfg map[string]interface{}) {
+	key := "flat_headers"
+	f.FlatHeaders = map[string]string{}
+
+	flatHeadersConfig, ok := cfg[key]
+	if !ok {
+		return
+	}
+
+	flatHeadersConfigMap, ok := flatHeadersConfig.(map[string]interface{})
+	if !ok {
+		printOutConfigError(key, errors.New("can't convert config to right type"))
+		return
+	}
+
+	for _, direction := range []string{"request", "response"} {
+		entries, ok := flatHeadersConfigMap[direction].([]interface{})
+		if !ok {
+			continue
+		}
+
+		for _, entry := range entries {
+			var header, name string
+			switch e := entry.(type) {
+			case string:
+				header = e
+			case map[string]interface{}:
+				header = fmt.Sprintf("%v", e["header"])
+				if n, ok := e["name"]; ok {
+					name = fmt.Sprintf("%v", n)
+				}
+			default:
+				printOutConfigError(
+					fmt.Sprintf("%s.%s", key, direction), errors.New("entry should be a string or an object"),
+				)
+				continue
+			}
+
+			header = http.CanonicalHeaderKey(header)
+			if name == "" {
+				name = flatHeaderName(direction, header)
+			}
+			if _, reserved := recordFields[name]; reserved {
+				printOutConfigError(
+					fmt.Sprintf("%s.%s", key, direction), fmt.Errorf("field '%s' of '%s' is a record field", name, header),
+				)
+				continue
+			}
+			f.FlatHeaders[strings.Join([]string{direction, header}, ".")] = name
+		}
+	}
+}
+
+func (f *FluentLoggerConfig) setProjectionConfig(cfg map[string]interface{}) {
+	key := "projection"
+
+	projectionConfig, ok := cfg[key]
+	if !ok {
+		return
+	}
+
+	projectionConfigMap, ok := projectionConfig.(map[string]interface{})
+	if !ok {
+		printOutConfigError(key, errors.New("can't convert config to right type"))
+		return
+	}
+
+	f.Projection = parseProjectionConfig(projectionConfigMap)
+
+	endpoints, ok := projectionConfigMap["endpoints"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	f.Projection.Endpoints = map[string]ProjectionConfig{}
+	for endpoint, endpointConfig := range endpoints {
+		endpointConfigMap, ok := endpointConfig.(map[string]interface{})
+		if !ok {
+			printOutConfigError(
+				fmt.Sprintf("%s.endpoints.%s", key, endpoint), errors.New("can't convert config to right type"),
+			)
+			continue
+		}
+		f.Projection.Endpoints[endpoint] = parseProjectionConfig(endpointConfigMap)
+	}
+}
+
+func parseProjectionConfig(cfg map[string]interface{}) ProjectionConfig {
+	return ProjectionConfig{
+		Request:  parseProjectionRule(cfg, "request"),
+		Response: parseProjectionRule(cfg, "response"),
+	}
+}
+
+func parseProjectionRule(cfg map[string]interface{}, key string) *ProjectionRule {
+	ruleConfig, ok := cfg[key].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	fields, ok := ruleConfig["fields"].([]interface{})
+	if !ok {
+		printOutConfigError(fmt.Sprintf("projection.%s.fields", key), errors.New("no fields found"))
+		return nil
+	}
+
+	rule := &ProjectionRule{Fields: interfaceSliceToStrings(fields)}
+	if _, ok := ruleConfig["placeholder"]; ok {
+		rule.Placeholder = ConvertToBool("placeholder", ruleConfig)
+	}
+	if _, ok := ruleConfig["case_insensitive"]; ok {
+		rule.CaseInsensitive = ConvertToBool("case_insensitive", ruleConfig)
+	}
+	rule.selectors = ParseSelectors(fmt.Sprintf("projection.%s.fields", key), rule.Fields, rule.CaseInsensitive)
+
+	return rule
+}
+
+func (f *FluentLoggerConfig) setRedactConfig(cfg map[string]interface{}) {
+	key := "redact"
+
+	redactConfig, ok := cfg[key]
+	if !ok {
+		return
+	}
+
+	redactConfigMap, ok := redactConfig.(map[string]interface{})
+	if !ok {
+		printOutConfigError(key, errors.New("can't convert config to right type"))
+		return
+	}
+
+	scanner := &Scanner{Targets: map[string]struct{}{}}
+
+	detectors, ok := redactConfigMap["detectors"].([]interface{})
+	if !ok {
+		detectors = []interface{}{"pan", "email", "phone", "iban", "jwt", "aws_key"}
+	}
+	for _, entry := range detectors {
+		detector, err := f.parseDetector(entry)
+		if err != nil {
+			printOutConfigError("redact.detectors", err)
+			continue
+		}
+		scanner.Detectors = append(scanner.Detectors, detector)
+	}
+
+	if custom, ok := redactConfigMap["custom"].([]interface{}); ok {
+		for _, entry := range custom {
+			detector, err := f.parseCustomDetector(entry)
+			if err != nil {
+				printOutConfigError("redact.custom", err)
+				continue
+			}
+			scanner.Detectors = append(scanner.Detectors, detector)
+		}
+	}
+
+	if targets, ok := redactConfigMap["targets"].([]interface{}); ok {
+		sliceToMap(targets, scanner.Targets)
+	} else {
+		for _, target := range defaultRedactTargets {
+			scanner.Targets[target] = struct{}{}
+		}
+	}
+
+	f.Redact = scanner
+}
+
+// parseDetector accepts a built-in detector name or an object
+// {"name": "pan", "strategy": ...}.
+func (f *FluentLoggerConfig) parseDetector(entry interface{}) (Detector, error) {
+	var (
+		name     string
+		strategy interface{}
+	)
+
+	switch e := entry.(type) {
+	case string:
+		name = e
+	case map[string]interface{}:
+		name = fmt.Sprintf("%v", e["name"])
+		strategy = e["strategy"]
+	default:
+		return Detector{}, errors.New("detector should be a name or an object")
+	}
+
+	builder, ok := builtinDetectors[name]
+	if !ok {
+		return Detector{}, fmt.Errorf("unknown detector '%s'", name)
+	}
+	detector := builder()
+	detector.Strategy = f.detectorStrategy(name, strategy)
+
+	return detector, nil
+}
+
+// parseCustomDetector reads {"name": "...", "pattern": "...", "strategy": ...}.
+func (f *FluentLoggerConfig) parseCustomDetector(entry interface{}) (Detector, error) {
+	e, ok := entry.(map[string]interface{})
+	if !ok {
+		return Detector{}, errors.New("custom detector should be an object")
+	}
+
+	name := fmt.Sprintf("%v", e["name"])
+	pattern, ok := e["pattern"].(string)
+	if !ok {
+		return Detector{}, fmt.Errorf("no 'pattern' key found for '%s' detector", name)
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return Detector{}, fmt.Errorf("detector '%s': %v", name, err)
+	}
+
+	return Detector{Name: name, Pattern: re, Strategy: f.detectorStrategy(name, e["strategy"])}, nil
+}
+
+func (f *FluentLoggerConfig) detectorStrategy(name string, ref interface{}) MaskStrategy {
+	if ref == nil {
+		strategy, _ := newRedactStrategy(map[string]interface{}{"replacement": fmt.Sprintf("[REDACTED:%s]", name)})
+		return strategy
+	}
+
+	return resolveMaskStrategy(fmt.Sprintf("redact strategy of '%s'", name), ref, f.Mask.strategies)
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// sinkConn is a connection of a sink writing to a socket. It is dialed
+// lazily and dropped after errors, so the next write dials it again.
+// Writes taking longer than writeTimeout, if set, fail, so a stalled peer
+// does not block the sink.
+type sinkConn struct {
+	dial         func() (net.Conn, error)
+	writeTimeout time.Duration
+	mu           sync.Mutex
+	conn         net.Conn
+}
+
+func newSinkConn(dial func() (net.Conn, error), writeTimeout time.Duration) *sinkConn {
+	return &sinkConn{dial: dial, writeTimeout: writeTimeout}
+}
+
+// write calls send with the connection, reconnecting once if the
+// connection turns out to be broken, then calls read, if not nil, to get
+// the response. A read failure drops the connection but is not retried,
+// as the message has already been sent.
+func (c *sinkConn) write(send, read func(conn net.Conn) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if c.conn == nil {
+			if c.conn, err = c.dial(); err != nil {
+				c.conn = nil
+				continue
+			}
+		}
+		if c.writeTimeout > 0 {
+			if err = c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+				c.disconnect()
+				continue
+			}
+		}
+		if err = send(c.conn); err != nil {
+			c.disconnect()
+			continue
+		}
+		if read != nil {
+			if err = read(c.conn); err != nil {
+				c.disconnect()
+			}
+		}
+		return err
+	}
+
+	return err
+}
+
+func (c *sinkConn) disconnect() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn = nil
+}
+
+func (c *sinkConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.disconnect()
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSinkConnWrite(t *testing.T) {
+	errWrite := errors.New("write failed")
+	errRead := errors.New("read failed")
+
+	tests := []struct {
+		name      string
+		dialErrs  int
+		sendErrs  int
+		readErr   error
+		wantErr   error
+		wantDials int
+		wantSends int
+	}{
+		{name: "sent", wantDials: 1, wantSends: 1},
+		{name: "reconnected once", sendErrs: 1, wantDials: 2, wantSends: 2},
+		{name: "failed twice", sendErrs: 2, wantErr: errWrite, wantDials: 2, wantSends: 2},
+		{name: "dial failed once", dialErrs: 1, wantDials: 2, wantSends: 1},
+		{name: "read failure is not retried", readErr: errRead, wantErr: errRead, wantDials: 1, wantSends: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dials, sends := 0, 0
+			conn := newSinkConn(func() (net.Conn, error) {
+				dials++
+				if dials <= tt.dialErrs {
+					return nil, errors.New("dial failed")
+				}
+				client, server := net.Pipe()
+				server.Close()
+				return client, nil
+			}, 0)
+			defer conn.Close()
+
+			err := conn.write(func(net.Conn) error {
+				sends++
+				if sends <= tt.sendErrs {
+					return errWrite
+				}
+				return nil
+			}, func(net.Conn) error { return tt.readErr })
+
+			if err != tt.wantErr || dials != tt.wantDials || sends != tt.wantSends {
+				t.Errorf("write() = %v with %d dials, %d sends, want %v with %d, %d",
+					err, dials, sends, tt.wantErr, tt.wantDials, tt.wantSends)
+			}
+			if (conn.conn == nil) != (err != nil) {
+				t.Errorf("connection kept = %v after error %v", conn.conn != nil, err)
+			}
+		})
+	}
+}
+
+func TestSinkConnWriteTimeout(t *testing.T) {
+	dials := 0
+	conn := newSinkConn(func() (net.Conn, error) {
+		dials++
+		client, _ := net.Pipe()
+		return client, nil
+	}, 20*time.Millisecond)
+	defer conn.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.write(func(c net.Conn) error {
+			_, err := c.Write([]byte("stalled"))
+			return err
+		}, nil)
+	}()
+
+	select {
+	case err := <-done:
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Errorf("write() = %v, want a timeout", err)
+		}
+		if dials != 2 {
+			t.Errorf("dials = %d, want 2", dials)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write to a stalled peer did not time out")
+	}
+}
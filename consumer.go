@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	consumerTypeJWT    = "jwt"
+	consumerTypeAPIKey = "api_key"
+	consumerTypeMTLS   = "mtls"
+	consumerTypeBasic  = "basic"
+)
+
+type Consumer struct {
+	ID   string
+	Type string
+	Name string
+}
+
+// IdentitySource is a single way to identify a consumer. Type is one of
+// "jwt", "api_key", "mtls" or "basic".
+type IdentitySource struct {
+	Type      string
+	IDClaim   string
+	NameClaim string
+	Header    string
+	Query     string
+}
+
+// ConsumerConfig resolves consumer identity trying Sources in order.
+// API keys are never logged as is, only as HMAC keyed with secret.
+type ConsumerConfig struct {
+	Sources []IdentitySource
+	secret  []byte
+}
+
+func (c ConsumerConfig) needsJWT() bool {
+	for _, source := range c.Sources {
+		if source.Type == consumerTypeJWT {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Resolve returns the consumer of the request. claims are verified token
+// claims, nil if there is no verified token; unverified claims must never
+// be passed here as anyone can forge them.
+func (c ConsumerConfig) Resolve(r *http.Request, claims jwt.MapClaims) (Consumer, bool) {
+	for _, source := range c.Sources {
+		if consumer, ok := c.resolve(source, r, claims); ok {
+			return consumer, true
+		}
+	}
+
+	return Consumer{}, false
+}
+
+func (c ConsumerConfig) resolve(source IdentitySource, r *http.Request, claims jwt.MapClaims) (Consumer, bool) {
+	switch source.Type {
+	case consumerTypeJWT:
+		id, ok := claims[source.IDClaim]
+		if !ok {
+			return Consumer{}, false
+		}
+		consumer := Consumer{ID: fmt.Sprintf("%v", id), Type: consumerTypeJWT}
+		if name, ok := claims[source.NameClaim]; ok {
+			consumer.Name = fmt.Sprintf("%v", name)
+		}
+		return consumer, true
+	case consumerTypeAPIKey:
+		key := ""
+		if source.Header != "" {
+			key = r.Header.Get(source.Header)
+		}
+		if key == "" && source.Query != "" {
+			key = r.URL.Query().Get(source.Query)
+		}
+		if key == "" || c.secret == nil {
+			return Consumer{}, false
+		}
+		return Consumer{ID: hmacSHA256(c.secret, key), Type: consumerTypeAPIKey}, true
+	case consumerTypeMTLS:
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return Consumer{}, false
+		}
+		certificate := r.TLS.PeerCertificates[0]
+		return Consumer{
+			ID:   certificate.SerialNumber.Text(16),
+			Type: consumerTypeMTLS,
+			Name: certificate.Subject.String(),
+		}, true
+	case consumerTypeBasic:
+		username, _, ok := r.BasicAuth()
+		if !ok || username == "" {
+			return Consumer{}, false
+		}
+		return Consumer{ID: username, Type: consumerTypeBasic, Name: username}, true
+	}
+
+	return Consumer{}, false
+}
+
+// AddConsumerData adds "consumer.id", "consumer.type" and "consumer.name"
+// of the resolved consumer to data.
+func AddConsumerData(data map[string]interface{}, conf ConsumerConfig, r *http.Request, claims jwt.MapClaims) {
+	consumer, ok := conf.Resolve(r, claims)
+	if !ok {
+		return
+	}
+
+	data["consumer.id"] = consumer.ID
+	data["consumer.type"] = consumer.Type
+	if consumer.Name != "" {
+		data["consumer.name"] = consumer.Name
+	}
+}
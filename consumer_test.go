@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestConsumerResolve(t *testing.T) {
+	conf := ConsumerConfig{
+		Sources: []IdentitySource{
+			{Type: consumerTypeJWT, IDClaim: "sub", NameClaim: "name"},
+			{Type: consumerTypeAPIKey, Header: "X-Api-Key", Query: "api_key"},
+			{Type: consumerTypeMTLS},
+			{Type: consumerTypeBasic},
+		},
+		secret: []byte("secret"),
+	}
+
+	tests := []struct {
+		name    string
+		request func(r *http.Request)
+		claims  jwt.MapClaims
+		want    Consumer
+		ok      bool
+	}{
+		{
+			name:    "verified jwt",
+			request: func(r *http.Request) {},
+			claims:  jwt.MapClaims{"sub": "u1", "name": "User"},
+			want:    Consumer{ID: "u1", Type: consumerTypeJWT, Name: "User"},
+			ok:      true,
+		},
+		{
+			name:    "api key header is hashed",
+			request: func(r *http.Request) { r.Header.Set("X-Api-Key", "key1") },
+			want:    Consumer{ID: hmacSHA256([]byte("secret"), "key1"), Type: consumerTypeAPIKey},
+			ok:      true,
+		},
+		{
+			name:    "api key query",
+			request: func(r *http.Request) { r.URL.RawQuery = "api_key=key2" },
+			want:    Consumer{ID: hmacSHA256([]byte("secret"), "key2"), Type: consumerTypeAPIKey},
+			ok:      true,
+		},
+		{
+			name: "client certificate",
+			request: func(r *http.Request) {
+				r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+					{SerialNumber: big.NewInt(255), Subject: pkix.Name{CommonName: "svc"}},
+				}}
+			},
+			want: Consumer{ID: "ff", Type: consumerTypeMTLS, Name: "CN=svc"},
+			ok:   true,
+		},
+		{
+			name:    "basic auth",
+			request: func(r *http.Request) { r.SetBasicAuth("bob", "pass") },
+			want:    Consumer{ID: "bob", Type: consumerTypeBasic, Name: "bob"},
+			ok:      true,
+		},
+		{
+			name:    "sources are tried in order",
+			request: func(r *http.Request) { r.SetBasicAuth("bob", "pass") },
+			claims:  jwt.MapClaims{"sub": "u1"},
+			want:    Consumer{ID: "u1", Type: consumerTypeJWT},
+			ok:      true,
+		},
+		{
+			name:    "nothing",
+			request: func(r *http.Request) {},
+			ok:      false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			tt.request(r)
+			got, ok := conf.Resolve(r, tt.claims)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("Resolve() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestConsumerFromForgedToken(t *testing.T) {
+	secret := []byte("secret")
+	forged := signToken(t, jwt.SigningMethodHS256, []byte("attacker"), "", jwt.MapClaims{"sub": "admin"})
+	valid := signToken(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{"sub": "u1"})
+	consumer := ConsumerConfig{Sources: []IdentitySource{{Type: consumerTypeJWT, IDClaim: "sub"}}}
+	claimsConfig := JWTClaimsConfig{Claims: []JWTClaim{{Claim: "sub", Name: "sub"}}}
+
+	tests := []struct {
+		name     string
+		token    string
+		verifier *JWTVerifier
+		want     map[string]interface{}
+	}{
+		{
+			name:     "verified token",
+			token:    valid,
+			verifier: &JWTVerifier{hmacSecret: secret, Unverified: unverifiedClaimsDrop},
+			want: map[string]interface{}{
+				"jwt.verified": true, "sub": "u1", "consumer.id": "u1", "consumer.type": consumerTypeJWT,
+			},
+		},
+		{
+			name:     "forged token with claims dropped",
+			token:    forged,
+			verifier: &JWTVerifier{hmacSecret: secret, Unverified: unverifiedClaimsDrop},
+			want:     map[string]interface{}{"jwt.verified": false},
+		},
+		{
+			name:     "forged token with claims kept for the log",
+			token:    forged,
+			verifier: &JWTVerifier{hmacSecret: secret, Unverified: unverifiedClaimsMark},
+			want: map[string]interface{}{
+				"jwt.verified": false, "jwt.error": "signature is invalid", "sub": "admin",
+			},
+		},
+		{
+			name:     "no verifier",
+			token:    forged,
+			verifier: nil,
+			want:     map[string]interface{}{"sub": "admin"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := map[string]interface{}{}
+			claims, _ := AddJwtData(data, claimsConfig, tt.token, tt.verifier)
+			AddConsumerData(data, consumer, httptest.NewRequest(http.MethodGet, "/", nil), claims)
+			if !reflect.DeepEqual(data, tt.want) {
+				t.Errorf("data = %v, want %v", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetConsumerConfig(t *testing.T) {
+	sources := map[string]interface{}{"consumer": map[string]interface{}{"sources": []interface{}{
+		map[string]interface{}{"type": "jwt", "id_claim": "client_id"},
+		map[string]interface{}{"type": "api_key", "header": "X-Api-Key"},
+		map[string]interface{}{"type": "basic"},
+		map[string]interface{}{"type": "unknown"},
+	}}}
+
+	conf := FluentLoggerConfig{}
+	conf.setConsumerConfig(sources)
+	want := []IdentitySource{{Type: consumerTypeBasic, IDClaim: "sub"}}
+	if !reflect.DeepEqual(conf.Consumer.Sources, want) {
+		t.Errorf("without verifier and secret sources = %+v, want %+v", conf.Consumer.Sources, want)
+	}
+
+	conf = FluentLoggerConfig{JWTVerifier: &JWTVerifier{}}
+	conf.setConsumerConfig(sources)
+	want = []IdentitySource{
+		{Type: consumerTypeJWT, IDClaim: "client_id"},
+		{Type: consumerTypeBasic, IDClaim: "sub"},
+	}
+	if !reflect.DeepEqual(conf.Consumer.Sources, want) {
+		t.Errorf("with verifier sources = %+v, want %+v", conf.Consumer.Sources, want)
+	}
+}
+
+func TestSetConsumerConfigMasksAPIKeys(t *testing.T) {
+	os.Setenv("KRAKEND_FLUENTD_TEST_CONSUMER_SECRET", "secret")
+	defer os.Unsetenv("KRAKEND_FLUENTD_TEST_CONSUMER_SECRET")
+
+	conf := FluentLoggerConfig{}
+	conf.setMaskConfig(map[string]interface{}{"mask": map[string]interface{}{
+		"request": map[string]interface{}{"query": []interface{}{"page"}},
+	}})
+	conf.setConsumerConfig(map[string]interface{}{"consumer": map[string]interface{}{
+		"hmac_secret_env": "KRAKEND_FLUENTD_TEST_CONSUMER_SECRET",
+		"sources": []interface{}{
+			map[string]interface{}{"type": "api_key", "header": "X-Api-Key", "query": "api_key"},
+		},
+	}})
+
+	headers := MaskRequestHeaders(map[string]string{"x-api-key": "key", "Accept": "*/*"}, conf.Mask)
+	if want := map[string]string{"x-api-key": "[REDACTED]", "Accept": "*/*"}; !reflect.DeepEqual(headers, want) {
+		t.Errorf("headers = %v, want %v", headers, want)
+	}
+	if query := MaskRequestQuery("api_key=key&page=2", conf.Mask); query != "api_key=%5BREDACTED%5D&page=%2A" {
+		t.Errorf("query = %s", query)
+	}
+}
@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"expvar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	deliveryAtMostOnce  = "at_most_once"
+	deliveryAtLeastOnce = "at_least_once"
+
+	defaultDeliveryMaxAttempts = 3
+	defaultDeliveryRetryWait   = 500 * time.Millisecond
+)
+
+// DeliveryConfig controls how batches are delivered. In "at_least_once"
+// mode every batch carries a chunk ID and is considered delivered only
+// when fluentd acknowledges it. Failed batches are tried up to MaxAttempts
+// times, on another server when there are several, and then written to
+// FallbackDir if it is set.
+type DeliveryConfig struct {
+	Mode         string
+	AckTimeout   time.Duration
+	MaxAttempts  int
+	RetryWait    time.Duration
+	MaxRetryWait time.Duration
+	FallbackDir  string
+}
+
+func (d DeliveryConfig) requireAck() bool {
+	return d.Mode == deliveryAtLeastOnce
+}
+
+// DeliveryCounters are delivery outcomes of batched records: process-wide
+// for forward batching, returned by DeliveryStats, and per exporting sink,
+// returned by its Stats.
+type DeliveryCounters struct {
+	SentChunks     int64 `json:"sent_chunks"`
+	SentRecords    int64 `json:"sent_records"`
+	Retries        int64 `json:"retries"`
+	FailedChunks   int64 `json:"failed_chunks"`
+	SpooledChunks  int64 `json:"spooled_chunks"`
+	SpooledRecords int64 `json:"spooled_records"`
+	LostRecords    int64 `json:"lost_records"`
+}
+
+var (
+	deliveryCounters    DeliveryCounters
+	publishDeliveryOnce sync.Once
+)
+
+// publishDeliveryStats publishes delivery counters with expvar once the
+// first forward batcher is made.
+func publishDeliveryStats() {
+	publishDeliveryOnce.Do(func() {
+		expvar.Publish("krakend_fluentd_delivery", expvar.Func(func() interface{} {
+			return DeliveryStats()
+		}))
+	})
+}
+
+// DeliveryStats returns a snapshot of delivery counters. Once batching is
+// used they are also published with expvar as "krakend_fluentd_delivery".
+func DeliveryStats() DeliveryCounters {
+	return DeliveryCounters{
+		SentChunks:     atomic.LoadInt64(&deliveryCounters.SentChunks),
+		SentRecords:    atomic.LoadInt64(&deliveryCounters.SentRecords),
+		Retries:        atomic.LoadInt64(&deliveryCounters.Retries),
+		FailedChunks:   atomic.LoadInt64(&deliveryCounters.FailedChunks),
+		SpooledChunks:  atomic.LoadInt64(&deliveryCounters.SpooledChunks),
+		SpooledRecords: atomic.LoadInt64(&deliveryCounters.SpooledRecords),
+		LostRecords:    atomic.LoadInt64(&deliveryCounters.LostRecords),
+	}
+}
+
+func newChunkID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprint(time.Now().UnixNano())
+	}
+
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+// spoolChunk writes a chunk that could not be delivered to dir as a
+// complete forward protocol message, so the file can be replayed by
+// sending it as is to fluentd forward input.
+func spoolChunk(dir, tag string, chunk *forwardChunk) error {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%s.%s.msgpack", spoolName(tag), chunk.id))
+	temporary := path + ".tmp"
+
+	spooled := *chunk
+	spooled.ack = false
+	if err := os.WriteFile(temporary, encodePackedForward(tag, &spooled), 0o640); err != nil {
+		return err
+	}
+
+	return os.Rename(temporary, path)
+}
+
+// spoolName makes a tag, which handlers can set, safe to use in a spool
+// file name: only its last path element is kept and characters other than
+// letters, digits, '.', '-' and '_' are replaced with '_'.
+func spoolName(tag string) string {
+	name := []byte(filepath.Base(tag))
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			name[i] = '_'
+		}
+	}
+
+	return string(name)
+}
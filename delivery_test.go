@@ -0,0 +1,211 @@
+package handler
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestSpoolName(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want string
+	}{
+		{"krakend.access", "krakend.access"},
+		{"../../etc/cron.d/job", "job"},
+		{"a/b", "b"},
+		{`..\\..\\x`, "..__..__x"},
+		{"tag with spaces;rm", "tag_with_spaces_rm"},
+		{"..", ".."},
+		{"", "."},
+	}
+
+	for _, tt := range tests {
+		if got := spoolName(tt.tag); got != tt.want {
+			t.Errorf("spoolName(%q) = %q, want %q", tt.tag, got, tt.want)
+		}
+	}
+}
+
+func TestSpoolChunk(t *testing.T) {
+	dir := t.TempDir()
+	chunk := &forwardChunk{id: "id1", size: 1, ack: true}
+	chunk.entries = encodeEntry(nil, time.Now(), map[string]interface{}{"n": 1}, false)
+
+	if err := spoolChunk(dir, "../../escape/access", chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 1 || filepath.Base(files[0]) != "access.id1.msgpack" {
+		t.Fatalf("spooled files = %v", files)
+	}
+	content, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _, err := msgp.ReadIntfBytes(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := value.([]interface{})
+	if message[0] != "../../escape/access" {
+		t.Errorf("spooled tag = %v", message[0])
+	}
+	if options := message[2].(map[string]interface{}); options["chunk"] != nil {
+		t.Errorf("spooled chunk requests ack: %v", options)
+	}
+}
+
+func TestForwardBatcherRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		delivery  DeliveryConfig
+		wantSent  int
+		wantSpool int
+	}{
+		{
+			name:     "retried after wait",
+			failures: 1,
+			delivery: DeliveryConfig{MaxAttempts: 2, RetryWait: 10 * time.Millisecond},
+			wantSent: 2,
+		},
+		{
+			name:      "out of attempts",
+			failures:  2,
+			delivery:  DeliveryConfig{MaxAttempts: 2, RetryWait: 10 * time.Millisecond},
+			wantSent:  1,
+			wantSpool: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.delivery.FallbackDir = t.TempDir()
+			sender := &chunkRecorder{failures: tt.failures}
+			batcher := NewForwardBatcher(sender, ForwardConfig{}, BatchConfig{MaxRecords: 1}, tt.delivery)
+
+			batcher.Post("first", map[string]interface{}{})
+			deadline := time.Now().Add(time.Second)
+			for time.Now().Before(deadline) {
+				sender.mu.Lock()
+				attempts := sender.attempts
+				sender.mu.Unlock()
+				if attempts > tt.failures {
+					break
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			batcher.Post("second", map[string]interface{}{})
+			batcher.Close()
+
+			if sent := len(sender.sent()); sent != tt.wantSent {
+				t.Errorf("sent chunks = %d, want %d", sent, tt.wantSent)
+			}
+			spooled, _ := filepath.Glob(filepath.Join(tt.delivery.FallbackDir, "*.msgpack"))
+			if len(spooled) != tt.wantSpool {
+				t.Errorf("spooled chunks = %v, want %d", spooled, tt.wantSpool)
+			}
+		})
+	}
+}
+
+func TestForwardBatcherRetryDoesNotBlock(t *testing.T) {
+	sender := &chunkRecorder{failures: 1}
+	delivery := DeliveryConfig{MaxAttempts: 3, RetryWait: time.Hour, FallbackDir: t.TempDir()}
+	batcher := NewForwardBatcher(sender, ForwardConfig{}, BatchConfig{MaxRecords: 1}, delivery)
+
+	batcher.Post("failing", map[string]interface{}{})
+	batcher.Post("next", map[string]interface{}{})
+
+	deadline := time.Now().Add(time.Second)
+	for len(sender.sent()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if chunks := sender.sent(); len(chunks) != 1 || chunks[0].tag != "next" {
+		t.Fatalf("sent = %v, want the next chunk while the failed one waits", chunks)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		batcher.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close() waits for the retry backoff")
+	}
+
+	var tags []string
+	for _, chunk := range sender.sent() {
+		tags = append(tags, chunk.tag)
+	}
+	if strings.Join(tags, ",") != "next,failing" {
+		t.Errorf("sent tags = %v, want the failed chunk sent on close", tags)
+	}
+}
+
+// blockingSender holds the first chunk until released.
+type blockingSender struct {
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (s *blockingSender) postChunk(*forwardChunk) error {
+	s.once.Do(func() {
+		close(s.entered)
+		<-s.release
+	})
+
+	return nil
+}
+
+func TestForwardBatcherQueueFull(t *testing.T) {
+	tests := []struct {
+		name        string
+		fallbackDir string
+		wantErr     bool
+		wantSpooled int
+	}{
+		{name: "spooled to fallback", fallbackDir: t.TempDir(), wantSpooled: 1},
+		{name: "lost without fallback", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &blockingSender{entered: make(chan struct{}), release: make(chan struct{})}
+			delivery := DeliveryConfig{Mode: deliveryAtLeastOnce, FallbackDir: tt.fallbackDir}
+			batcher := NewForwardBatcher(sender, ForwardConfig{}, BatchConfig{MaxRecords: 1, QueueSize: 1}, delivery)
+			defer batcher.Close()
+			defer close(sender.release)
+
+			if err := batcher.Post("access", map[string]interface{}{"n": 1}); err != nil {
+				t.Fatal(err)
+			}
+			<-sender.entered
+			if err := batcher.Post("access", map[string]interface{}{"n": 2}); err != nil {
+				t.Fatal(err)
+			}
+
+			err := batcher.Post("access", map[string]interface{}{"n": 3})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Post() to full queue error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.fallbackDir == "" {
+				return
+			}
+			files, _ := filepath.Glob(filepath.Join(tt.fallbackDir, "access.*.msgpack"))
+			if len(files) != tt.wantSpooled {
+				t.Errorf("spooled files = %v, want %d", files, tt.wantSpooled)
+			}
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var defaultRedactTargets = []string{
+	"request.body", "request.headers", "request.query", "response.body", "response.headers", "error",
+}
+
+// Detector finds sensitive values in free text. Validate, if set, filters
+// out pattern matches that are not real findings (e.g. failed checksums).
+type Detector struct {
+	Name     string
+	Pattern  *regexp.Regexp
+	Validate func(match string) bool
+	Strategy MaskStrategy
+}
+
+var builtinDetectors = map[string]func() Detector{
+	"pan": func() Detector {
+		return Detector{
+			Name:     "pan",
+			Pattern:  regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+			Validate: validPAN,
+		}
+	},
+	"email": func() Detector {
+		return Detector{
+			Name:    "email",
+			Pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+		}
+	},
+	"phone": func() Detector {
+		return Detector{
+			Name:    "phone",
+			Pattern: regexp.MustCompile(`(?:\+\d{1,3}[ .-]?|\(\d{3}\) ?)\(?\d{1,4}\)?(?:[ .-]?\d{2,4}){2,4}\b`),
+		}
+	},
+	"iban": func() Detector {
+		return Detector{
+			Name:     "iban",
+			Pattern:  regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]){11,30}\b`),
+			Validate: validIBAN,
+		}
+	},
+	"jwt": func() Detector {
+		return Detector{
+			Name:    "jwt",
+			Pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+		}
+	},
+	"aws_key": func() Detector {
+		return Detector{
+			Name:    "aws_key",
+			Pattern: regexp.MustCompile(`\b(?:AKIA|ASIA|AGPA|AIDA|AROA|ANPA|ANVA|AIPA)[A-Z0-9]{16}\b`),
+		}
+	},
+}
+
+type Scanner struct {
+	Detectors []Detector
+	Targets   map[string]struct{}
+}
+
+func (s *Scanner) enabled(target string) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.Targets[target]
+
+	return ok
+}
+
+// Redact replaces every finding of every detector in text and returns
+// the redacted text with the number of replacements.
+func (s *Scanner) Redact(text string) (string, int) {
+	redacted, _, count := s.redact(text)
+
+	return redacted, count
+}
+
+// redact is Redact also reporting whether text was a single finding
+// removed by its strategy, so values of structured documents can be
+// dropped instead of left empty.
+func (s *Scanner) redact(text string) (string, bool, int) {
+	count := 0
+	keepText := true
+	for _, detector := range s.Detectors {
+		whole := text
+		text = detector.Pattern.ReplaceAllStringFunc(text, func(match string) string {
+			if detector.Validate != nil && !detector.Validate(match) {
+				return match
+			}
+			masked, keep := detector.Strategy.Mask(match)
+			count++
+			if !keep {
+				keepText = keepText && match != whole
+				return ""
+			}
+			return masked
+		})
+	}
+
+	return text, keepText, count
+}
+
+// RedactTarget redacts text when target is scanned.
+func (s *Scanner) RedactTarget(target, text string) (string, int) {
+	if !s.enabled(target) || text == "" {
+		return text, 0
+	}
+
+	return s.Redact(text)
+}
+
+// RedactBody redacts body when target is scanned. JSON documents are
+// redacted value by value so the result stays valid JSON; numbers with
+// findings become strings and values removed by strategies are dropped.
+func (s *Scanner) RedactBody(target, body string) (string, int) {
+	if !s.enabled(target) || body == "" {
+		return body, 0
+	}
+
+	document, err := decodeJSONDocument(body)
+	if err != nil {
+		return s.Redact(body)
+	}
+
+	redacted, _, count := s.redactValue(document)
+	if count == 0 {
+		return body, 0
+	}
+
+	encoded, err := toString(redacted)
+	if err != nil {
+		return s.Redact(body)
+	}
+
+	return encoded, count
+}
+
+func (s *Scanner) redactValue(value interface{}) (interface{}, bool, int) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		count := 0
+		for key, item := range v {
+			redacted, keep, n := s.redactValue(item)
+			count += n
+			if !keep {
+				delete(v, key)
+				continue
+			}
+			v[key] = redacted
+		}
+		return v, true, count
+	case []interface{}:
+		count := 0
+		result := v[:0]
+		for _, item := range v {
+			redacted, keep, n := s.redactValue(item)
+			count += n
+			if keep {
+				result = append(result, redacted)
+			}
+		}
+		return result, true, count
+	case string:
+		return s.redact(v)
+	case json.Number:
+		redacted, keep, count := s.redact(v.String())
+		if count == 0 {
+			return v, true, 0
+		}
+		return redacted, keep, count
+	}
+
+	return value, true, 0
+}
+
+// RedactQuery redacts a raw query string when target is scanned. Names
+// and values are URL-decoded before scanning so encoded findings like
+// "a%40b.com" are found; pairs without findings keep their encoding.
+func (s *Scanner) RedactQuery(target, query string) (string, int) {
+	if !s.enabled(target) || query == "" {
+		return query, 0
+	}
+
+	count := 0
+	pairs := strings.Split(query, "&")
+	for i, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		for j, part := range kv {
+			decoded, err := url.QueryUnescape(part)
+			if err != nil {
+				decoded = part
+			}
+			redacted, n := s.Redact(decoded)
+			if n == 0 {
+				continue
+			}
+			count += n
+			kv[j] = url.QueryEscape(redacted)
+		}
+		pairs[i] = strings.Join(kv, "=")
+	}
+
+	return strings.Join(pairs, "&"), count
+}
+
+// RedactHeaders redacts every header value when target is scanned.
+func (s *Scanner) RedactHeaders(target string, headers map[string]string) int {
+	if !s.enabled(target) {
+		return 0
+	}
+
+	count := 0
+	for k, v := range headers {
+		redacted, n := s.Redact(v)
+		headers[k] = redacted
+		count += n
+	}
+
+	return count
+}
+
+// decodeJSONDocument decodes text holding exactly one JSON value.
+func decodeJSONDocument(text string) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewBufferString(text))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after JSON value")
+	}
+
+	return value, nil
+}
+
+// panRanges are issuer identification number ranges of card networks with
+// card number lengths they use: Visa, Mastercard, American Express,
+// Discover, JCB, Diners Club, UnionPay and Maestro.
+var panRanges = []struct {
+	digits, low, high, minLength, maxLength int
+}{
+	{1, 4, 4, 13, 19},
+	{2, 51, 55, 16, 16},
+	{4, 2221, 2720, 16, 16},
+	{2, 34, 34, 15, 15},
+	{2, 37, 37, 15, 15},
+	{4, 6011, 6011, 16, 19},
+	{3, 644, 649, 16, 19},
+	{2, 65, 65, 16, 19},
+	{4, 3528, 3589, 16, 19},
+	{3, 300, 305, 14, 19},
+	{2, 36, 36, 14, 19},
+	{2, 38, 39, 16, 19},
+	{2, 62, 62, 16, 19},
+	{2, 50, 50, 13, 19},
+	{2, 56, 58, 13, 19},
+	{2, 67, 67, 13, 19},
+}
+
+// validPAN accepts card numbers of known issuer ranges and lengths with a
+// valid Luhn checksum, so long numeric IDs and timestamps are not taken
+// for card numbers.
+func validPAN(match string) bool {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, match)
+
+	for _, r := range panRanges {
+		if len(digits) < r.minLength || len(digits) > r.maxLength {
+			continue
+		}
+		prefix := 0
+		for _, d := range digits[:r.digits] {
+			prefix = prefix*10 + int(d-'0')
+		}
+		if prefix >= r.low && prefix <= r.high {
+			return validLuhn(digits)
+		}
+	}
+
+	return false
+}
+
+func validLuhn(match string) bool {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, match)
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+
+	return sum%10 == 0
+}
+
+func validIBAN(match string) bool {
+	iban := strings.ReplaceAll(match, " ", "")
+	if len(iban) < 15 || len(iban) > 34 {
+		return false
+	}
+
+	var numeric strings.Builder
+	for _, r := range iban[4:] + iban[:4] {
+		switch {
+		case r >= '0' && r <= '9':
+			numeric.WriteRune(r)
+		case r >= 'A' && r <= 'Z':
+			numeric.WriteString(fmt.Sprint(int(r-'A') + 10))
+		default:
+			return false
+		}
+	}
+
+	n, ok := new(big.Int).SetString(numeric.String(), 10)
+	if !ok {
+		return false
+	}
+
+	return new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
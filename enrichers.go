@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Enricher adds fields to the access record after the request has been
+// handled. Name identifies it in the "enrichers" config section.
+type Enricher interface {
+	Name() string
+	Enrich(c *gin.Context, r *http.Request, record map[string]interface{})
+}
+
+type enricherFunc struct {
+	name string
+	fn   func(c *gin.Context, r *http.Request, record map[string]interface{})
+}
+
+func (e enricherFunc) Name() string {
+	return e.name
+}
+
+func (e enricherFunc) Enrich(c *gin.Context, r *http.Request, record map[string]interface{}) {
+	e.fn(c, r, record)
+}
+
+func NewEnricher(name string, fn func(c *gin.Context, r *http.Request, record map[string]interface{})) Enricher {
+	return enricherFunc{name: name, fn: fn}
+}
+
+// EnricherChain runs enrichers in order.
+type EnricherChain []Enricher
+
+func (ch EnricherChain) Enrich(c *gin.Context, record map[string]interface{}) {
+	for _, enricher := range ch {
+		enricher.Enrich(c, c.Request, record)
+	}
+}
+
+var builtinEnrichers = map[string]func(cfg map[string]interface{}) (Enricher, error){
+	"hostname":    newHostnameEnricher,
+	"environment": newEnvironmentEnricher,
+	"static":      newStaticEnricher,
+}
+
+var builtinEnricherOrder = []string{"hostname", "environment", "static"}
+
+// newHostnameEnricher adds host name of the gateway instance to "hostname" field.
+func newHostnameEnricher(cfg map[string]interface{}) (Enricher, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	field := enricherField(cfg, "hostname")
+
+	return NewEnricher("hostname", func(_ *gin.Context, _ *http.Request, record map[string]interface{}) {
+		record[field] = hostname
+	}), nil
+}
+
+// newEnvironmentEnricher adds "value" or the value of "env" environment
+// variable to "environment" field.
+func newEnvironmentEnricher(cfg map[string]interface{}) (Enricher, error) {
+	value := ""
+	if _, ok := cfg["value"]; ok {
+		value = ConvertToString("value", cfg)
+	} else if _, ok := cfg["env"]; ok {
+		value = os.Getenv(ConvertToString("env", cfg))
+	}
+	if value == "" {
+		return nil, errors.New("no 'value' or non-empty 'env' found")
+	}
+	field := enricherField(cfg, "environment")
+
+	return NewEnricher("environment", func(_ *gin.Context, _ *http.Request, record map[string]interface{}) {
+		record[field] = value
+	}), nil
+}
+
+// newStaticEnricher adds constant "fields".
+func newStaticEnricher(cfg map[string]interface{}) (Enricher, error) {
+	fields, ok := cfg["fields"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("no 'fields' found")
+	}
+
+	return NewEnricher("static", func(_ *gin.Context, _ *http.Request, record map[string]interface{}) {
+		for k, v := range fields {
+			record[k] = v
+		}
+	}), nil
+}
+
+func enricherField(cfg map[string]interface{}, defaultField string) string {
+	if _, ok := cfg["field"]; ok {
+		return ConvertToString("field", cfg)
+	}
+
+	return defaultField
+}
+
+// enricherEnabled reads `"name": false` or `"name": {"enabled": false}`.
+func enricherEnabled(cfg interface{}) bool {
+	switch c := cfg.(type) {
+	case bool:
+		return c
+	case map[string]interface{}:
+		if enabled, ok := c["enabled"].(bool); ok {
+			return enabled
+		}
+	}
+
+	return true
+}
+
+// buildEnricherChain makes the chain of built-in enrichers present in
+// config followed by custom ones, skipping those disabled in config.
+func buildEnricherChain(cfg map[string]interface{}, custom []Enricher) EnricherChain {
+	var chain EnricherChain
+
+	for _, name := range builtinEnricherOrder {
+		enricherConfig, ok := cfg[name]
+		if !ok || !enricherEnabled(enricherConfig) {
+			continue
+		}
+		enricherConfigMap, _ := enricherConfig.(map[string]interface{})
+		enricher, err := builtinEnrichers[name](enricherConfigMap)
+		if err != nil {
+			printOutConfigError(fmt.Sprintf("enrichers.%s", name), err)
+			continue
+		}
+		chain = append(chain, enricher)
+	}
+
+	for _, enricher := range custom {
+		if enricher == nil {
+			continue
+		}
+		if enricherConfig, ok := cfg[enricher.Name()]; ok && !enricherEnabled(enricherConfig) {
+			continue
+		}
+		chain = append(chain, enricher)
+	}
+
+	return chain
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBuildEnricherChain(t *testing.T) {
+	os.Setenv("KRAKEND_FLUENTD_TEST_ENV", "staging")
+	defer os.Unsetenv("KRAKEND_FLUENTD_TEST_ENV")
+	hostname, _ := os.Hostname()
+
+	custom := NewEnricher("custom", func(_ *gin.Context, _ *http.Request, record map[string]interface{}) {
+		record["environment"] = "overridden by custom"
+		record["custom"] = true
+	})
+
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		custom []Enricher
+		want   map[string]interface{}
+	}{
+		{
+			name:   "nothing configured",
+			config: map[string]interface{}{},
+			want:   map[string]interface{}{},
+		},
+		{
+			name: "built-in enrichers",
+			config: map[string]interface{}{
+				"hostname":    map[string]interface{}{"field": "host.name"},
+				"environment": map[string]interface{}{"env": "KRAKEND_FLUENTD_TEST_ENV"},
+				"static":      map[string]interface{}{"fields": map[string]interface{}{"team": "api"}},
+			},
+			want: map[string]interface{}{"host.name": hostname, "environment": "staging", "team": "api"},
+		},
+		{
+			name: "custom enrichers run after built-in ones",
+			config: map[string]interface{}{
+				"environment": map[string]interface{}{"value": "prod"},
+			},
+			custom: []Enricher{custom, nil},
+			want:   map[string]interface{}{"environment": "overridden by custom", "custom": true},
+		},
+		{
+			name: "disabled enrichers",
+			config: map[string]interface{}{
+				"hostname": false,
+				"static":   map[string]interface{}{"enabled": false, "fields": map[string]interface{}{"a": 1}},
+				"custom":   false,
+			},
+			custom: []Enricher{custom},
+			want:   map[string]interface{}{},
+		},
+		{
+			name: "misconfigured enrichers are skipped",
+			config: map[string]interface{}{
+				"environment": map[string]interface{}{"env": "KRAKEND_FLUENTD_TEST_UNSET"},
+				"static":      map[string]interface{}{},
+			},
+			want: map[string]interface{}{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+			record := map[string]interface{}{}
+			buildEnricherChain(tt.config, tt.custom).Enrich(c, record)
+			if !reflect.DeepEqual(record, tt.want) {
+				t.Errorf("record = %v, want %v", record, tt.want)
+			}
+		})
+	}
+}
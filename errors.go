@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+const panicErrorType = "panic"
+
+var ginErrorTypes = []struct {
+	flag gin.ErrorType
+	name string
+}{
+	{gin.ErrorTypeBind, "bind"},
+	{gin.ErrorTypeRender, "render"},
+	{gin.ErrorTypePrivate, "private"},
+	{gin.ErrorTypePublic, "public"},
+}
+
+// nextRecovering runs the rest of the handlers chain and recovers a panic
+// raised there, returning the recovered value with its stack trace. The
+// request is aborted with 500 only if abort is set, i.e. the panic is not
+// going to be re-raised for an outer recovery to respond.
+func nextRecovering(c *gin.Context, abort bool) (recovered interface{}, stack []byte) {
+	defer func() {
+		if recovered = recover(); recovered != nil {
+			stack = debug.Stack()
+			if abort && !c.Writer.Written() {
+				c.AbortWithStatus(http.StatusInternalServerError)
+			}
+		}
+	}()
+
+	c.Next()
+
+	return nil, nil
+}
+
+// makeErrors serializes gin errors of the request and a recovered panic
+// into a list of {"message", "type", "meta"} objects.
+func makeErrors(errs []*gin.Error, recovered interface{}, stack []byte) []interface{} {
+	var result []interface{}
+	for _, err := range errs {
+		entry := map[string]interface{}{
+			"message": err.Error(),
+			"type":    ginErrorTypeName(err.Type),
+		}
+		if err.Meta != nil {
+			entry["meta"] = fmt.Sprintf("%v", err.Meta)
+		}
+		result = append(result, entry)
+	}
+
+	if recovered != nil {
+		result = append(result, map[string]interface{}{
+			"message": fmt.Sprintf("%v", recovered),
+			"type":    panicErrorType,
+			"stack":   string(stack),
+		})
+	}
+
+	return result
+}
+
+// redactErrors redacts string values of serialized errors when the
+// "error" target is scanned and returns them with the number of findings.
+func redactErrors(errs []interface{}, scanner *Scanner) ([]interface{}, int) {
+	if !scanner.enabled("error") {
+		return errs, 0
+	}
+
+	count := 0
+	result := make([]interface{}, 0, len(errs))
+	for _, err := range errs {
+		entry, ok := err.(map[string]interface{})
+		if !ok {
+			result = append(result, err)
+			continue
+		}
+		redacted := make(map[string]interface{}, len(entry))
+		for k, v := range entry {
+			if text, ok := v.(string); ok && k != "type" {
+				var n int
+				v, n = scanner.RedactTarget("error", text)
+				count += n
+			}
+			redacted[k] = v
+		}
+		result = append(result, redacted)
+	}
+
+	return result, count
+}
+
+func ginErrorTypeName(errorType gin.ErrorType) string {
+	for _, t := range ginErrorTypes {
+		if errorType&t.flag != 0 {
+			return t.name
+		}
+	}
+
+	return "unknown"
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/logging"
+)
+
+func TestMakeErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		errs      []*gin.Error
+		recovered interface{}
+		want      []interface{}
+	}{
+		{
+			name: "no errors",
+		},
+		{
+			name: "gin errors",
+			errs: []*gin.Error{
+				{Err: errors.New("bad input"), Type: gin.ErrorTypeBind, Meta: "field"},
+				{Err: errors.New("oops"), Type: gin.ErrorTypePrivate},
+			},
+			want: []interface{}{
+				map[string]interface{}{"message": "bad input", "type": "bind", "meta": "field"},
+				map[string]interface{}{"message": "oops", "type": "private"},
+			},
+		},
+		{
+			name:      "panic",
+			recovered: "boom",
+			want: []interface{}{
+				map[string]interface{}{"message": "boom", "type": panicErrorType, "stack": "stack"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := makeErrors(tt.errs, tt.recovered, []byte("stack"))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("makeErrors() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactErrors(t *testing.T) {
+	errs := []interface{}{
+		map[string]interface{}{"message": "user a@example.com not found", "type": "private"},
+		map[string]interface{}{"message": "boom", "type": panicErrorType, "stack": "token eyJa.eyJb.c"},
+	}
+
+	tests := []struct {
+		name    string
+		scanner *Scanner
+		targets []string
+		want    []interface{}
+		count   int
+	}{
+		{
+			name:    "no scanner",
+			scanner: nil,
+			want:    errs,
+		},
+		{
+			name:    "error target not scanned",
+			scanner: newTestScanner(t, "email", "jwt"),
+			targets: []string{"request.body"},
+			want:    errs,
+		},
+		{
+			name:    "error target scanned",
+			scanner: newTestScanner(t, "email", "jwt"),
+			want: []interface{}{
+				map[string]interface{}{"message": "user [REDACTED:email] not found", "type": "private"},
+				map[string]interface{}{"message": "boom", "type": panicErrorType, "stack": "token [REDACTED:jwt]"},
+			},
+			count: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.targets != nil {
+				tt.scanner.Targets = map[string]struct{}{}
+				for _, target := range tt.targets {
+					tt.scanner.Targets[target] = struct{}{}
+				}
+			}
+			got, count := redactErrors(errs, tt.scanner)
+			if !reflect.DeepEqual(got, tt.want) || count != tt.count {
+				t.Errorf("redactErrors() = %v, %d, want %v, %d", got, count, tt.want, tt.count)
+			}
+		})
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	tests := []struct {
+		name    string
+		repanic bool
+		status  int
+	}{
+		{name: "recovered", repanic: false, status: http.StatusInternalServerError},
+		{name: "re-raised", repanic: true, status: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extra, path := testConfig(t, map[string]interface{}{"repanic": tt.repanic})
+			outer := func(c *gin.Context) {
+				defer func() {
+					if recover() != nil {
+						if c.Writer.Written() {
+							t.Error("response written before the outer recovery")
+						}
+						c.AbortWithStatus(http.StatusBadGateway)
+					}
+				}()
+				c.Next()
+			}
+
+			gin.SetMode(gin.TestMode)
+			engine := gin.New()
+			engine.Use(outer, FluentLoggerWithConfig(logging.NoOp, extra, nil))
+			engine.GET("/", func(c *gin.Context) { panic("boom") })
+			response := httptest.NewRecorder()
+			engine.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if response.Code != tt.status {
+				t.Errorf("status = %d, want %d", response.Code, tt.status)
+			}
+			records := readRecords(t, path)
+			if len(records) != 1 {
+				t.Fatalf("records = %d, want 1", len(records))
+			}
+			if records[0]["response.status_code"] != "500" {
+				t.Errorf("response.status_code = %v, want 500", records[0]["response.status_code"])
+			}
+			errs, _ := records[0]["error"].([]interface{})
+			if len(errs) != 1 || !strings.Contains(errs[0].(map[string]interface{})["stack"].(string), "errors_test.go") {
+				t.Errorf("error = %v", records[0]["error"])
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultExportMaxBatchSize   = 512
+	defaultExportMaxQueueSize   = 2048
+	defaultExportFlushInterval  = time.Second
+	defaultExportTimeout        = 10 * time.Second
+	defaultExportMaxAttempts    = 5
+	defaultExportInitialBackoff = time.Second
+	defaultExportMaxBackoff     = 30 * time.Second
+)
+
+// ExportConfig sets batching and retries of exporting sinks. Batches of up
+// to MaxBatchSize records are exported every FlushInterval or as soon as
+// they are full; at most MaxQueueSize records wait for export, the rest
+// are dropped. Retryable failures are retried up to MaxAttempts times with
+// exponential backoff between InitialBackoff and MaxBackoff.
+type ExportConfig struct {
+	MaxBatchSize   int
+	MaxQueueSize   int
+	FlushInterval  time.Duration
+	Timeout        time.Duration
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func (c ExportConfig) withDefaults() ExportConfig {
+	if c.MaxBatchSize <= 0 {
+		c.MaxBatchSize = defaultExportMaxBatchSize
+	}
+	if c.MaxQueueSize < c.MaxBatchSize {
+		c.MaxQueueSize = defaultExportMaxQueueSize
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = defaultExportFlushInterval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultExportTimeout
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = defaultExportMaxAttempts
+	}
+	if c.InitialBackoff <= 0 {
+		c.InitialBackoff = defaultExportInitialBackoff
+	}
+	if c.MaxBackoff < c.InitialBackoff {
+		c.MaxBackoff = defaultExportMaxBackoff
+	}
+
+	return c
+}
+
+// exportEntry is a record waiting for export.
+type exportEntry struct {
+	tag    string
+	time   time.Time
+	record map[string]interface{}
+}
+
+// retryableError marks an export failure worth retrying, optionally after
+// the delay the server asked for. A non-nil retry narrows the retry to
+// these entries of the batch; failed of the others failed for good and the
+// rest were exported.
+type retryableError struct {
+	err    error
+	after  time.Duration
+	retry  []exportEntry
+	failed int
+}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+// batchExporter is the batching and retrying part shared by exporting
+// sinks; export sends one batch. Each sink counts its delivery outcomes
+// apart from forward ones.
+type batchExporter struct {
+	name     string
+	export   func(ctx context.Context, entries []exportEntry) error
+	cfg      ExportConfig
+	counters DeliveryCounters
+
+	mu      sync.Mutex
+	entries []exportEntry
+	closed  bool
+
+	worker *retryWorker
+}
+
+func newBatchExporter(
+	name string, cfg ExportConfig, export func(ctx context.Context, entries []exportEntry) error,
+) *batchExporter {
+	cfg = cfg.withDefaults()
+	e := &batchExporter{
+		name:   name,
+		export: export,
+		cfg:    cfg,
+	}
+	queueSize := cfg.MaxQueueSize / cfg.MaxBatchSize
+	e.worker = newRetryWorker(e, queueSize, cfg.FlushInterval, retryPolicy{
+		maxAttempts: cfg.MaxAttempts,
+		initialWait: cfg.InitialBackoff,
+		maxWait:     cfg.MaxBackoff,
+		jitter:      true,
+		maxRetries:  queueSize,
+	}, &e.counters)
+
+	return e
+}
+
+func (e *batchExporter) Post(tag string, record map[string]interface{}) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return fmt.Errorf("%s sink is closed", e.name)
+	}
+
+	e.entries = append(e.entries, exportEntry{tag: tag, time: time.Now(), record: record})
+	if len(e.entries) < e.cfg.MaxBatchSize {
+		return nil
+	}
+
+	batch := e.entries
+	e.entries = nil
+	if e.worker.enqueue(batch) {
+		return nil
+	}
+	atomic.AddInt64(&e.counters.LostRecords, int64(len(batch)))
+
+	return fmt.Errorf("%s queue is full, %d records dropped", e.name, len(batch))
+}
+
+// Close exports waiting records and stops the exporter.
+func (e *batchExporter) Close() error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil
+	}
+	e.closed = true
+	e.mu.Unlock()
+
+	e.worker.close()
+
+	return nil
+}
+
+// Stats returns a snapshot of delivery counters of the sink.
+func (e *batchExporter) Stats() DeliveryCounters {
+	return DeliveryCounters{
+		SentChunks:   atomic.LoadInt64(&e.counters.SentChunks),
+		SentRecords:  atomic.LoadInt64(&e.counters.SentRecords),
+		Retries:      atomic.LoadInt64(&e.counters.Retries),
+		FailedChunks: atomic.LoadInt64(&e.counters.FailedChunks),
+		LostRecords:  atomic.LoadInt64(&e.counters.LostRecords),
+	}
+}
+
+func (e *batchExporter) take() []interface{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.entries) == 0 {
+		return nil
+	}
+	batch := e.entries
+	e.entries = nil
+
+	return []interface{}{batch}
+}
+
+// attempt exports a batch. A retryable failure naming the entries to
+// retry leaves only them in the batch; of the others failed ones are lost
+// and the rest exported.
+func (e *batchExporter) attempt(item interface{}) (interface{}, time.Duration, error) {
+	batch := item.([]exportEntry)
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.cfg.Timeout)
+	err := e.export(ctx, batch)
+	cancel()
+	if err == nil {
+		atomic.AddInt64(&e.counters.SentRecords, int64(len(batch)))
+		return nil, 0, nil
+	}
+
+	retryable, ok := err.(retryableError)
+	if !ok {
+		return nil, 0, err
+	}
+	if retryable.retry != nil {
+		exported := len(batch) - len(retryable.retry) - retryable.failed
+		atomic.AddInt64(&e.counters.SentRecords, int64(exported))
+		if retryable.failed > 0 {
+			atomic.AddInt64(&e.counters.LostRecords, int64(retryable.failed))
+			fmt.Printf("krakend-fluentd-request-logger: %d records not exported to %s: %v \n",
+				retryable.failed, e.name, err)
+		}
+		batch = retryable.retry
+	}
+
+	return batch, retryable.after, err
+}
+
+func (e *batchExporter) drop(item interface{}, err error) {
+	batch := item.([]exportEntry)
+	atomic.AddInt64(&e.counters.LostRecords, int64(len(batch)))
+	fmt.Printf("krakend-fluentd-request-logger: %d records not exported to %s: %v \n", len(batch), e.name, err)
+}
+
+// parseExportConfig reads "timeout", "batch" and "retry" sections of an
+// exporting sink.
+func parseExportConfig(cfg map[string]interface{}) ExportConfig {
+	export := ExportConfig{}
+	if _, ok := cfg["timeout"]; ok {
+		export.Timeout = ConvertToDuration("timeout", cfg)
+	}
+	if batchConfigMap, ok := cfg["batch"].(map[string]interface{}); ok {
+		if _, ok := batchConfigMap["max_batch_size"]; ok {
+			export.MaxBatchSize = ConvertToInt("max_batch_size", batchConfigMap)
+		}
+		if _, ok := batchConfigMap["max_queue_size"]; ok {
+			export.MaxQueueSize = ConvertToInt("max_queue_size", batchConfigMap)
+		}
+		if _, ok := batchConfigMap["flush_interval"]; ok {
+			export.FlushInterval = ConvertToDuration("flush_interval", batchConfigMap)
+		}
+	}
+	if retryConfigMap, ok := cfg["retry"].(map[string]interface{}); ok {
+		if _, ok := retryConfigMap["max_attempts"]; ok {
+			export.MaxAttempts = ConvertToInt("max_attempts", retryConfigMap)
+		}
+		if _, ok := retryConfigMap["initial_backoff"]; ok {
+			export.InitialBackoff = ConvertToDuration("initial_backoff", retryConfigMap)
+		}
+		if _, ok := retryConfigMap["max_backoff"]; ok {
+			export.MaxBackoff = ConvertToDuration("max_backoff", retryConfigMap)
+		}
+	}
+
+	return export
+}
+
+// stringMap reads a map of strings like "headers", nil if absent.
+func stringMap(cfg map[string]interface{}, key string) map[string]string {
+	m, ok := cfg[key].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	result := make(map[string]string, len(m))
+	for k := range m {
+		result[k] = ConvertToString(k, m)
+	}
+
+	return result
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// exportRecorder is an export function failing the first failures
+// exports with err and keeping exported batches.
+type exportRecorder struct {
+	mu       sync.Mutex
+	failures int
+	err      error
+	attempts int
+	batches  [][]exportEntry
+}
+
+func (r *exportRecorder) export(_ context.Context, entries []exportEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.attempts++
+	if r.attempts <= r.failures {
+		return r.err
+	}
+	r.batches = append(r.batches, entries)
+
+	return nil
+}
+
+func (r *exportRecorder) counts() (int, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.attempts, len(r.batches)
+}
+
+func TestBatchExporterRetry(t *testing.T) {
+	retryable := retryableError{err: errors.New("unavailable")}
+
+	tests := []struct {
+		name         string
+		failures     int
+		err          error
+		wantAttempts int
+		wantBatches  int
+	}{
+		{name: "exported", wantAttempts: 1, wantBatches: 1},
+		{name: "retried", failures: 2, err: retryable, wantAttempts: 3, wantBatches: 1},
+		{name: "out of attempts", failures: 5, err: retryable, wantAttempts: 3, wantBatches: 0},
+		{name: "not retryable", failures: 1, err: errors.New("bad request"), wantAttempts: 1, wantBatches: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &exportRecorder{failures: tt.failures, err: tt.err}
+			exporter := newBatchExporter("test", ExportConfig{
+				MaxBatchSize: 1, MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond,
+			}, recorder.export)
+
+			exporter.Post("access", map[string]interface{}{})
+			deadline := time.Now().Add(time.Second)
+			for time.Now().Before(deadline) {
+				if attempts, _ := recorder.counts(); attempts >= tt.wantAttempts {
+					break
+				}
+				time.Sleep(2 * time.Millisecond)
+			}
+			exporter.Close()
+
+			attempts, batches := recorder.counts()
+			if attempts != tt.wantAttempts || batches != tt.wantBatches {
+				t.Errorf("attempts = %d, batches = %d, want %d, %d", attempts, batches, tt.wantAttempts, tt.wantBatches)
+			}
+		})
+	}
+}
+
+func TestBatchExporterRetryDoesNotBlock(t *testing.T) {
+	recorder := &exportRecorder{failures: 1, err: retryableError{err: errors.New("unavailable"), after: time.Hour}}
+	exporter := newBatchExporter("test", ExportConfig{
+		MaxBatchSize: 1, MaxQueueSize: 2, MaxAttempts: 5, FlushInterval: time.Hour,
+	}, recorder.export)
+
+	exporter.Post("first", map[string]interface{}{})
+	for i := 0; i < 5; i++ {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			if _, batches := recorder.counts(); batches == i {
+				break
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+		if err := exporter.Post("next", map[string]interface{}{}); err != nil {
+			t.Fatalf("Post() while a batch waits for retry: %v", err)
+		}
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		exporter.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close() waits for the retry backoff")
+	}
+
+	attempts, batches := recorder.counts()
+	if batches != 6 || attempts != 7 {
+		t.Errorf("attempts = %d, batches = %d, want 7, 6: one failure and one last attempt on close",
+			attempts, batches)
+	}
+}
@@ -0,0 +1,312 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultFileMaxFiles = 5
+	rotatedFileLayout   = "2006-01-02T15-04-05.000"
+)
+
+// FileSinkConfig configures the JSON lines file sink. The file is rotated
+// when it grows over MaxSize bytes or every RotateInterval; rotated files
+// are renamed with a timestamp, optionally gzipped, and only MaxFiles of
+// them are kept.
+type FileSinkConfig struct {
+	Path           string
+	MaxSize        int64
+	RotateInterval time.Duration
+	MaxFiles       int
+	Compress       bool
+	TagField       string
+}
+
+// FileSink writes every record as one JSON object per line. It reopens
+// the file on SIGHUP, so it can also be rotated by logrotate.
+type FileSink struct {
+	cfg FileSinkConfig
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+
+	signals   chan os.Signal
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func NewFileSink(cfg FileSinkConfig) (*FileSink, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("no 'path' found")
+	}
+	if cfg.MaxFiles <= 0 {
+		cfg.MaxFiles = defaultFileMaxFiles
+	}
+
+	s := &FileSink{
+		cfg:     cfg,
+		signals: make(chan os.Signal, 1),
+		done:    make(chan struct{}),
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	signal.Notify(s.signals, syscall.SIGHUP)
+	s.wg.Add(1)
+	go s.reopenOnSignal()
+
+	return s, nil
+}
+
+func (s *FileSink) Post(tag string, record map[string]interface{}) error {
+	line, err := encodeJSONLine(taggedRecord(record, s.cfg.TagField, tag))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return errors.New("file sink is closed")
+	}
+	if s.rotationDue(len(line)) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+
+	return err
+}
+
+// Close closes the file and waits for background compression. Closing
+// the sink again does nothing.
+func (s *FileSink) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		signal.Stop(s.signals)
+		close(s.done)
+
+		s.mu.Lock()
+		if s.file != nil {
+			err = s.file.Close()
+			s.file = nil
+		}
+		s.mu.Unlock()
+
+		s.wg.Wait()
+	})
+
+	return err
+}
+
+// open opens the file at the configured path; the sink file is replaced
+// only if that succeeds.
+func (s *FileSink) open() error {
+	if err := os.MkdirAll(filepath.Dir(s.cfg.Path), 0o750); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file, s.size, s.openedAt = file, info.Size(), time.Now()
+
+	return nil
+}
+
+func (s *FileSink) reopenOnSignal() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.signals:
+			s.mu.Lock()
+			if previous := s.file; previous != nil {
+				if err := s.open(); err != nil {
+					fmt.Printf("krakend-fluentd-request-logger: reopen '%s' failed: %v \n", s.cfg.Path, err)
+				} else {
+					previous.Close()
+				}
+			}
+			s.mu.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *FileSink) rotationDue(next int) bool {
+	if s.size == 0 {
+		return false
+	}
+	if s.cfg.MaxSize > 0 && s.size+int64(next) > s.cfg.MaxSize {
+		return true
+	}
+
+	return s.cfg.RotateInterval > 0 && time.Since(s.openedAt) >= s.cfg.RotateInterval
+}
+
+// rotate renames the current file to "<name>-<timestamp><ext>" and opens
+// a new one. Compression and removal of old generations run in background.
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+
+	rotated := rotatedFileName(s.cfg.Path, time.Now())
+	if err := os.Rename(s.cfg.Path, rotated); err != nil {
+		if openErr := s.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if s.cfg.Compress {
+			if err := gzipFile(rotated); err != nil {
+				fmt.Printf("krakend-fluentd-request-logger: compress '%s' failed: %v \n", rotated, err)
+			}
+		}
+		s.removeOldFiles()
+	}()
+
+	return nil
+}
+
+func rotatedFileName(path string, t time.Time) string {
+	ext := filepath.Ext(path)
+
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(path, ext), t.Format(rotatedFileLayout), ext)
+}
+
+// removeOldFiles keeps MaxFiles newest rotated files. Timestamps in names
+// make them sort by age.
+func (s *FileSink) removeOldFiles() {
+	dir, base := filepath.Split(s.cfg.Path)
+	entries, err := os.ReadDir(filepath.Dir(s.cfg.Path))
+	if err != nil {
+		return
+	}
+
+	var generations []string
+	for _, entry := range entries {
+		if !entry.IsDir() && isRotatedFileName(base, entry.Name()) {
+			generations = append(generations, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(generations)
+
+	for len(generations) > s.cfg.MaxFiles {
+		os.Remove(generations[0])
+		generations = generations[1:]
+	}
+}
+
+// isRotatedFileName reports whether name is a file rotated from base by
+// rotatedFileName, possibly gzipped.
+func isRotatedFileName(base, name string) bool {
+	ext := filepath.Ext(base)
+	prefix := strings.TrimSuffix(base, ext) + "-"
+	name = strings.TrimSuffix(name, ".gz")
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) || len(name) < len(prefix)+len(ext) {
+		return false
+	}
+	_, err := time.Parse(rotatedFileLayout, name[len(prefix):len(name)-len(ext)])
+
+	return err == nil
+}
+
+func gzipFile(path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	temporary := path + ".gz.tmp"
+	target, err := os.OpenFile(temporary, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+
+	writer := gzip.NewWriter(target)
+	_, err = io.Copy(writer, source)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temporary)
+		return err
+	}
+
+	if err := os.Rename(temporary, path+".gz"); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// taggedRecord returns a copy of record with the tag in field, or record
+// itself if field is empty.
+func taggedRecord(record map[string]interface{}, field, tag string) map[string]interface{} {
+	if field == "" {
+		return record
+	}
+
+	tagged := make(map[string]interface{}, len(record)+1)
+	for k, v := range record {
+		tagged[k] = v
+	}
+	tagged[field] = tag
+
+	return tagged
+}
+
+// encodeJSONLine encodes record as one line of JSON without HTML escaping.
+func encodeJSONLine(record map[string]interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(record); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,234 @@
+package handler
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFileSinkRotation(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       FileSinkConfig
+		records   int
+		wantFiles int
+		wantGzip  bool
+	}{
+		{
+			name:      "no rotation",
+			cfg:       FileSinkConfig{},
+			records:   5,
+			wantFiles: 1,
+		},
+		{
+			name:      "rotated by size",
+			cfg:       FileSinkConfig{MaxSize: 20, MaxFiles: 10},
+			records:   3,
+			wantFiles: 3,
+		},
+		{
+			name:      "old generations removed",
+			cfg:       FileSinkConfig{MaxSize: 20, MaxFiles: 1},
+			records:   4,
+			wantFiles: 2,
+		},
+		{
+			name:      "compressed",
+			cfg:       FileSinkConfig{MaxSize: 20, MaxFiles: 10, Compress: true},
+			records:   2,
+			wantFiles: 2,
+			wantGzip:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.cfg.Path = filepath.Join(dir, "logs", "access.log")
+			sink, err := NewFileSink(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tt.records; i++ {
+				if err := sink.Post("access", map[string]interface{}{"message": "0123456789"}); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(2 * time.Millisecond)
+			}
+			if err := sink.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			files, _ := filepath.Glob(filepath.Join(dir, "logs", "*"))
+			if len(files) != tt.wantFiles {
+				t.Fatalf("files = %v, want %d", files, tt.wantFiles)
+			}
+			for _, file := range files {
+				if file == tt.cfg.Path {
+					continue
+				}
+				if strings.HasSuffix(file, ".gz") != tt.wantGzip {
+					t.Errorf("rotated file %s, want gzip %v", file, tt.wantGzip)
+				}
+				if tt.wantGzip {
+					assertGzipContains(t, file, `"message":"0123456789"`)
+				}
+			}
+		})
+	}
+}
+
+func assertGzipContains(t *testing.T, path, want string) {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(reader)
+	if !strings.Contains(string(content), want) {
+		t.Errorf("%s = %s, want %s", path, content, want)
+	}
+}
+
+func TestFileSinkClose(t *testing.T) {
+	sink, err := NewFileSink(FileSinkConfig{Path: filepath.Join(t.TempDir(), "access.log")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+	if err := sink.Post("access", map[string]interface{}{}); err == nil {
+		t.Error("Post() after Close() succeeded")
+	}
+}
+
+func TestFileSinkReopenOnSIGHUP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	sink, err := NewFileSink(FileSinkConfig{Path: path, TagField: "tag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	sink.Post("access", map[string]interface{}{"n": 1})
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	sink.Post("audit", map[string]interface{}{"n": 2})
+
+	records := readRecords(t, path)
+	if len(records) != 1 || records[0]["tag"] != "audit" {
+		t.Errorf("records after reopen = %v", records)
+	}
+}
+
+func TestFileSinkReopenFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	sink, err := NewFileSink(FileSinkConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	sink.Post("access", map[string]interface{}{"n": 1})
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if err := sink.Post("access", map[string]interface{}{"n": 2}); err != nil {
+		t.Fatalf("Post() after failed reopen error = %v", err)
+	}
+	if records := readRecords(t, path+".1"); len(records) != 2 {
+		t.Errorf("records = %v, want both in the old file", records)
+	}
+}
+
+func TestTaggedRecord(t *testing.T) {
+	record := map[string]interface{}{"path": "/"}
+
+	if got := taggedRecord(record, "", "access"); !reflect.DeepEqual(got, record) {
+		t.Errorf("taggedRecord() without field = %v", got)
+	}
+	got := taggedRecord(record, "tag", "access")
+	if !reflect.DeepEqual(got, map[string]interface{}{"path": "/", "tag": "access"}) {
+		t.Errorf("taggedRecord() = %v", got)
+	}
+	if _, ok := record["tag"]; ok {
+		t.Error("taggedRecord() changed the record")
+	}
+}
+
+func TestRotatedFileName(t *testing.T) {
+	moment := time.Date(2024, 1, 2, 3, 4, 5, 6000000, time.UTC)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/var/log/access.log", "/var/log/access-2024-01-02T03-04-05.006.log"},
+		{"/var/log/access", "/var/log/access-2024-01-02T03-04-05.006"},
+	}
+	for _, tt := range tests {
+		if got := rotatedFileName(tt.path, moment); got != tt.want {
+			t.Errorf("rotatedFileName(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestIsRotatedFileName(t *testing.T) {
+	tests := []struct {
+		base string
+		name string
+		want bool
+	}{
+		{"access.log", "access-2024-01-02T03-04-05.006.log", true},
+		{"access.log", "access-2024-01-02T03-04-05.006.log.gz", true},
+		{"access.log", "access-2024-01-02T03-04-05.006.log.gz.tmp", false},
+		{"access.log", "access-old.log", false},
+		{"access.log", "access.log", false},
+		{"access", "access-2024-01-02T03-04-05.006", true},
+		{"access", "access-2024-01-02T03-04-05.006.gz", true},
+		{"access", "access-control.json", false},
+		{"access", "access-2024-01-02.tar", false},
+	}
+	for _, tt := range tests {
+		if got := isRotatedFileName(tt.base, tt.name); got != tt.want {
+			t.Errorf("isRotatedFileName(%q, %q) = %v, want %v", tt.base, tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+const (
+	defaultForwardHost    = "127.0.0.1"
+	defaultForwardPort    = 24224
+	defaultForwardNetwork = "tcp"
+	defaultForwardTimeout = 3 * time.Second
+	defaultAckTimeout     = 5 * time.Second
+)
+
+// ForwardSecurity holds the shared key and optional user credentials of
+// fluentd `<security>` section used in the HELO/PING/PONG handshake.
+type ForwardSecurity struct {
+	SelfHostname string
+	SharedKey    string
+	Username     string
+	Password     string
+}
+
+// ForwardConfig configures a forward protocol connection to fluentd.
+type ForwardConfig struct {
+	Host               string
+	Port               int
+	Network            string
+	SocketPath         string
+	Timeout            time.Duration
+	WriteTimeout       time.Duration
+	TagPrefix          string
+	SubSecondPrecision bool
+	AckTimeout         time.Duration
+	TLS                *tls.Config
+	Security           *ForwardSecurity
+}
+
+func (c ForwardConfig) address() (string, string) {
+	if c.Network == "unix" {
+		return "unix", c.SocketPath
+	}
+
+	return c.Network, net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+// ForwardClient sends records with the fluentd forward protocol over TCP,
+// TLS or a unix socket, performing the shared key handshake if configured.
+// Connections are established lazily and re-established after errors.
+type ForwardClient struct {
+	cfg  ForwardConfig
+	conn *sinkConn
+
+	// reader reads responses of the current connection, guarded by conn
+	reader *msgp.Reader
+}
+
+func NewForwardClient(cfg ForwardConfig) *ForwardClient {
+	if cfg.Host == "" {
+		cfg.Host = defaultForwardHost
+	}
+	if cfg.Port == 0 {
+		cfg.Port = defaultForwardPort
+	}
+	if cfg.Network == "" {
+		cfg.Network = defaultForwardNetwork
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultForwardTimeout
+	}
+	if cfg.AckTimeout == 0 {
+		cfg.AckTimeout = defaultAckTimeout
+	}
+
+	c := &ForwardClient{cfg: cfg}
+	c.conn = newSinkConn(c.dial, c.cfg.WriteTimeout)
+
+	return c
+}
+
+func (c *ForwardClient) Post(tag string, record map[string]interface{}) error {
+	tag = forwardTag(c.cfg.TagPrefix, tag)
+
+	return c.write(encodeMessage(tag, time.Now(), record, c.cfg.SubSecondPrecision), "")
+}
+
+// postChunk sends a chunk and, if the chunk requests it, waits for the
+// acknowledgment of its ID.
+func (c *ForwardClient) postChunk(chunk *forwardChunk) error {
+	ack := ""
+	if chunk.ack {
+		ack = chunk.id
+	}
+
+	return c.write(encodePackedForward(forwardTag(c.cfg.TagPrefix, chunk.tag), chunk), ack)
+}
+
+func forwardTag(prefix, tag string) string {
+	if prefix == "" {
+		return tag
+	}
+
+	return prefix + "." + tag
+}
+
+// write sends an encoded message and reads the ack response if ack is
+// not empty.
+func (c *ForwardClient) write(message []byte, ack string) error {
+	var read func(conn net.Conn) error
+	if ack != "" {
+		read = func(conn net.Conn) error {
+			return c.readAck(conn, ack)
+		}
+	}
+
+	return c.conn.write(func(conn net.Conn) error {
+		_, err := conn.Write(message)
+		return err
+	}, read)
+}
+
+func (c *ForwardClient) readAck(conn net.Conn, chunkID string) error {
+	if err := conn.SetReadDeadline(time.Now().Add(c.cfg.AckTimeout)); err != nil {
+		return err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	response, err := c.reader.ReadIntf()
+	if err != nil {
+		return fmt.Errorf("no ack for chunk %s: %v", chunkID, err)
+	}
+	responseMap, ok := response.(map[string]interface{})
+	if !ok || string(handshakeBytes(responseMap["ack"])) != chunkID {
+		return fmt.Errorf("wrong ack for chunk %s: %v", chunkID, response)
+	}
+
+	return nil
+}
+
+// send writes a handshake message, which goes out while dialing, before
+// the connection write deadline is set.
+func (c *ForwardClient) send(conn net.Conn, message []byte) error {
+	if c.cfg.WriteTimeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout)); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Write(message)
+
+	return err
+}
+
+// dial connects and, if security is configured, authenticates the
+// connection.
+func (c *ForwardClient) dial() (net.Conn, error) {
+	network, address := c.cfg.address()
+	dialer := &net.Dialer{Timeout: c.cfg.Timeout}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if c.cfg.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, network, address, c.cfg.TLS)
+	} else {
+		conn, err = dialer.Dial(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.reader = msgp.NewReader(conn)
+	if c.cfg.Security != nil {
+		if err := c.handshake(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("forward handshake with %s failed: %v", address, err)
+		}
+	}
+
+	return conn, nil
+}
+
+func (c *ForwardClient) Close() error {
+	return c.conn.Close()
+}
+
+// handshake performs HELO/PING/PONG authentication described in the
+// forward protocol specification.
+func (c *ForwardClient) handshake(conn net.Conn) error {
+	security := c.cfg.Security
+	if err := conn.SetDeadline(time.Now().Add(c.cfg.Timeout)); err != nil {
+		return err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	helo, err := readHandshakeMessage(c.reader, "HELO", 2)
+	if err != nil {
+		return err
+	}
+	options, ok := helo[1].(map[string]interface{})
+	if !ok {
+		return errors.New("malformed HELO options")
+	}
+	nonce := handshakeBytes(options["nonce"])
+	authSalt := handshakeBytes(options["auth"])
+
+	sharedKeySalt := make([]byte, 16)
+	if _, err := rand.Read(sharedKeySalt); err != nil {
+		return err
+	}
+
+	passwordDigest := ""
+	if security.Username != "" {
+		passwordDigest = sha512Hex(authSalt, []byte(security.Username), []byte(security.Password))
+	}
+
+	ping := msgp.AppendArrayHeader(nil, 6)
+	ping = msgp.AppendString(ping, "PING")
+	ping = msgp.AppendString(ping, security.SelfHostname)
+	ping = msgp.AppendBytes(ping, sharedKeySalt)
+	ping = msgp.AppendString(ping, sha512Hex(
+		sharedKeySalt, []byte(security.SelfHostname), nonce, []byte(security.SharedKey),
+	))
+	ping = msgp.AppendString(ping, security.Username)
+	ping = msgp.AppendString(ping, passwordDigest)
+	if err := c.send(conn, ping); err != nil {
+		return err
+	}
+
+	pong, err := readHandshakeMessage(c.reader, "PONG", 5)
+	if err != nil {
+		return err
+	}
+	if authenticated, _ := pong[1].(bool); !authenticated {
+		return fmt.Errorf("authentication failed: %v", pong[2])
+	}
+
+	serverHostname := string(handshakeBytes(pong[3]))
+	expected := sha512Hex(sharedKeySalt, []byte(serverHostname), nonce, []byte(security.SharedKey))
+	if string(handshakeBytes(pong[4])) != expected {
+		return errors.New("server shared key mismatch")
+	}
+
+	return nil
+}
+
+func readHandshakeMessage(reader *msgp.Reader, kind string, size int) ([]interface{}, error) {
+	value, err := reader.ReadIntf()
+	if err != nil {
+		return nil, err
+	}
+
+	message, ok := value.([]interface{})
+	if !ok || len(message) < size || string(handshakeBytes(message[0])) != kind {
+		return nil, fmt.Errorf("%s expected", kind)
+	}
+
+	return message, nil
+}
+
+func handshakeBytes(value interface{}) []byte {
+	switch v := value.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
+
+	return nil
+}
+
+func sha512Hex(parts ...[]byte) string {
+	hash := sha512.New()
+	for _, part := range parts {
+		hash.Write(part)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// encodeMessage encodes a record in forward protocol Message mode:
+// [tag, time, record].
+func encodeMessage(tag string, t time.Time, record map[string]interface{}, subSecond bool) []byte {
+	message := msgp.AppendArrayHeader(nil, 3)
+	message = msgp.AppendString(message, tag)
+	message = appendEventTime(message, t, subSecond)
+
+	return appendRecord(message, record)
+}
+
+// encodeEntry encodes a record as [time, record] entry of PackedForward
+// event stream.
+func encodeEntry(b []byte, t time.Time, record map[string]interface{}, subSecond bool) []byte {
+	b = msgp.AppendArrayHeader(b, 2)
+	b = appendEventTime(b, t, subSecond)
+
+	return appendRecord(b, record)
+}
+
+// encodePackedForward encodes a chunk in PackedForward mode:
+// [tag, entries, {"size": n}], with "compressed": "gzip" for
+// CompressedPackedForward and "chunk": id when ack is requested.
+func encodePackedForward(tag string, chunk *forwardChunk) []byte {
+	options := 1
+	if chunk.compressed {
+		options++
+	}
+	if chunk.ack {
+		options++
+	}
+
+	message := msgp.AppendArrayHeader(nil, 3)
+	message = msgp.AppendString(message, tag)
+	message = msgp.AppendBytes(message, chunk.entries)
+	message = msgp.AppendMapHeader(message, uint32(options))
+	message = msgp.AppendString(message, "size")
+	message = msgp.AppendInt(message, chunk.size)
+	if chunk.compressed {
+		message = msgp.AppendString(message, "compressed")
+		message = msgp.AppendString(message, "gzip")
+	}
+	if chunk.ack {
+		message = msgp.AppendString(message, "chunk")
+		message = msgp.AppendString(message, chunk.id)
+	}
+
+	return message
+}
+
+// appendEventTime appends integer seconds or EventTime extension
+// (type 0: big-endian uint32 seconds and nanoseconds).
+func appendEventTime(b []byte, t time.Time, subSecond bool) []byte {
+	if !subSecond {
+		return msgp.AppendInt64(b, t.Unix())
+	}
+
+	seconds, nanoseconds := uint32(t.Unix()), uint32(t.Nanosecond())
+	return append(b, 0xd7, 0x00,
+		byte(seconds>>24), byte(seconds>>16), byte(seconds>>8), byte(seconds),
+		byte(nanoseconds>>24), byte(nanoseconds>>16), byte(nanoseconds>>8), byte(nanoseconds),
+	)
+}
+
+func appendRecord(b []byte, record map[string]interface{}) []byte {
+	b = msgp.AppendMapHeader(b, uint32(len(record)))
+	for k, v := range record {
+		b = msgp.AppendString(b, k)
+		b = appendValue(b, v)
+	}
+
+	return b
+}
+
+// appendValue encodes value, falling back to its string form for types
+// msgpack has no representation for.
+func appendValue(b []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return appendRecord(b, v)
+	case []interface{}:
+		b = msgp.AppendArrayHeader(b, uint32(len(v)))
+		for _, item := range v {
+			b = appendValue(b, item)
+		}
+		return b
+	}
+
+	if encoded, err := msgp.AppendIntf(b, value); err == nil {
+		return encoded
+	}
+
+	return msgp.AppendString(b, fmt.Sprintf("%v", value))
+}
+
+// NewForwardTLSConfig builds TLS settings from a CA file, an optional
+// client certificate and key, and the expected server name.
+func NewForwardTLSConfig(caFile, certFile, keyFile, serverName string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName, InsecureSkipVerify: insecure} //nolint:gosec
+
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in '%s'", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
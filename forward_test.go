@@ -0,0 +1,293 @@
+package handler
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-logger-golang/fluent"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// fakeFluentd is a forward protocol server accepting one connection,
+// authenticating it with sharedKey and acknowledging chunks.
+type fakeFluentd struct {
+	listener  net.Listener
+	sharedKey string
+	hostname  string
+	messages  chan []interface{}
+	pings     chan []interface{}
+}
+
+func newFakeFluentd(t *testing.T, sharedKey string) *fakeFluentd {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &fakeFluentd{
+		listener:  listener,
+		sharedKey: sharedKey,
+		hostname:  "fluentd-test",
+		messages:  make(chan []interface{}, 10),
+		pings:     make(chan []interface{}, 1),
+	}
+	go server.serve()
+
+	return server
+}
+
+func (s *fakeFluentd) config() ForwardConfig {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+
+	return ForwardConfig{Host: host, Port: portNumber, Timeout: time.Second, AckTimeout: time.Second}
+}
+
+func (s *fakeFluentd) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	reader := msgp.NewReader(conn)
+
+	nonce, auth := []byte("nonce"), []byte("auth-salt")
+	if s.sharedKey != "" {
+		helo := msgp.AppendArrayHeader(nil, 2)
+		helo = msgp.AppendString(helo, "HELO")
+		helo = msgp.AppendMapHeader(helo, 3)
+		helo = msgp.AppendString(helo, "nonce")
+		helo = msgp.AppendBytes(helo, nonce)
+		helo = msgp.AppendString(helo, "auth")
+		helo = msgp.AppendBytes(helo, auth)
+		helo = msgp.AppendString(helo, "keepalive")
+		helo = msgp.AppendBool(helo, true)
+		conn.Write(helo)
+
+		value, err := reader.ReadIntf()
+		if err != nil {
+			return
+		}
+		ping, _ := value.([]interface{})
+		s.pings <- ping
+		if len(ping) != 6 {
+			return
+		}
+		salt := handshakeBytes(ping[2])
+		clientHostname := handshakeBytes(ping[1])
+		authenticated := string(handshakeBytes(ping[3])) ==
+			sha512Hex(salt, clientHostname, nonce, []byte(s.sharedKey))
+
+		pong := msgp.AppendArrayHeader(nil, 5)
+		pong = msgp.AppendString(pong, "PONG")
+		pong = msgp.AppendBool(pong, authenticated)
+		pong = msgp.AppendString(pong, "")
+		pong = msgp.AppendString(pong, s.hostname)
+		pong = msgp.AppendString(pong, sha512Hex(salt, []byte(s.hostname), nonce, []byte(s.sharedKey)))
+		conn.Write(pong)
+		if !authenticated {
+			return
+		}
+	}
+
+	for {
+		value, err := reader.ReadIntf()
+		if err != nil {
+			return
+		}
+		message, _ := value.([]interface{})
+		s.messages <- message
+		if len(message) == 3 {
+			if options, ok := message[2].(map[string]interface{}); ok && options["chunk"] != nil {
+				ack := msgp.AppendMapHeader(nil, 1)
+				ack = msgp.AppendString(ack, "ack")
+				ack = msgp.AppendString(ack, options["chunk"].(string))
+				conn.Write(ack)
+			}
+		}
+	}
+}
+
+func TestForwardClientHandshake(t *testing.T) {
+	tests := []struct {
+		name      string
+		clientKey string
+		serverKey string
+		username  string
+		wantErr   bool
+	}{
+		{name: "shared key", clientKey: "secret", serverKey: "secret"},
+		{name: "shared key with user", clientKey: "secret", serverKey: "secret", username: "krakend"},
+		{name: "wrong shared key", clientKey: "wrong", serverKey: "secret", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeFluentd(t, tt.serverKey)
+			cfg := server.config()
+			cfg.Security = &ForwardSecurity{
+				SelfHostname: "gateway-1", SharedKey: tt.clientKey, Username: tt.username, Password: "pass",
+			}
+			client := NewForwardClient(cfg)
+			defer client.Close()
+
+			err := client.Post("access", map[string]interface{}{"path": "/"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Post() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			ping := <-server.pings
+			if string(handshakeBytes(ping[0])) != "PING" || string(handshakeBytes(ping[1])) != "gateway-1" {
+				t.Errorf("PING = %v", ping)
+			}
+			if string(handshakeBytes(ping[4])) != tt.username {
+				t.Errorf("PING username = %v, want %q", ping[4], tt.username)
+			}
+			if tt.username != "" {
+				want := sha512Hex([]byte("auth-salt"), []byte(tt.username), []byte("pass"))
+				if string(handshakeBytes(ping[5])) != want {
+					t.Errorf("PING password digest = %v, want %s", ping[5], want)
+				}
+			}
+			if tt.wantErr {
+				return
+			}
+
+			message := <-server.messages
+			if len(message) != 3 || string(handshakeBytes(message[0])) != "access" {
+				t.Fatalf("message = %v", message)
+			}
+			record, _ := message[2].(map[string]interface{})
+			if !reflect.DeepEqual(record, map[string]interface{}{"path": "/"}) {
+				t.Errorf("record = %v", record)
+			}
+		})
+	}
+}
+
+func TestForwardClientAck(t *testing.T) {
+	server := newFakeFluentd(t, "secret")
+	cfg := server.config()
+	cfg.TagPrefix = "krakend"
+	cfg.Security = &ForwardSecurity{SelfHostname: "gateway-1", SharedKey: "secret"}
+	client := NewForwardClient(cfg)
+	defer client.Close()
+
+	chunk := &forwardChunk{tag: "access", id: newChunkID(), ack: true, size: 2}
+	chunk.entries = encodeEntry(chunk.entries, time.Now(), map[string]interface{}{"n": 1}, false)
+	chunk.entries = encodeEntry(chunk.entries, time.Now(), map[string]interface{}{"n": 2}, false)
+	if err := client.postChunk(chunk); err != nil {
+		t.Fatalf("postChunk() error = %v", err)
+	}
+
+	message := <-server.messages
+	if string(handshakeBytes(message[0])) != "krakend.access" {
+		t.Errorf("tag = %v, want krakend.access", message[0])
+	}
+	options, _ := message[2].(map[string]interface{})
+	if options["chunk"] != chunk.id || options["size"] != int64(2) {
+		t.Errorf("options = %v", options)
+	}
+}
+
+func TestForwardClientAckTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			msgp.NewReader(conn).ReadIntf()
+			time.Sleep(200 * time.Millisecond)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+	client := NewForwardClient(ForwardConfig{Host: host, Port: portNumber, AckTimeout: 50 * time.Millisecond})
+	defer client.Close()
+
+	chunk := &forwardChunk{tag: "access", id: newChunkID(), ack: true, size: 1}
+	chunk.entries = encodeEntry(nil, time.Now(), map[string]interface{}{"n": 1}, false)
+	if err := client.postChunk(chunk); err == nil {
+		t.Error("postChunk() without ack succeeded")
+	}
+}
+
+func TestNewFluentSinkWithoutFluentd(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	conf := FluentLoggerConfig{FluentConfig: fluent.Config{
+		FluentHost: "127.0.0.1", FluentPort: address.Port, Timeout: 100 * time.Millisecond, MaxRetry: 1,
+	}}
+	sink, err := NewFluentSink(conf)
+	if err != nil || sink == nil {
+		t.Fatalf("NewFluentSink() = %v, %v, want a sink reconnecting later", sink, err)
+	}
+	sink.Close()
+}
+
+func TestAsyncBatchConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       fluent.Config
+		wantBatch    BatchConfig
+		wantDelivery DeliveryConfig
+	}{
+		{
+			name:   "defaults",
+			config: fluent.Config{Async: true},
+		},
+		{
+			name:         "small buffer",
+			config:       fluent.Config{Async: true, BufferLimit: 100, MaxRetry: 3, RetryWait: 200, MaxRetryWait: 1000},
+			wantBatch:    BatchConfig{MaxRecords: 100, QueueSize: 1},
+			wantDelivery: DeliveryConfig{MaxAttempts: 3, RetryWait: 200 * time.Millisecond, MaxRetryWait: time.Second},
+		},
+		{
+			name:      "large buffer",
+			config:    fluent.Config{Async: true, BufferLimit: 8 * 1024},
+			wantBatch: BatchConfig{MaxRecords: defaultBatchMaxRecords, QueueSize: 9},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batch, delivery := asyncBatchConfig(tt.config)
+			if batch != tt.wantBatch || delivery != tt.wantDelivery {
+				t.Errorf("asyncBatchConfig() = %+v, %+v, want %+v, %+v",
+					batch, delivery, tt.wantBatch, tt.wantDelivery)
+			}
+		})
+	}
+}
+
+func TestNewFluentSinkAsyncForward(t *testing.T) {
+	conf := FluentLoggerConfig{
+		FluentConfig:    fluent.Config{Async: true},
+		ForwardSecurity: &ForwardSecurity{SharedKey: "secret"},
+	}
+	sink, err := NewFluentSink(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	if _, ok := sink.(*ForwardBatcher); !ok {
+		t.Errorf("sink = %T, want *ForwardBatcher", sink)
+	}
+}
@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"time"
+)
+
+const (
+	gelfCompressionGzip = "gzip"
+	gelfCompressionZlib = "zlib"
+	gelfCompressionNone = "none"
+
+	defaultGELFChunkSize = 1420
+	gelfMaxChunks        = 128
+	gelfChunkHeaderSize  = 12
+)
+
+var gelfFieldName = regexp.MustCompile(`[^\w.\-]`)
+
+// GELFConfig configures the GELF sink. Network is "udp", "tcp" or "tls".
+// Compression and chunking apply to UDP only. Timeout bounds both dialing
+// and writing a message.
+type GELFConfig struct {
+	Network     string
+	Address     string
+	Host        string
+	Compression string
+	ChunkSize   int
+	Timeout     time.Duration
+	TLS         *tls.Config
+}
+
+// GELFSink sends records to Graylog as GELF 1.1 messages: record fields
+// become "_"-prefixed additional fields, "METHOD path status" the short
+// message and the level follows the response status as in syslog.
+type GELFSink struct {
+	cfg  GELFConfig
+	conn *sinkConn
+}
+
+func NewGELFSink(cfg GELFConfig) (*GELFSink, error) {
+	switch cfg.Network {
+	case "udp", "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("unknown network '%s'", cfg.Network)
+	}
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("no 'address' found")
+	}
+	switch cfg.Compression {
+	case "":
+		cfg.Compression = gelfCompressionGzip
+	case gelfCompressionGzip, gelfCompressionZlib, gelfCompressionNone:
+	default:
+		return nil, fmt.Errorf("unknown compression '%s'", cfg.Compression)
+	}
+	if cfg.ChunkSize <= gelfChunkHeaderSize {
+		cfg.ChunkSize = defaultGELFChunkSize
+	}
+	if cfg.Host == "" {
+		cfg.Host, _ = os.Hostname()
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultForwardTimeout
+	}
+
+	s := &GELFSink{cfg: cfg}
+	s.conn = newSinkConn(s.dial, s.cfg.Timeout)
+
+	return s, nil
+}
+
+func (s *GELFSink) Post(tag string, record map[string]interface{}) error {
+	message, err := json.Marshal(s.message(tag, record, time.Now()))
+	if err != nil {
+		return err
+	}
+
+	var packets [][]byte
+	if s.cfg.Network == "udp" {
+		packets, err = s.udpPackets(message)
+		if err != nil {
+			return err
+		}
+	} else {
+		packets = [][]byte{append(message, 0)}
+	}
+
+	return s.conn.write(func(conn net.Conn) error {
+		for _, packet := range packets {
+			if _, err := conn.Write(packet); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil)
+}
+
+func (s *GELFSink) Close() error {
+	return s.conn.Close()
+}
+
+func (s *GELFSink) message(tag string, record map[string]interface{}, t time.Time) map[string]interface{} {
+	message := map[string]interface{}{
+		"version":       "1.1",
+		"host":          s.cfg.Host,
+		"short_message": recordSummary(record),
+		"timestamp":     float64(t.UnixNano()/int64(time.Millisecond)) / 1000,
+		"level":         statusSeverity(recordStatus(record)),
+		"_tag":          tag,
+	}
+
+	for k, v := range record {
+		name := "_" + gelfFieldName.ReplaceAllString(k, "_")
+		if name == "_id" || v == nil {
+			continue
+		}
+		switch value := v.(type) {
+		case string, int, int32, int64, uint, uint32, uint64, float32, float64:
+			message[name] = value
+		default:
+			message[name] = recordValueString(value)
+		}
+	}
+
+	return message
+}
+
+// udpPackets compresses the message and splits it into chunks when it
+// does not fit one datagram: 0x1e 0x0f, 8 bytes message ID, sequence
+// number and count, then the data.
+func (s *GELFSink) udpPackets(message []byte) ([][]byte, error) {
+	payload, err := gelfCompress(message, s.cfg.Compression)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) <= s.cfg.ChunkSize {
+		return [][]byte{payload}, nil
+	}
+
+	dataSize := s.cfg.ChunkSize - gelfChunkHeaderSize
+	count := (len(payload) + dataSize - 1) / dataSize
+	if count > gelfMaxChunks {
+		return nil, fmt.Errorf("GELF message of %d bytes needs more than %d chunks", len(payload), gelfMaxChunks)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	packets := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * dataSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		packet := make([]byte, 0, gelfChunkHeaderSize+end-i*dataSize)
+		packet = append(packet, 0x1e, 0x0f)
+		packet = append(packet, id...)
+		packet = append(packet, byte(i), byte(count))
+		packets = append(packets, append(packet, payload[i*dataSize:end]...))
+	}
+
+	return packets, nil
+}
+
+func gelfCompress(message []byte, compression string) ([]byte, error) {
+	if compression == gelfCompressionNone {
+		return message, nil
+	}
+
+	var buffer bytes.Buffer
+	var writer io.WriteCloser
+	if compression == gelfCompressionZlib {
+		writer = zlib.NewWriter(&buffer)
+	} else {
+		writer = gzip.NewWriter(&buffer)
+	}
+	if _, err := writer.Write(message); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func (s *GELFSink) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: s.cfg.Timeout}
+	if s.cfg.Network == "tls" {
+		return tls.DialWithDialer(dialer, "tcp", s.cfg.Address, s.cfg.TLS)
+	}
+
+	return dialer.Dial(s.cfg.Network, s.cfg.Address)
+}
+
+func newGELFSinkFromConfig(_ FluentLoggerConfig, cfg map[string]interface{}) (Sink, error) {
+	gelfConfig := GELFConfig{}
+	for option, target := range map[string]*string{
+		"network":     &gelfConfig.Network,
+		"address":     &gelfConfig.Address,
+		"host":        &gelfConfig.Host,
+		"compression": &gelfConfig.Compression,
+	} {
+		if _, ok := cfg[option]; ok {
+			*target = ConvertToString(option, cfg)
+		}
+	}
+	if _, ok := cfg["chunk_size"]; ok {
+		gelfConfig.ChunkSize = ConvertToInt("chunk_size", cfg)
+	}
+	if _, ok := cfg["timeout"]; ok {
+		gelfConfig.Timeout = ConvertToDuration("timeout", cfg)
+	}
+	if tlsConfigMap, ok := cfg["tls"].(map[string]interface{}); ok {
+		tlsConfig, err := parseTLSConfig(tlsConfigMap)
+		if err != nil {
+			return nil, err
+		}
+		gelfConfig.TLS = tlsConfig
+	}
+
+	return NewGELFSink(gelfConfig)
+}
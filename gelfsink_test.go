@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestGELFSink(t *testing.T, cfg GELFConfig) *GELFSink {
+	t.Helper()
+
+	if cfg.Network == "" {
+		cfg.Network = "udp"
+	}
+	if cfg.Address == "" {
+		cfg.Address = "127.0.0.1:12201"
+	}
+	cfg.Host = "gw"
+	sink, err := NewGELFSink(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sink
+}
+
+func TestGELFMessage(t *testing.T) {
+	sink := newTestGELFSink(t, GELFConfig{})
+	record := map[string]interface{}{
+		"request.method":       "POST",
+		"path":                 "/orders",
+		"response.status_code": "502",
+		"latency ms":           12,
+		"id":                   "reserved",
+		"nested":               map[string]interface{}{"a": 1},
+		"empty":                nil,
+	}
+
+	got := sink.message("access", record, time.Unix(1700000000, 123456789))
+	want := map[string]interface{}{
+		"version":               "1.1",
+		"host":                  "gw",
+		"short_message":         "POST /orders 502",
+		"timestamp":             1700000000.123,
+		"level":                 severityError,
+		"_tag":                  "access",
+		"_request.method":       "POST",
+		"_path":                 "/orders",
+		"_response.status_code": "502",
+		"_latency_ms":           12,
+		"_nested":               `{"a":1}`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("message() = %v, want %v", got, want)
+	}
+}
+
+func TestGELFUDPPackets(t *testing.T) {
+	tests := []struct {
+		name        string
+		size        int
+		chunkSize   int
+		wantPackets int
+		wantErr     bool
+	}{
+		{name: "single datagram", size: 100, chunkSize: 200, wantPackets: 1},
+		{name: "chunked", size: 250, chunkSize: 112, wantPackets: 3},
+		{name: "128 chunks", size: 128 * 100, chunkSize: 112, wantPackets: 128},
+		{name: "over 128 chunks", size: 128*100 + 1, chunkSize: 112, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := newTestGELFSink(t, GELFConfig{Compression: gelfCompressionNone, ChunkSize: tt.chunkSize})
+			message := bytes.Repeat([]byte("x"), tt.size)
+
+			packets, err := sink.udpPackets(message)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("udpPackets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(packets) != tt.wantPackets {
+				t.Fatalf("packets = %d, want %d", len(packets), tt.wantPackets)
+			}
+			if len(packets) == 1 {
+				if !bytes.Equal(packets[0], message) {
+					t.Error("single datagram is not the message")
+				}
+				return
+			}
+
+			var joined []byte
+			id := packets[0][2:10]
+			for i, packet := range packets {
+				if len(packet) > tt.chunkSize {
+					t.Errorf("chunk %d of %d bytes, over %d", i, len(packet), tt.chunkSize)
+				}
+				if packet[0] != 0x1e || packet[1] != 0x0f {
+					t.Errorf("chunk %d magic = %x", i, packet[:2])
+				}
+				if !bytes.Equal(packet[2:10], id) {
+					t.Errorf("chunk %d message ID = %x, want %x", i, packet[2:10], id)
+				}
+				if int(packet[10]) != i || int(packet[11]) != len(packets) {
+					t.Errorf("chunk %d sequence = %d/%d", i, packet[10], packet[11])
+				}
+				joined = append(joined, packet[gelfChunkHeaderSize:]...)
+			}
+			if !bytes.Equal(joined, message) {
+				t.Error("chunks do not join into the message")
+			}
+		})
+	}
+}
+
+func TestGELFCompress(t *testing.T) {
+	message := []byte(`{"short_message":"GET / 200"}`)
+
+	tests := []struct {
+		compression string
+		reader      func(io.Reader) (io.Reader, error)
+	}{
+		{gelfCompressionNone, func(r io.Reader) (io.Reader, error) { return r, nil }},
+		{gelfCompressionGzip, func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{gelfCompressionZlib, func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) }},
+	}
+
+	for _, tt := range tests {
+		compressed, err := gelfCompress(message, tt.compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := tt.reader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.compression, err)
+		}
+		if decompressed, _ := io.ReadAll(reader); !bytes.Equal(decompressed, message) {
+			t.Errorf("%s: decompressed = %s", tt.compression, decompressed)
+		}
+	}
+}
+
+func TestGELFSinkTCPFraming(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		var messages []string
+		for len(messages) < 2 {
+			message, err := reader.ReadString(0)
+			if err != nil {
+				break
+			}
+			messages = append(messages, strings.TrimSuffix(message, "\x00"))
+		}
+		received <- messages
+	}()
+
+	sink := newTestGELFSink(t, GELFConfig{Network: "tcp", Address: listener.Addr().String()})
+	defer sink.Close()
+	for _, path := range []string{"/first", "/second"} {
+		if err := sink.Post("access", map[string]interface{}{"path": path}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case messages := <-received:
+		if len(messages) != 2 {
+			t.Fatalf("messages = %q", messages)
+		}
+		for i, path := range []string{"/first", "/second"} {
+			var message map[string]interface{}
+			if err := json.Unmarshal([]byte(messages[i]), &message); err != nil {
+				t.Fatalf("message %q is not uncompressed JSON: %v", messages[i], err)
+			}
+			if message["_path"] != path {
+				t.Errorf("message %d _path = %v, want %s", i, message["_path"], path)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no messages received")
+	}
+}
+
+func TestGELFSinkUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink := newTestGELFSink(t, GELFConfig{Address: conn.LocalAddr().String()})
+	defer sink.Close()
+	if err := sink.Post("access", map[string]interface{}{"path": "/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 65536)
+	n, _, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(buffer[:n]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message map[string]interface{}
+	if err := json.NewDecoder(reader).Decode(&message); err != nil {
+		t.Fatal(err)
+	}
+	if message["_path"] != "/" || message["version"] != "1.1" {
+		t.Errorf("message = %v", message)
+	}
+}
@@ -10,5 +10,7 @@ require (
 	github.com/google/uuid v1.3.0
 	github.com/luraproject/lura v1.4.1
 	github.com/luraproject/lura/v2 v2.2.2
-	github.com/tinylib/msgp v1.1.6 // indirect
+	github.com/tinylib/msgp v1.1.6
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
+	google.golang.org/protobuf v1.28.0
 )
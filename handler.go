@@ -4,7 +4,7 @@ import (
 	"errors"
 	"fmt"
 
-	"github.com/fluent/fluent-logger-golang/fluent"
+	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/luraproject/lura/logging"
@@ -35,25 +35,54 @@ func ReadConfig(conf *FluentLoggerConfig, extra config.ExtraConfig) error {
 	if err != nil {
 		printOutError("fluentd 'skip' paths", err, "set %s error: %v \n")
 	}
+	conf.setMaskConfig(appConfigMap)
 	err = conf.SetJWTClaimsConfig(appConfigMap)
 	if err != nil {
 		printOutError("fluentd 'include_jwt_claims' ", err, "set %s error: %v \n")
 	}
+	conf.setJWTVerificationConfig(appConfigMap)
+	conf.setJWTTokenSourcesConfig(appConfigMap)
+	conf.setConsumerConfig(appConfigMap)
+	conf.setEnrichersConfig(appConfigMap)
+	conf.setRepanicConfig(appConfigMap)
+	conf.setSinksConfig(appConfigMap)
 	err = conf.setBodyLoggingOptions(appConfigMap)
 	if err != nil {
 		printOutError("fluentd 'response' ", err, "set %s error: %v \n")
 	}
 
-	conf.setMaskConfig(appConfigMap)
+	conf.setHeadersConfig(appConfigMap)
+	conf.setFlatHeadersConfig(appConfigMap)
+	conf.setProjectionConfig(appConfigMap)
+	conf.setRedactConfig(appConfigMap)
 
 	return nil
 }
 
+// AdditionalData changes the record before it is enriched and posted.
+// Enrichers, which also get the gin context, should be preferred.
 type AdditionalData func(log LogWriter, data map[string]interface{}) map[string]interface{}
 
+// FluentLoggerWithConfig creates the logging middleware. additionalData,
+// if not nil, is called with every record.
 func FluentLoggerWithConfig(
 	logger logging.Logger, cfg config.ExtraConfig, additionalData AdditionalData,
 ) gin.HandlerFunc {
+	return newFluentLogger(logger, cfg, additionalData, nil)
+}
+
+// FluentLoggerWithEnrichers creates the logging middleware with custom
+// enrichers. They run in the given order after built-in ones and can be
+// disabled by name in config.
+func FluentLoggerWithEnrichers(
+	logger logging.Logger, cfg config.ExtraConfig, enrichers ...Enricher,
+) gin.HandlerFunc {
+	return newFluentLogger(logger, cfg, nil, enrichers)
+}
+
+func newFluentLogger(
+	logger logging.Logger, cfg config.ExtraConfig, additionalData AdditionalData, enrichers []Enricher,
+) gin.HandlerFunc {
 
 	conf := FluentLoggerConfig{logger: logger}
 
@@ -62,7 +91,12 @@ func FluentLoggerWithConfig(
 		logger.Error("krakend-fluentd-request-logger: ", err.Error())
 		return EmptyFunc
 	}
-	fluentLogger, _ := fluent.New(conf.FluentConfig)
+	conf.Enrichers = buildEnricherChain(conf.enrichersConfig, enrichers)
+	sink, err := NewSink(conf)
+	if err != nil {
+		logger.Error("krakend-fluentd-request-logger: ", err.Error())
+		return EmptyFunc
+	}
 
 	return func(c *gin.Context) {
 		logWriter, err := NewLogWriter(c)
@@ -72,29 +106,48 @@ func FluentLoggerWithConfig(
 		}
 
 		path := c.Request.URL.Path
-		skip := false
 		if _, ok := conf.Skip[path]; ok {
-			skip = true
-			c.Next()
-		} else {
-			logWriter.SetRequestBody(c, conf)
-			c.Request.Header.Set("X-Correlation-ID", fmt.Sprint(uuid.New()))
 			c.Next()
+			return
 		}
 
-		if skip {
+		logWriter.SetRequestBody(c, conf)
+		c.Request.Header.Set("X-Correlation-ID", fmt.Sprint(uuid.New()))
+		recovered, stack := nextRecovering(c, !conf.Repanic)
+		if recovered != nil {
+			if conf.Repanic {
+				// the outer recovery logs the panic with its stack
+				defer panic(recovered)
+			} else {
+				logger.Error(fmt.Sprintf("krakend-fluentd-request-logger: panic recovered: %v\n%s", recovered, stack))
+			}
+		}
+
+		if logWriter.Skipped() {
 			return
 		}
 
+		logWriter.SetErrors(c, recovered, stack)
 		logWriter.SetResponseBody(c, conf)
-		data := additionalData(*logWriter, logWriter.MakeLogData(conf))
-		err = AddJwtData(data, conf.JWTClaims, c.Request.Header.Get("Authorization"))
-		if err != nil {
-			logger.Debug(err)
-			return
+		data := logWriter.MakeLogData(conf)
+		if additionalData != nil {
+			data = additionalData(*logWriter, data)
+		}
+		var claims jwt.MapClaims
+		if len(conf.JWTClaims.Claims) > 0 || conf.Consumer.needsJWT() {
+			token, err := ExtractToken(c.Request, conf.JWTTokenSources)
+			if err == nil {
+				claims, err = AddJwtData(data, conf.JWTClaims, token, conf.JWTVerifier)
+			}
+			if err != nil {
+				logger.Debug(err)
+				data["jwt.error"] = err.Error()
+			}
 		}
+		AddConsumerData(data, conf.Consumer, c.Request, claims)
+		conf.Enrichers.Enrich(c, data)
 
-		err = fluentLogger.Post(conf.FluentTag, data)
+		err = sink.Post(logWriter.Tag(), data)
 		if err != nil {
 			logger.Critical(err)
 			return
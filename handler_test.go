@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/v2/config"
+)
+
+// testConfig makes the middleware config with options and a file sink
+// writing to a file in a temporary directory, returned as the second value.
+func testConfig(t *testing.T, options map[string]interface{}) (config.ExtraConfig, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	appConfig := map[string]interface{}{
+		"fluent_config": map[string]interface{}{"fluent_tag": "krakend.access"},
+		"sinks":         []interface{}{map[string]interface{}{"type": "file", "path": path}},
+	}
+	for k, v := range options {
+		appConfig[k] = v
+	}
+
+	return config.ExtraConfig{Namespace: appConfig}, path
+}
+
+// serveLogged serves request with handlers behind middleware and returns
+// the response with records written to the file sink at path.
+func serveLogged(
+	t *testing.T, middleware gin.HandlerFunc, path string, request *http.Request, handlers ...gin.HandlerFunc,
+) (*httptest.ResponseRecorder, []map[string]interface{}) {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(middleware)
+	engine.Any("/*path", handlers...)
+
+	response := httptest.NewRecorder()
+	engine.ServeHTTP(response, request)
+
+	return response, readRecords(t, path)
+}
+
+func readRecords(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("record %s: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func TestFluentLoggerWithConfig(t *testing.T) {
+	extra, path := testConfig(t, map[string]interface{}{
+		"enrichers": map[string]interface{}{
+			"environment": map[string]interface{}{"value": "test"},
+		},
+		"mask": map[string]interface{}{
+			"request": map[string]interface{}{"query": []interface{}{"token"}},
+		},
+	})
+	additionalData := func(log LogWriter, data map[string]interface{}) map[string]interface{} {
+		data["route"] = log.logData.route
+		return data
+	}
+
+	response, records := serveLogged(t,
+		FluentLoggerWithConfig(logging.NoOp, extra, additionalData), path,
+		httptest.NewRequest(http.MethodGet, "/users/1?x=1&token=abc", nil),
+		func(c *gin.Context) { c.Data(http.StatusOK, "application/json", []byte(`{"ok":true}`)) },
+	)
+
+	if response.Code != http.StatusOK {
+		t.Errorf("status = %d", response.Code)
+	}
+	if len(records) != 1 {
+		t.Fatalf("records = %d, want 1", len(records))
+	}
+	record := records[0]
+	for field, want := range map[string]interface{}{
+		"path":                 "/users/1",
+		"request.method":       "GET",
+		"request.query":        "x=1&token=%2A%2A%2A",
+		"response.status_code": "200",
+		"response.body":        `{"ok":true}`,
+		"route":                "/*path",
+		"environment":          "test",
+		"tag":                  "krakend.access",
+	} {
+		if record[field] != want {
+			t.Errorf("%s = %v, want %v", field, record[field], want)
+		}
+	}
+}
+
+func TestFluentLoggerWithConfigNilAdditionalData(t *testing.T) {
+	extra, path := testConfig(t, nil)
+
+	_, records := serveLogged(t,
+		FluentLoggerWithConfig(logging.NoOp, extra, nil), path,
+		httptest.NewRequest(http.MethodGet, "/?access_token=secret", nil),
+		func(c *gin.Context) { c.Status(http.StatusNoContent) },
+	)
+
+	if len(records) != 1 || records[0]["response.status_code"] != "204" {
+		t.Fatalf("records = %v", records)
+	}
+	if query, ok := records[0]["request.query"]; ok {
+		t.Errorf("request.query = %v, want no query without redact or query masks", query)
+	}
+}
+
+func TestFluentLoggerWithEnrichers(t *testing.T) {
+	extra, path := testConfig(t, map[string]interface{}{
+		"enrichers": map[string]interface{}{"disabled": false},
+	})
+
+	_, records := serveLogged(t,
+		FluentLoggerWithEnrichers(logging.NoOp, extra,
+			NewEnricher("user", func(c *gin.Context, _ *http.Request, record map[string]interface{}) {
+				record["user"] = c.GetString("user")
+			}),
+			NewEnricher("disabled", func(_ *gin.Context, _ *http.Request, record map[string]interface{}) {
+				record["disabled"] = true
+			}),
+		), path,
+		httptest.NewRequest(http.MethodGet, "/", nil),
+		func(c *gin.Context) {
+			c.Set("user", "bob")
+			c.Status(http.StatusOK)
+		},
+	)
+
+	if len(records) != 1 {
+		t.Fatalf("records = %d, want 1", len(records))
+	}
+	if records[0]["user"] != "bob" {
+		t.Errorf("user = %v, want bob", records[0]["user"])
+	}
+	if _, ok := records[0]["disabled"]; ok {
+		t.Error("disabled enricher ran")
+	}
+}
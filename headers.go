@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// HeaderFilter selects headers to be logged. When Allow is not empty only
+// matching headers are kept, then headers matching Deny are removed.
+// Patterns are case-insensitive and support "*" wildcards: "X-Internal-*".
+type HeaderFilter struct {
+	Allow []string
+	Deny  []string
+}
+
+type HeadersConfig struct {
+	Request  HeaderFilter
+	Response HeaderFilter
+}
+
+func (h HeaderFilter) Filter(headers http.Header) http.Header {
+	if len(h.Allow) == 0 && len(h.Deny) == 0 {
+		return headers
+	}
+
+	result := http.Header{}
+	for name, values := range headers {
+		if len(h.Allow) > 0 && !matchHeaderPatterns(h.Allow, name) {
+			continue
+		}
+		if matchHeaderPatterns(h.Deny, name) {
+			continue
+		}
+		result[name] = values
+	}
+
+	return result
+}
+
+func matchHeaderPatterns(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if wildcardMatch(strings.ToLower(pattern), strings.ToLower(name)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wildcardMatch matches name against pattern where "*" stands for any
+// (possibly empty) sequence of characters.
+func wildcardMatch(pattern, name string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == name
+	}
+
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+
+	for _, part := range parts[1 : len(parts)-1] {
+		index := strings.Index(name, part)
+		if index < 0 {
+			return false
+		}
+		name = name[index+len(part):]
+	}
+
+	return strings.HasSuffix(name, parts[len(parts)-1])
+}
+
+// recordFields are fields set by the logger itself, which promoted headers
+// and JWT claims must not overwrite.
+var recordFields = map[string]struct{}{
+	"start": {}, "finish": {}, "path": {}, "latency": {}, "client_ip": {}, "host": {},
+	"request.method": {}, "request.query": {}, "request.headers": {}, "request.body": {},
+	"response.status_code": {}, "response.headers": {}, "response.body": {},
+	"redactions": {}, "trace_id": {}, "span_id": {}, "error": {},
+	"jwt.verified": {}, "jwt.error": {},
+}
+
+// promoteHeaders copies headers listed in FlatHeaders for direction into
+// their own record fields. Headers dropped by HeaderFilter are not
+// promoted, values go through the same cookie masking, header masking and
+// redaction as logged headers, and fields already in data are kept.
+func promoteHeaders(
+	data map[string]interface{}, direction string, headers http.Header, conf FluentLoggerConfig,
+) int {
+	if direction == "request" {
+		headers = conf.Headers.Request.Filter(headers)
+	} else {
+		headers = conf.Headers.Response.Filter(headers)
+	}
+
+	prefix := direction + "."
+	promoted := http.Header{}
+	names := map[string]string{}
+	for key, name := range conf.FlatHeaders {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		header := strings.TrimPrefix(key, prefix)
+		if values := headers.Values(header); len(values) > 0 {
+			promoted[header] = values
+			names[header] = name
+		}
+	}
+	if len(promoted) == 0 {
+		return 0
+	}
+
+	values := MaskHeaders(
+		makeHeaders(MaskCookies(promoted, conf.Mask.rules[direction+".cookies"])),
+		conf.Mask.rules[direction+".headers"],
+	)
+	redactions := conf.Redact.RedactHeaders(direction+".headers", values)
+
+	for header, value := range values {
+		if _, exists := data[names[header]]; exists {
+			continue
+		}
+		data[names[header]] = value
+	}
+
+	return redactions
+}
+
+// flatHeaderName makes default record field name for promoted header:
+// "X-Tenant-ID" of request becomes "request.x_tenant_id".
+func flatHeaderName(direction, header string) string {
+	return direction + "." + strings.ReplaceAll(strings.ToLower(header), "-", "_")
+}
+
+// parseTraceparent returns hex trace and span IDs of a W3C traceparent
+// header "version-traceid-spanid-flags".
+func parseTraceparent(header string) (string, string, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return "", "", false
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", "", false
+	}
+
+	return strings.ToLower(parts[1]), strings.ToLower(parts[2]), true
+}
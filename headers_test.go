@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestHeaderFilter(t *testing.T) {
+	headers := http.Header{
+		"Accept":          {"*/*"},
+		"Authorization":   {"Bearer x"},
+		"X-Internal-Id":   {"1"},
+		"X-Internal-Span": {"2"},
+		"X-Request-Id":    {"3"},
+	}
+
+	tests := []struct {
+		name   string
+		filter HeaderFilter
+		want   []string
+	}{
+		{
+			name:   "no lists",
+			filter: HeaderFilter{},
+			want:   []string{"Accept", "Authorization", "X-Internal-Id", "X-Internal-Span", "X-Request-Id"},
+		},
+		{
+			name:   "allow",
+			filter: HeaderFilter{Allow: []string{"accept", "x-request-id"}},
+			want:   []string{"Accept", "X-Request-Id"},
+		},
+		{
+			name:   "deny with wildcard",
+			filter: HeaderFilter{Deny: []string{"authorization", "X-INTERNAL-*"}},
+			want:   []string{"Accept", "X-Request-Id"},
+		},
+		{
+			name:   "deny wins over allow",
+			filter: HeaderFilter{Allow: []string{"x-*"}, Deny: []string{"*-span"}},
+			want:   []string{"X-Internal-Id", "X-Request-Id"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.filter.Filter(headers)
+			names := make([]string, 0, len(got))
+			for name := range got {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("Filter() = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestWildcardMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"x-*", "x-a", true},
+		{"x-*", "x-", true},
+		{"x-*", "y-a", false},
+		{"*-id", "x-request-id", true},
+		{"x-*-id", "x-request-id", true},
+		{"x-*-id", "x-request-span", false},
+		{"*", "anything", true},
+		{"exact", "exact", true},
+		{"exact", "exactly", false},
+	}
+
+	for _, tt := range tests {
+		if got := wildcardMatch(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("wildcardMatch(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSetHeadersConfig(t *testing.T) {
+	conf := FluentLoggerConfig{}
+	conf.setHeadersConfig(map[string]interface{}{
+		"headers": map[string]interface{}{
+			"request":  map[string]interface{}{"deny": []interface{}{"cookie"}},
+			"response": map[string]interface{}{"allow": []interface{}{"content-type"}},
+		},
+	})
+
+	want := HeadersConfig{
+		Request:  HeaderFilter{Deny: []string{"cookie"}},
+		Response: HeaderFilter{Allow: []string{"content-type"}},
+	}
+	if !reflect.DeepEqual(conf.Headers, want) {
+		t.Errorf("Headers = %+v, want %+v", conf.Headers, want)
+	}
+}
+
+func TestPromoteHeaders(t *testing.T) {
+	conf := FluentLoggerConfig{}
+	conf.setMaskConfig(map[string]interface{}{"mask": map[string]interface{}{
+		"request": map[string]interface{}{"headers": []interface{}{"x-api-key"}},
+	}})
+	conf.setHeadersConfig(map[string]interface{}{"headers": map[string]interface{}{
+		"request": map[string]interface{}{"deny": []interface{}{"x-internal-*"}},
+	}})
+	conf.setFlatHeadersConfig(map[string]interface{}{"flat_headers": map[string]interface{}{
+		"request": []interface{}{
+			"user-agent",
+			"X-Api-Key",
+			"X-Internal-Token",
+			map[string]interface{}{"header": "X-Tenant-ID", "name": "tenant"},
+			map[string]interface{}{"header": "X-Forwarded-Host", "name": "host"},
+			map[string]interface{}{"header": "X-Status", "name": "response.status_code"},
+		},
+		"response": []interface{}{"X-Cache"},
+	}})
+
+	if _, ok := conf.FlatHeaders["request.X-Forwarded-Host"]; ok {
+		t.Error("header renamed to a record field was not rejected")
+	}
+	if _, ok := conf.FlatHeaders["request.X-Status"]; ok {
+		t.Error("header renamed to a record field was not rejected")
+	}
+
+	data := map[string]interface{}{"host": "api.example.com", "tenant": "from-enricher"}
+	promoteHeaders(data, "request", http.Header{
+		"User-Agent":       {"curl"},
+		"X-Api-Key":        {"secret-api-key"},
+		"X-Internal-Token": {"internal"},
+		"X-Tenant-Id":      {"t1"},
+		"X-Forwarded-Host": {"evil"},
+	}, conf)
+	promoteHeaders(data, "response", http.Header{"X-Cache": {"HIT"}}, conf)
+
+	want := map[string]interface{}{
+		"host":               "api.example.com",
+		"tenant":             "from-enricher",
+		"request.user_agent": "curl",
+		"request.x_api_key":  "secr...-key",
+		"response.x_cache":   "HIT",
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("promoteHeaders() = %v, want %v", data, want)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header  string
+		traceID string
+		spanID  string
+		ok      bool
+	}{
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", true},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", "", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01", "", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "", "", false},
+		{"", "", "", false},
+	}
+
+	for _, tt := range tests {
+		traceID, spanID, ok := parseTraceparent(tt.header)
+		if traceID != tt.traceID || spanID != tt.spanID || ok != tt.ok {
+			t.Errorf("parseTraceparent(%q) = %s, %s, %v", tt.header, traceID, spanID, ok)
+		}
+	}
+}
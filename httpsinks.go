@@ -0,0 +1,571 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultElasticsearchIndex      = "krakend-{date}"
+	defaultElasticsearchDateFormat = "2006.01.02"
+	defaultSplunkSourcetype        = "_json"
+
+	maxErrorMessageLength = 512
+)
+
+var lokiLabelName = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// HTTPSinkConfig holds settings shared by HTTP bulk sinks. Headers are
+// added to every request; an Authorization header among them is replaced
+// by basic auth of Username and Password or by sink credentials, such as
+// the Splunk token or the Elasticsearch API key. Username can't be set
+// together with sink credentials.
+type HTTPSinkConfig struct {
+	Endpoint    string
+	Headers     map[string]string
+	Username    string
+	Password    string
+	Compression string
+	TLS         *tls.Config
+	Export      ExportConfig
+}
+
+// httpBulkSink posts batches of records encoded by encode to one URL and
+// turns responses into errors with parse. Connection failures and HTTP
+// 429, 502, 503 and 504 responses are retried.
+type httpBulkSink struct {
+	*batchExporter
+	cfg    HTTPSinkConfig
+	url    string
+	client *http.Client
+	encode func(entries []exportEntry) ([]byte, string, error)
+	parse  func(entries []exportEntry, status int, body []byte) error
+}
+
+func newHTTPBulkSink(
+	name string, cfg HTTPSinkConfig, path string,
+	encode func(entries []exportEntry) ([]byte, string, error),
+	parse func(entries []exportEntry, status int, body []byte) error,
+) (*httpBulkSink, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("no 'endpoint' found")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("endpoint '%s' must be http or https URL", cfg.Endpoint)
+	}
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + path
+
+	switch cfg.Compression {
+	case "", "none":
+		cfg.Compression = ""
+	case compressionGzip:
+	default:
+		return nil, fmt.Errorf("unknown compression '%s'", cfg.Compression)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg.TLS
+
+	s := &httpBulkSink{
+		cfg:    cfg,
+		url:    endpoint.String(),
+		client: &http.Client{Transport: transport},
+		encode: encode,
+		parse:  parse,
+	}
+	s.batchExporter = newBatchExporter(name, cfg.Export, s.export)
+
+	return s, nil
+}
+
+func (s *httpBulkSink) Close() error {
+	err := s.batchExporter.Close()
+	s.client.CloseIdleConnections()
+
+	return err
+}
+
+func (s *httpBulkSink) export(ctx context.Context, entries []exportEntry) error {
+	payload, contentType, err := s.encode(entries)
+	if err != nil {
+		return err
+	}
+	if s.cfg.Compression == compressionGzip {
+		if payload, err = gzipBytes(payload); err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	if s.cfg.Compression == compressionGzip {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range s.cfg.Headers {
+		request.Header.Set(k, v)
+	}
+	if s.cfg.Username != "" {
+		request.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return retryableError{err: err}
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+
+	err = s.parse(entries, response.StatusCode, body)
+	if err != nil && isRetryableHTTPStatus(response.StatusCode) {
+		return retryableError{err: err, after: retryAfter(response.Header)}
+	}
+
+	return err
+}
+
+// responseError makes an error of a failed response.
+func responseError(status int, body []byte) error {
+	return fmt.Errorf("status %d: %s", status, errorMessage(body))
+}
+
+// errorMessage takes the message from common JSON error shapes
+// ({"error": {"reason": ...}}, {"error": ...}, {"message": ...},
+// {"text": ...}) or the body itself.
+func errorMessage(body []byte) string {
+	message := strings.TrimSpace(string(body))
+
+	var parsed map[string]interface{}
+	if json.Unmarshal(body, &parsed) == nil {
+		switch e := parsed["error"].(type) {
+		case map[string]interface{}:
+			if reason, ok := e["reason"]; ok {
+				message = fmt.Sprint(reason)
+			}
+		case string:
+			message = e
+		case nil:
+			for _, key := range []string{"message", "text"} {
+				if value, ok := parsed[key].(string); ok {
+					message = value
+					break
+				}
+			}
+		}
+	}
+	if len(message) > maxErrorMessageLength {
+		message = message[:maxErrorMessageLength] + "..."
+	}
+
+	return message
+}
+
+func isSuccessStatus(status int) bool {
+	return status >= 200 && status < 300
+}
+
+// ElasticsearchConfig configures the Elasticsearch/OpenSearch bulk sink.
+// Index is a template where "{tag}" is replaced with the tag and "{date}"
+// with the record date formatted with DateFormat.
+type ElasticsearchConfig struct {
+	HTTPSinkConfig
+	Index      string
+	DateFormat string
+	OpType     string
+}
+
+// NewElasticsearchSink makes a sink indexing records with the _bulk API.
+// Records get "@timestamp" and "tag" fields. Items rejected by 429 are
+// retried without the rest of the batch; other item errors are reported.
+func NewElasticsearchSink(cfg ElasticsearchConfig) (Sink, error) {
+	if cfg.Index == "" {
+		cfg.Index = defaultElasticsearchIndex
+	}
+	if cfg.DateFormat == "" {
+		cfg.DateFormat = defaultElasticsearchDateFormat
+	}
+	switch cfg.OpType {
+	case "":
+		cfg.OpType = "index"
+	case "index", "create":
+	default:
+		return nil, fmt.Errorf("unknown op_type '%s'", cfg.OpType)
+	}
+
+	encode := func(entries []exportEntry) ([]byte, string, error) {
+		var buffer bytes.Buffer
+		for _, entry := range entries {
+			index := strings.ToLower(
+				strings.NewReplacer("{tag}", entry.tag, "{date}", entry.time.UTC().Format(cfg.DateFormat)).
+					Replace(cfg.Index),
+			)
+			action, err := encodeJSONLine(map[string]interface{}{
+				cfg.OpType: map[string]interface{}{"_index": index},
+			})
+			if err != nil {
+				return nil, "", err
+			}
+			document := taggedRecord(entry.record, "tag", entry.tag)
+			document["@timestamp"] = entry.time.UTC().Format(time.RFC3339Nano)
+			line, err := encodeJSONLine(document)
+			if err != nil {
+				return nil, "", err
+			}
+			buffer.Write(action)
+			buffer.Write(line)
+		}
+		return buffer.Bytes(), "application/x-ndjson", nil
+	}
+
+	return newHTTPBulkSink("Elasticsearch", cfg.HTTPSinkConfig, "/_bulk", encode, parseBulkResponse)
+}
+
+// parseBulkResponse checks per item results of a _bulk response to
+// entries, whose items come in the order of entries.
+func parseBulkResponse(entries []exportEntry, status int, body []byte) error {
+	if !isSuccessStatus(status) {
+		return responseError(status, body)
+	}
+
+	var response struct {
+		Errors bool                                `json:"errors"`
+		Items  []map[string]map[string]interface{} `json:"items"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || !response.Errors {
+		return nil
+	}
+
+	var rejected []exportEntry
+	failed := 0
+	reason := ""
+	for i, item := range response.Items {
+		for _, result := range item {
+			if result["error"] == nil {
+				continue
+			}
+			if fmt.Sprint(result["status"]) == strconv.Itoa(http.StatusTooManyRequests) && i < len(entries) {
+				rejected = append(rejected, entries[i])
+			} else {
+				failed++
+			}
+			if reason == "" {
+				errorBody, _ := json.Marshal(map[string]interface{}{"error": result["error"]})
+				reason = errorMessage(errorBody)
+			}
+		}
+	}
+	if failed+len(rejected) == 0 {
+		return nil
+	}
+
+	err := fmt.Errorf("%d of %d bulk items failed, first: %s", failed+len(rejected), len(response.Items), reason)
+	if len(rejected) > 0 {
+		return retryableError{err: err, retry: rejected, failed: failed}
+	}
+
+	return err
+}
+
+// LokiConfig configures the Loki push sink. Streams are labeled with
+// Labels, the tag as "tag" and values of LabelFields record fields.
+type LokiConfig struct {
+	HTTPSinkConfig
+	Labels      map[string]string
+	LabelFields []string
+	TenantID    string
+}
+
+// NewLokiSink makes a sink pushing records as JSON log lines.
+func NewLokiSink(cfg LokiConfig) (Sink, error) {
+	if cfg.TenantID != "" {
+		cfg.Headers = withHeader(cfg.Headers, "X-Scope-OrgID", cfg.TenantID)
+	}
+
+	encode := func(entries []exportEntry) ([]byte, string, error) {
+		type stream struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		}
+		streams := map[string]*stream{}
+		var order []string
+
+		for _, entry := range entries {
+			labels := map[string]string{"tag": entry.tag}
+			for k, v := range cfg.Labels {
+				labels[k] = v
+			}
+			for _, field := range cfg.LabelFields {
+				if value, ok := entry.record[field]; ok && value != nil {
+					labels[lokiLabelName.ReplaceAllString(field, "_")] = recordValueString(value)
+				}
+			}
+			key := lokiStreamKey(labels)
+			s, ok := streams[key]
+			if !ok {
+				s = &stream{Stream: labels}
+				streams[key] = s
+				order = append(order, key)
+			}
+
+			line, err := toString(entry.record)
+			if err != nil {
+				return nil, "", err
+			}
+			s.Values = append(s.Values, [2]string{strconv.FormatInt(entry.time.UnixNano(), 10), line})
+		}
+
+		push := struct {
+			Streams []*stream `json:"streams"`
+		}{}
+		for _, key := range order {
+			push.Streams = append(push.Streams, streams[key])
+		}
+		payload, err := json.Marshal(push)
+		return payload, "application/json", err
+	}
+
+	parse := func(_ []exportEntry, status int, body []byte) error {
+		if isSuccessStatus(status) {
+			return nil
+		}
+		return responseError(status, body)
+	}
+
+	return newHTTPBulkSink("Loki", cfg.HTTPSinkConfig, "/loki/api/v1/push", encode, parse)
+}
+
+func lokiStreamKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var builder strings.Builder
+	for _, k := range keys {
+		builder.WriteString(k + "=" + strconv.Quote(labels[k]) + ",")
+	}
+
+	return builder.String()
+}
+
+// SplunkConfig configures the Splunk HTTP Event Collector sink.
+type SplunkConfig struct {
+	HTTPSinkConfig
+	Token      string
+	Index      string
+	Source     string
+	Sourcetype string
+	Host       string
+}
+
+// NewSplunkSink makes a sink sending records as HEC events. The source
+// defaults to the tag.
+func NewSplunkSink(cfg SplunkConfig) (Sink, error) {
+	if cfg.Token == "" {
+		return nil, errors.New("no HEC token found")
+	}
+	if cfg.Username != "" {
+		return nil, errors.New("username can't be used with the HEC token")
+	}
+	cfg.Headers = withHeader(cfg.Headers, "Authorization", "Splunk "+cfg.Token)
+	if cfg.Sourcetype == "" {
+		cfg.Sourcetype = defaultSplunkSourcetype
+	}
+	if cfg.Host == "" {
+		cfg.Host, _ = os.Hostname()
+	}
+
+	encode := func(entries []exportEntry) ([]byte, string, error) {
+		var buffer bytes.Buffer
+		for _, entry := range entries {
+			event := map[string]interface{}{
+				"time":       float64(entry.time.UnixNano()/int64(time.Millisecond)) / 1000,
+				"host":       cfg.Host,
+				"source":     entry.tag,
+				"sourcetype": cfg.Sourcetype,
+				"event":      entry.record,
+			}
+			if cfg.Source != "" {
+				event["source"] = cfg.Source
+			}
+			if cfg.Index != "" {
+				event["index"] = cfg.Index
+			}
+			line, err := encodeJSONLine(event)
+			if err != nil {
+				return nil, "", err
+			}
+			buffer.Write(line)
+		}
+		return buffer.Bytes(), "application/json", nil
+	}
+
+	return newHTTPBulkSink("Splunk HEC", cfg.HTTPSinkConfig, "/services/collector/event", encode, parseHECResponse)
+}
+
+// splunkBusyCode is the HEC "server is busy" response code.
+const splunkBusyCode = 9
+
+// parseHECResponse checks {"text": ..., "code": ...} HEC responses.
+func parseHECResponse(_ []exportEntry, status int, body []byte) error {
+	var response struct {
+		Text string `json:"text"`
+		Code *int   `json:"code"`
+	}
+	parsed := json.Unmarshal(body, &response) == nil && response.Code != nil
+
+	if isSuccessStatus(status) && (!parsed || *response.Code == 0) {
+		return nil
+	}
+	if !parsed {
+		return responseError(status, body)
+	}
+
+	err := fmt.Errorf("status %d: HEC code %d: %s", status, *response.Code, response.Text)
+	if *response.Code == splunkBusyCode {
+		return retryableError{err: err}
+	}
+
+	return err
+}
+
+// withHeader copies headers with key set to value, dropping the keys
+// differing from key only in case.
+func withHeader(headers map[string]string, key, value string) map[string]string {
+	result := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		if !strings.EqualFold(k, key) {
+			result[k] = v
+		}
+	}
+	result[key] = value
+
+	return result
+}
+
+func parseHTTPSinkConfig(cfg map[string]interface{}) (HTTPSinkConfig, error) {
+	httpConfig := HTTPSinkConfig{}
+	for option, target := range map[string]*string{
+		"endpoint":    &httpConfig.Endpoint,
+		"username":    &httpConfig.Username,
+		"compression": &httpConfig.Compression,
+	} {
+		if _, ok := cfg[option]; ok {
+			*target = ConvertToString(option, cfg)
+		}
+	}
+	if _, ok := cfg["password_env"]; ok {
+		httpConfig.Password = os.Getenv(ConvertToString("password_env", cfg))
+	} else if _, ok := cfg["password"]; ok {
+		httpConfig.Password = ConvertToString("password", cfg)
+	}
+	httpConfig.Headers = stringMap(cfg, "headers")
+	if tlsConfigMap, ok := cfg["tls"].(map[string]interface{}); ok {
+		tlsConfig, err := parseTLSConfig(tlsConfigMap)
+		if err != nil {
+			return httpConfig, err
+		}
+		httpConfig.TLS = tlsConfig
+	}
+	httpConfig.Export = parseExportConfig(cfg)
+
+	return httpConfig, nil
+}
+
+func newElasticsearchSinkFromConfig(_ FluentLoggerConfig, cfg map[string]interface{}) (Sink, error) {
+	httpConfig, err := parseHTTPSinkConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	esConfig := ElasticsearchConfig{HTTPSinkConfig: httpConfig}
+	for option, target := range map[string]*string{
+		"index":       &esConfig.Index,
+		"date_format": &esConfig.DateFormat,
+		"op_type":     &esConfig.OpType,
+	} {
+		if _, ok := cfg[option]; ok {
+			*target = ConvertToString(option, cfg)
+		}
+	}
+	if _, ok := cfg["api_key_env"]; ok {
+		if esConfig.Username != "" {
+			return nil, errors.New("username can't be used with api_key_env")
+		}
+		esConfig.Headers = withHeader(
+			esConfig.Headers, "Authorization", "ApiKey "+os.Getenv(ConvertToString("api_key_env", cfg)),
+		)
+	}
+
+	return NewElasticsearchSink(esConfig)
+}
+
+func newLokiSinkFromConfig(_ FluentLoggerConfig, cfg map[string]interface{}) (Sink, error) {
+	httpConfig, err := parseHTTPSinkConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	lokiConfig := LokiConfig{HTTPSinkConfig: httpConfig, Labels: stringMap(cfg, "labels")}
+	if labelFields, ok := cfg["label_fields"].([]interface{}); ok {
+		lokiConfig.LabelFields = interfaceSliceToStrings(labelFields)
+	}
+	if _, ok := cfg["tenant_id"]; ok {
+		lokiConfig.TenantID = ConvertToString("tenant_id", cfg)
+	}
+
+	return NewLokiSink(lokiConfig)
+}
+
+func newSplunkSinkFromConfig(_ FluentLoggerConfig, cfg map[string]interface{}) (Sink, error) {
+	httpConfig, err := parseHTTPSinkConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	secretConfig := map[string]interface{}{}
+	if tokenEnv, ok := cfg["token_env"]; ok {
+		secretConfig["secret_env"] = tokenEnv
+	}
+	if token, ok := cfg["token"]; ok {
+		secretConfig["secret"] = token
+	}
+	token, err := readSecret(secretConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	splunkConfig := SplunkConfig{HTTPSinkConfig: httpConfig, Token: string(token)}
+	for option, target := range map[string]*string{
+		"index":      &splunkConfig.Index,
+		"source":     &splunkConfig.Source,
+		"sourcetype": &splunkConfig.Sourcetype,
+		"host":       &splunkConfig.Host,
+	} {
+		if _, ok := cfg[option]; ok {
+			*target = ConvertToString(option, cfg)
+		}
+	}
+
+	return NewSplunkSink(splunkConfig)
+}
@@ -0,0 +1,413 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func httpBody(status int, body string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}
+}
+
+// testExportConfig exports batches of size records, retrying them almost
+// at once.
+func testExportConfig(size int) ExportConfig {
+	return ExportConfig{
+		MaxBatchSize: size, MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond,
+	}
+}
+
+// exportRecords posts records through sink and closes it.
+func exportRecords(t *testing.T, sink Sink, records ...map[string]interface{}) {
+	t.Helper()
+
+	for _, record := range records {
+		if err := sink.Post("access", record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	sink.Close()
+}
+
+// ndjson decodes newline delimited JSON.
+func ndjson(t *testing.T, payload []byte) []map[string]interface{} {
+	t.Helper()
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(payload))
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("line %s: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+func TestParseBulkResponse(t *testing.T) {
+	entries := []exportEntry{
+		{tag: "access", record: map[string]interface{}{"n": 1}},
+		{tag: "access", record: map[string]interface{}{"n": 2}},
+		{tag: "access", record: map[string]interface{}{"n": 3}},
+	}
+	rejected := `{"status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue is full"}}`
+	invalid := `{"status":400,"error":{"type":"mapper_parsing_exception","reason":"bad field"}}`
+
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		wantErr    string
+		wantRetry  []exportEntry
+		wantFailed int
+	}{
+		{
+			name:   "no errors",
+			status: http.StatusOK,
+			body:   `{"errors":false,"items":[{"index":{"status":201}},{"index":{"status":201}},{"index":{"status":201}}]}`,
+		},
+		{
+			name:    "request failed",
+			status:  http.StatusBadRequest,
+			body:    `{"error":{"reason":"malformed action"}}`,
+			wantErr: "status 400: malformed action",
+		},
+		{
+			name:    "item errors",
+			status:  http.StatusOK,
+			body:    `{"errors":true,"items":[{"index":{"status":201}},{"index":` + invalid + `},{"index":{"status":201}}]}`,
+			wantErr: "1 of 3 bulk items failed, first: bad field",
+		},
+		{
+			name:       "rejected items",
+			status:     http.StatusOK,
+			body:       `{"errors":true,"items":[{"index":` + rejected + `},{"index":` + invalid + `},{"create":` + rejected + `}]}`,
+			wantErr:    "3 of 3 bulk items failed, first: queue is full",
+			wantRetry:  []exportEntry{entries[0], entries[2]},
+			wantFailed: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := parseBulkResponse(entries, tt.status, []byte(tt.body))
+			if err == nil || tt.wantErr == "" {
+				if (err != nil) != (tt.wantErr != "") {
+					t.Fatalf("parseBulkResponse() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err.Error() != tt.wantErr {
+				t.Errorf("parseBulkResponse() error = %v, want %q", err, tt.wantErr)
+			}
+			retryable, _ := err.(retryableError)
+			if !reflect.DeepEqual(retryable.retry, tt.wantRetry) || retryable.failed != tt.wantFailed {
+				t.Errorf("retry = %v, failed = %d, want %v, %d",
+					retryable.retry, retryable.failed, tt.wantRetry, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestElasticsearchSinkRetriesRejectedItems(t *testing.T) {
+	collector := &otlpCollector{responses: []func(http.ResponseWriter){
+		httpBody(http.StatusOK, `{"errors":true,"items":[`+
+			`{"index":{"status":201}},`+
+			`{"index":{"status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue is full"}}},`+
+			`{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"bad field"}}}]}`),
+		httpBody(http.StatusOK, `{"errors":false,"items":[{"index":{"status":201}}]}`),
+	}}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	sink, err := NewElasticsearchSink(ElasticsearchConfig{
+		HTTPSinkConfig: HTTPSinkConfig{Endpoint: server.URL, Export: testExportConfig(3)},
+		Index:          "Logs-{tag}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarded := DeliveryStats()
+	exportRecords(t, sink,
+		map[string]interface{}{"n": 1}, map[string]interface{}{"n": 2}, map[string]interface{}{"n": 3})
+
+	if collector.count() != 2 {
+		t.Fatalf("requests = %d, want 2", collector.count())
+	}
+	if path := collector.requests[0].URL.Path; path != "/_bulk" {
+		t.Errorf("path = %s, want /_bulk", path)
+	}
+	if lines := ndjson(t, collector.payloads[0]); len(lines) != 6 {
+		t.Errorf("first request lines = %d, want 6", len(lines))
+	}
+	lines := ndjson(t, collector.payloads[1])
+	if len(lines) != 2 {
+		t.Fatalf("retried lines = %v, want the rejected item", lines)
+	}
+	if action := lines[0]["index"]; !reflect.DeepEqual(action, map[string]interface{}{"_index": "logs-access"}) {
+		t.Errorf("action = %v", action)
+	}
+	if lines[1]["n"] != float64(2) || lines[1]["tag"] != "access" || lines[1]["@timestamp"] == nil {
+		t.Errorf("retried document = %v", lines[1])
+	}
+	stats := sink.(interface{ Stats() DeliveryCounters }).Stats()
+	if stats.SentRecords != 2 || stats.LostRecords != 1 || stats.Retries != 1 {
+		t.Errorf("stats = %+v, want 2 sent, 1 lost records and 1 retry", stats)
+	}
+	if DeliveryStats() != forwarded {
+		t.Errorf("forward delivery stats changed to %+v", DeliveryStats())
+	}
+}
+
+func TestHTTPSinkAuthorization(t *testing.T) {
+	os.Setenv("KRAKEND_FLUENTD_TEST_API_KEY", "key")
+	defer os.Unsetenv("KRAKEND_FLUENTD_TEST_API_KEY")
+
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		want   string
+	}{
+		{
+			name:   "headers",
+			config: map[string]interface{}{},
+			want:   "Bearer custom",
+		},
+		{
+			name:   "basic auth",
+			config: map[string]interface{}{"username": "krakend", "password": "secret"},
+			want:   "Basic a3Jha2VuZDpzZWNyZXQ=",
+		},
+		{
+			name:   "API key",
+			config: map[string]interface{}{"api_key_env": "KRAKEND_FLUENTD_TEST_API_KEY"},
+			want:   "ApiKey key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := &otlpCollector{responses: []func(http.ResponseWriter){
+				httpBody(http.StatusOK, `{"errors":false,"items":[]}`),
+			}}
+			server := httptest.NewServer(collector)
+			defer server.Close()
+
+			tt.config["endpoint"] = server.URL
+			tt.config["headers"] = map[string]interface{}{"authorization": "Bearer custom", "X-Custom": "1"}
+			tt.config["batch"] = map[string]interface{}{"max_batch_size": 1}
+			sink, err := newElasticsearchSinkFromConfig(FluentLoggerConfig{}, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exportRecords(t, sink, map[string]interface{}{"n": 1})
+
+			if collector.count() != 1 {
+				t.Fatalf("requests = %d, want 1", collector.count())
+			}
+			header := collector.requests[0].Header
+			if header.Get("Authorization") != tt.want || header.Get("X-Custom") != "1" {
+				t.Errorf("Authorization = %q, X-Custom = %q, want %q, 1",
+					header.Get("Authorization"), header.Get("X-Custom"), tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPSinkCredentialConflicts(t *testing.T) {
+	tests := []struct {
+		name    string
+		newSink func(FluentLoggerConfig, map[string]interface{}) (Sink, error)
+		config  map[string]interface{}
+		wantErr string
+	}{
+		{
+			name:    "basic auth with API key",
+			newSink: newElasticsearchSinkFromConfig,
+			config:  map[string]interface{}{"username": "krakend", "api_key_env": "KRAKEND_FLUENTD_TEST_API_KEY"},
+			wantErr: "username can't be used with api_key_env",
+		},
+		{
+			name:    "basic auth with HEC token",
+			newSink: newSplunkSinkFromConfig,
+			config:  map[string]interface{}{"username": "krakend", "token": "secret"},
+			wantErr: "username can't be used with the HEC token",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config["endpoint"] = "http://localhost:9200"
+			sink, err := tt.newSink(FluentLoggerConfig{}, tt.config)
+			if err == nil {
+				sink.Close()
+				t.Fatalf("sink made, want error %q", tt.wantErr)
+			}
+			if err.Error() != tt.wantErr {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLokiSink(t *testing.T) {
+	collector := &otlpCollector{responses: []func(http.ResponseWriter){httpStatus(http.StatusNoContent)}}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	sink, err := NewLokiSink(LokiConfig{
+		HTTPSinkConfig: HTTPSinkConfig{
+			Endpoint: server.URL + "/", Compression: compressionGzip, Export: testExportConfig(3),
+		},
+		Labels:      map[string]string{"job": "krakend"},
+		LabelFields: []string{"request.method"},
+		TenantID:    "team-a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exportRecords(t, sink,
+		map[string]interface{}{"request.method": "GET", "n": 1},
+		map[string]interface{}{"request.method": "POST", "n": 2},
+		map[string]interface{}{"request.method": "GET", "n": 3},
+	)
+
+	if collector.count() != 1 {
+		t.Fatalf("requests = %d, want 1", collector.count())
+	}
+	request := collector.requests[0]
+	if request.URL.Path != "/loki/api/v1/push" {
+		t.Errorf("path = %s", request.URL.Path)
+	}
+	if request.Header.Get("Content-Encoding") != "gzip" || request.Header.Get("X-Scope-OrgID") != "team-a" {
+		t.Errorf("headers = %v", request.Header)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(collector.payloads[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var push struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.NewDecoder(reader).Decode(&push); err != nil {
+		t.Fatal(err)
+	}
+
+	wantStreams := []map[string]string{
+		{"job": "krakend", "tag": "access", "request_method": "GET"},
+		{"job": "krakend", "tag": "access", "request_method": "POST"},
+	}
+	wantLines := [][]string{
+		{`{"n":1,"request.method":"GET"}`, `{"n":3,"request.method":"GET"}`},
+		{`{"n":2,"request.method":"POST"}`},
+	}
+	if len(push.Streams) != len(wantStreams) {
+		t.Fatalf("streams = %+v, want %d", push.Streams, len(wantStreams))
+	}
+	for i, stream := range push.Streams {
+		if !reflect.DeepEqual(stream.Stream, wantStreams[i]) {
+			t.Errorf("stream %d labels = %v, want %v", i, stream.Stream, wantStreams[i])
+		}
+		var lines []string
+		for _, value := range stream.Values {
+			lines = append(lines, value[1])
+		}
+		if !reflect.DeepEqual(lines, wantLines[i]) {
+			t.Errorf("stream %d lines = %v, want %v", i, lines, wantLines[i])
+		}
+	}
+}
+
+func TestSplunkSink(t *testing.T) {
+	tests := []struct {
+		name         string
+		responses    []func(http.ResponseWriter)
+		wantRequests int
+	}{
+		{
+			name:         "exported",
+			responses:    []func(http.ResponseWriter){httpBody(http.StatusOK, `{"text":"Success","code":0}`)},
+			wantRequests: 1,
+		},
+		{
+			name: "retried while busy",
+			responses: []func(http.ResponseWriter){
+				httpBody(http.StatusServiceUnavailable, `{"text":"Server is busy","code":9}`),
+				httpBody(http.StatusOK, `{"text":"Success","code":0}`),
+			},
+			wantRequests: 2,
+		},
+		{
+			name:         "invalid data not retried",
+			responses:    []func(http.ResponseWriter){httpBody(http.StatusBadRequest, `{"text":"Invalid data format","code":6}`)},
+			wantRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := &otlpCollector{responses: tt.responses}
+			server := httptest.NewServer(collector)
+			defer server.Close()
+
+			sink, err := NewSplunkSink(SplunkConfig{
+				HTTPSinkConfig: HTTPSinkConfig{
+					Endpoint: server.URL,
+					Headers:  map[string]string{"AUTHORIZATION": "Bearer custom"},
+					Export:   testExportConfig(1),
+				},
+				Token: "hec-token",
+				Index: "krakend",
+				Host:  "gateway-1",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			exportRecords(t, sink, map[string]interface{}{"path": "/"})
+
+			if collector.count() != tt.wantRequests {
+				t.Fatalf("requests = %d, want %d", collector.count(), tt.wantRequests)
+			}
+			request := collector.requests[0]
+			if request.URL.Path != "/services/collector/event" {
+				t.Errorf("path = %s", request.URL.Path)
+			}
+			if request.Header.Get("Authorization") != "Splunk hec-token" {
+				t.Errorf("Authorization = %q", request.Header.Get("Authorization"))
+			}
+			events := ndjson(t, collector.payloads[0])
+			if len(events) != 1 {
+				t.Fatalf("events = %v", events)
+			}
+			for field, want := range map[string]interface{}{
+				"host": "gateway-1", "source": "access", "sourcetype": "_json", "index": "krakend",
+			} {
+				if events[0][field] != want {
+					t.Errorf("%s = %v, want %v", field, events[0][field], want)
+				}
+			}
+			if !reflect.DeepEqual(events[0]["event"], map[string]interface{}{"path": "/"}) {
+				t.Errorf("event = %v", events[0]["event"])
+			}
+		})
+	}
+}
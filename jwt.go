@@ -0,0 +1,404 @@
+package handler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	unverifiedClaimsDrop = "drop"
+	unverifiedClaimsMark = "mark"
+)
+
+// JWTClaim is a claim to be logged. Claim is a top-level claim name or,
+// if there is no such claim, a selector into nested claims.
+type JWTClaim struct {
+	Claim    string
+	Name     string
+	Strategy MaskStrategy
+	selector *Selector
+}
+
+// JWTClaimsConfig describes claims to be logged and where to put them:
+// under Prefix ("jwt.sub") or inside Field sub-map ({"jwt": {"sub": ...}}).
+type JWTClaimsConfig struct {
+	Claims []JWTClaim
+	Prefix string
+	Field  string
+}
+
+// AddClaims copies configured claims to data. Prefix is joined to claim
+// names with ".". Claims colliding with record fields are logged with
+// "jwt." prefix instead, or dropped if that name is taken too.
+func (c JWTClaimsConfig) AddClaims(data map[string]interface{}, claims jwt.MapClaims) {
+	target := data
+	if c.Field != "" {
+		subMap, ok := data[c.Field].(map[string]interface{})
+		if !ok {
+			subMap = map[string]interface{}{}
+		}
+		target = subMap
+	}
+
+	for _, claim := range c.Claims {
+		value, ok := claim.value(claims)
+		if !ok {
+			continue
+		}
+
+		if claim.Strategy != nil {
+			masked, keep := maskAll(value, claim.Strategy)
+			if !keep {
+				continue
+			}
+			value = masked
+		}
+
+		name := claim.Name
+		if prefix := strings.TrimSuffix(c.Prefix, "."); prefix != "" {
+			name = prefix + "." + name
+		}
+		if c.Field == "" && isRecordField(data, name) {
+			name = "jwt." + claim.Name
+			if isRecordField(data, name) {
+				continue
+			}
+		}
+		target[name] = value
+	}
+
+	if c.Field != "" && len(target) > 0 {
+		data[c.Field] = target
+	}
+}
+
+// isRecordField reports whether name is taken by a field of data or by a
+// field the logger sets itself.
+func isRecordField(data map[string]interface{}, name string) bool {
+	if _, exists := data[name]; exists {
+		return true
+	}
+	_, reserved := recordFields[name]
+
+	return reserved
+}
+
+func (c JWTClaim) value(claims jwt.MapClaims) (interface{}, bool) {
+	if value, ok := claims[c.Claim]; ok {
+		return value, true
+	}
+	if c.selector == nil {
+		return nil, false
+	}
+
+	values := selectValues(map[string]interface{}(claims), nil, *c.selector)
+	switch len(values) {
+	case 0:
+		return nil, false
+	case 1:
+		return values[0], true
+	}
+
+	return values, true
+}
+
+func selectValues(value interface{}, path []PathElement, selector Selector) []interface{} {
+	full, partial := selector.Match(path)
+	if full {
+		return []interface{}{value}
+	}
+	if !partial {
+		return nil
+	}
+
+	var result []interface{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			result = append(result, selectValues(item, appendPath(path, PathElement{Key: key}), selector)...)
+		}
+	case []interface{}:
+		for i, item := range v {
+			result = append(result, selectValues(item, appendPath(path, PathElement{Index: i, IsIndex: true}), selector)...)
+		}
+	}
+
+	return result
+}
+
+// TokenSource is a place a token is read from: a header (optionally with
+// an auth scheme prefix), a cookie or a query parameter.
+type TokenSource struct {
+	Header string
+	Scheme string
+	Cookie string
+	Query  string
+}
+
+var defaultTokenSources = []TokenSource{{Header: "Authorization", Scheme: "Bearer"}}
+
+// Token returns the token of the request found in the source or an empty
+// string when there is none.
+func (s TokenSource) Token(r *http.Request) (string, error) {
+	switch {
+	case s.Header != "":
+		value := strings.TrimSpace(r.Header.Get(s.Header))
+		if value == "" || s.Scheme == "" {
+			return value, nil
+		}
+		parts := strings.Fields(value)
+		if len(parts) < minTokenParts {
+			return "", fmt.Errorf("wrong '%s' header format", s.Header)
+		}
+		if !strings.EqualFold(parts[0], s.Scheme) {
+			return "", nil
+		}
+		return parts[1], nil
+	case s.Cookie != "":
+		cookie, err := r.Cookie(s.Cookie)
+		if err != nil {
+			return "", nil
+		}
+		return cookie.Value, nil
+	case s.Query != "":
+		return r.URL.Query().Get(s.Query), nil
+	}
+
+	return "", nil
+}
+
+// ExtractToken tries sources in order and returns the first token found.
+// Errors of malformed sources are returned only if no token is found.
+func ExtractToken(r *http.Request, sources []TokenSource) (string, error) {
+	var firstErr error
+	for _, source := range sources {
+		token, err := source.Token(r)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if token != "" {
+			return token, nil
+		}
+	}
+
+	return "", firstErr
+}
+
+// JWTVerifier checks token signatures against local keys (JWKS file, PEM
+// public key or HMAC secret) and validates "exp", "nbf", "iss" and "aud".
+type JWTVerifier struct {
+	keys       map[string]interface{}
+	pemKey     interface{}
+	hmacSecret []byte
+	Issuer     string
+	Audience   []string
+	Unverified string
+}
+
+// Verify parses tokenString and returns its claims if the signature and
+// standard claims are valid.
+func (v *JWTVerifier) Verify(tokenString string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	parser := &jwt.Parser{ValidMethods: v.validMethods()}
+
+	_, err := parser.ParseWithClaims(tokenString, claims, v.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	if v.Issuer != "" && !claims.VerifyIssuer(v.Issuer, true) {
+		return nil, errors.New("token issuer is not accepted")
+	}
+	if len(v.Audience) > 0 && !verifyAudience(claims["aud"], v.Audience) {
+		return nil, errors.New("token audience is not accepted")
+	}
+
+	return claims, nil
+}
+
+func (v *JWTVerifier) validMethods() []string {
+	var methods []string
+	if v.hmacSecret != nil {
+		methods = append(methods, "HS256", "HS384", "HS512")
+	}
+	if len(v.keys) > 0 || v.pemKey != nil {
+		methods = append(methods, "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512")
+	}
+
+	return methods
+}
+
+func (v *JWTVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if v.hmacSecret == nil {
+			return nil, errors.New("no HMAC secret configured")
+		}
+		return v.hmacSecret, nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+		if kid, ok := token.Header["kid"].(string); ok {
+			if key, ok := v.keys[kid]; ok {
+				return key, nil
+			}
+		}
+		if v.pemKey != nil {
+			return v.pemKey, nil
+		}
+		if len(v.keys) == 1 {
+			for _, key := range v.keys {
+				return key, nil
+			}
+		}
+		return nil, errors.New("no key found for token")
+	}
+
+	return nil, fmt.Errorf("unexpected signing method '%v'", token.Header["alg"])
+}
+
+func verifyAudience(aud interface{}, accepted []string) bool {
+	var audiences []string
+	switch a := aud.(type) {
+	case string:
+		audiences = []string{a}
+	case []interface{}:
+		for _, item := range a {
+			if s, ok := item.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+	}
+
+	for _, audience := range audiences {
+		for _, expected := range accepted {
+			if audience == expected {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// LoadJWKS reads public signature keys of a JWK set file indexed by "kid".
+func LoadJWKS(path string) (map[string]interface{}, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	for i, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		publicKey, err := key.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %v", i, err)
+		}
+
+		kid := key.Kid
+		if kid == "" {
+			kid = fmt.Sprint(i)
+		}
+		keys[kid] = publicKey
+	}
+
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
+
+// LoadPEMPublicKey reads an RSA or EC public key from a PEM file.
+func LoadPEMPublicKey(path string) (interface{}, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(content); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(content); err == nil {
+		return key, nil
+	}
+
+	return nil, errors.New("no RSA or EC public key found")
+}
@@ -0,0 +1,396 @@
+package handler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func writeTestFile(t *testing.T, name string, content []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestJWTVerifierHMAC(t *testing.T) {
+	secret := []byte("secret")
+	verifier := &JWTVerifier{hmacSecret: secret, Issuer: "https://issuer", Audience: []string{"api"}}
+	valid := jwt.MapClaims{"sub": "u1", "iss": "https://issuer", "aud": []interface{}{"other", "api"}}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"valid", signToken(t, jwt.SigningMethodHS256, secret, "", valid), false},
+		{"wrong secret", signToken(t, jwt.SigningMethodHS256, []byte("other"), "", valid), true},
+		{"expired", signToken(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{
+			"sub": "u1", "iss": "https://issuer", "aud": "api", "exp": time.Now().Add(-time.Hour).Unix(),
+		}), true},
+		{"not yet valid", signToken(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{
+			"sub": "u1", "iss": "https://issuer", "aud": "api", "nbf": time.Now().Add(time.Hour).Unix(),
+		}), true},
+		{"wrong issuer", signToken(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{
+			"sub": "u1", "iss": "https://evil", "aud": "api",
+		}), true},
+		{"wrong audience", signToken(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{
+			"sub": "u1", "iss": "https://issuer", "aud": "web",
+		}), true},
+		{"none algorithm", signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", valid), true},
+		{"not a token", "abc", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifier.Verify(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && claims["sub"] != "u1" {
+				t.Errorf("Verify() claims = %v", claims)
+			}
+		})
+	}
+}
+
+func TestJWTVerifierPEM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestFile(t, "key.pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	conf := FluentLoggerConfig{}
+	conf.setJWTVerificationConfig(map[string]interface{}{
+		"jwt_verification": map[string]interface{}{"pem_file": path},
+	})
+	if conf.JWTVerifier == nil || conf.JWTVerifier.pemKey == nil {
+		t.Fatal("PEM key not loaded")
+	}
+
+	claims := jwt.MapClaims{"sub": "u1"}
+	if _, err := conf.JWTVerifier.Verify(signToken(t, jwt.SigningMethodRS256, rsaKey, "", claims)); err != nil {
+		t.Errorf("RS256 token not verified: %v", err)
+	}
+
+	// an HMAC token signed with the public key must not pass as RS256
+	if _, err := conf.JWTVerifier.Verify(signToken(t, jwt.SigningMethodHS256, der, "", claims)); err == nil {
+		t.Error("HS256 token signed with the public key was verified")
+	}
+}
+
+func TestJWTVerifierJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+
+	set, _ := json.Marshal(map[string]interface{}{"keys": []interface{}{
+		map[string]interface{}{
+			"kid": "rsa", "kty": "RSA", "use": "sig",
+			"n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E))),
+		},
+		map[string]interface{}{
+			"kid": "ec", "kty": "EC", "crv": "P-256", "x": encode(ecKey.X), "y": encode(ecKey.Y),
+		},
+		map[string]interface{}{"kid": "enc", "kty": "RSA", "use": "enc"},
+	}})
+	keys, err := LoadJWKS(writeTestFile(t, "jwks.json", set))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("keys = %d, want 2", len(keys))
+	}
+
+	verifier := &JWTVerifier{keys: keys}
+	claims := jwt.MapClaims{"sub": "u1"}
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"rsa", signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", claims), false},
+		{"ec", signToken(t, jwt.SigningMethodES256, ecKey, "ec", claims), false},
+		{"wrong kid", signToken(t, jwt.SigningMethodRS256, rsaKey, "ec", claims), true},
+		{"unknown kid", signToken(t, jwt.SigningMethodRS256, rsaKey, "other", claims), true},
+		{"hmac without secret", signToken(t, jwt.SigningMethodHS256, []byte("s"), "", claims), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := verifier.Verify(tt.token); (err != nil) != tt.wantErr {
+				t.Errorf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetJWTVerificationConfig(t *testing.T) {
+	os.Setenv("KRAKEND_FLUENTD_TEST_JWT_SECRET", "secret")
+	defer os.Unsetenv("KRAKEND_FLUENTD_TEST_JWT_SECRET")
+
+	conf := FluentLoggerConfig{}
+	conf.setJWTVerificationConfig(map[string]interface{}{
+		"jwt_verification": map[string]interface{}{
+			"hmac_secret_env":   "KRAKEND_FLUENTD_TEST_JWT_SECRET",
+			"issuer":            "iss",
+			"audience":          "aud",
+			"unverified_claims": "unknown",
+		},
+	})
+
+	verifier := conf.JWTVerifier
+	if string(verifier.hmacSecret) != "secret" || verifier.Issuer != "iss" || len(verifier.Audience) != 1 {
+		t.Errorf("verifier = %+v", verifier)
+	}
+	if verifier.Unverified != unverifiedClaimsDrop {
+		t.Errorf("unknown unverified_claims value should fall back to drop, got %s", verifier.Unverified)
+	}
+}
+
+func TestAddClaims(t *testing.T) {
+	claims := jwt.MapClaims{
+		"sub":                        "u1",
+		"host":                       "claimed-host",
+		"email":                      "a@b.com",
+		"https://example.com/tenant": "t1",
+		"realm_access":               map[string]interface{}{"roles": []interface{}{"admin", "user"}},
+		"orgs":                       []interface{}{map[string]interface{}{"id": "o1"}, map[string]interface{}{"id": "o2"}},
+	}
+	parse := func(entries ...interface{}) []JWTClaim {
+		conf := FluentLoggerConfig{}
+		var result []JWTClaim
+		for _, entry := range entries {
+			claim, err := conf.parseJWTClaim(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result = append(result, claim)
+		}
+		return result
+	}
+
+	tests := []struct {
+		name   string
+		config JWTClaimsConfig
+		want   map[string]interface{}
+	}{
+		{
+			name: "names, selectors and renames",
+			config: JWTClaimsConfig{Claims: parse(
+				"sub",
+				map[string]interface{}{"claim": "realm_access.roles", "name": "roles"},
+				map[string]interface{}{"claim": "https://example.com/tenant", "name": "tenant"},
+				map[string]interface{}{"claim": "orgs[*].id", "name": "orgs"},
+				"missing",
+			)},
+			want: map[string]interface{}{
+				"path": "/", "host": "api",
+				"sub": "u1", "roles": []interface{}{"admin", "user"}, "tenant": "t1",
+				"orgs": []interface{}{"o1", "o2"},
+			},
+		},
+		{
+			name:   "collision without prefix",
+			config: JWTClaimsConfig{Claims: parse("host")},
+			want:   map[string]interface{}{"path": "/", "host": "api", "jwt.host": "claimed-host"},
+		},
+		{
+			name:   "prefix is joined with a dot",
+			config: JWTClaimsConfig{Claims: parse("sub", "host"), Prefix: "jwt"},
+			want:   map[string]interface{}{"path": "/", "host": "api", "jwt.sub": "u1", "jwt.host": "claimed-host"},
+		},
+		{
+			name:   "prefix with trailing dot",
+			config: JWTClaimsConfig{Claims: parse("sub"), Prefix: "jwt."},
+			want:   map[string]interface{}{"path": "/", "host": "api", "jwt.sub": "u1"},
+		},
+		{
+			name: "collision after prefix",
+			config: JWTClaimsConfig{Claims: parse(
+				map[string]interface{}{"claim": "sub", "name": "method"},
+				map[string]interface{}{"claim": "email", "name": "body"},
+			), Prefix: "request"},
+			want: map[string]interface{}{
+				"path": "/", "host": "api", "jwt.method": "u1", "jwt.body": "a@b.com",
+			},
+		},
+		{
+			name:   "sub-map",
+			config: JWTClaimsConfig{Claims: parse("sub", "host"), Field: "jwt"},
+			want: map[string]interface{}{
+				"path": "/", "host": "api", "jwt": map[string]interface{}{"sub": "u1", "host": "claimed-host"},
+			},
+		},
+		{
+			name: "strategies",
+			config: JWTClaimsConfig{Claims: parse(
+				map[string]interface{}{"claim": "email", "strategy": "redact"},
+				map[string]interface{}{"claim": "sub", "strategy": "remove"},
+			)},
+			want: map[string]interface{}{"path": "/", "host": "api", "email": "[REDACTED]"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := map[string]interface{}{"path": "/", "host": "api"}
+			tt.config.AddClaims(data, claims)
+			if !reflect.DeepEqual(data, tt.want) {
+				t.Errorf("AddClaims() = %v, want %v", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddClaimsDropsTakenFallback(t *testing.T) {
+	data := map[string]interface{}{"host": "api", "jwt.host": "taken"}
+	JWTClaimsConfig{Claims: []JWTClaim{{Claim: "host", Name: "host"}}}.AddClaims(data, jwt.MapClaims{"host": "x"})
+
+	want := map[string]interface{}{"host": "api", "jwt.host": "taken"}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("AddClaims() = %v, want %v", data, want)
+	}
+}
+
+func TestSetJWTClaimsConfigField(t *testing.T) {
+	tests := []struct {
+		name  string
+		field string
+		want  string
+	}{
+		{name: "sub-map", field: "jwt", want: "jwt"},
+		{name: "record field", field: "path", want: ""},
+		{name: "logger field", field: "jwt.verified", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := FluentLoggerConfig{}
+			err := conf.SetJWTClaimsConfig(map[string]interface{}{
+				"include_jwt_claims": []interface{}{"sub"},
+				"jwt_claims_field":   tt.field,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conf.JWTClaims.Field != tt.want {
+				t.Errorf("Field = %q, want %q", conf.JWTClaims.Field, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractToken(t *testing.T) {
+	sources := []TokenSource{
+		{Header: "Authorization", Scheme: "Bearer"},
+		{Header: "X-Token"},
+		{Cookie: "access_token"},
+		{Query: "token"},
+	}
+
+	tests := []struct {
+		name    string
+		request func(r *http.Request)
+		want    string
+		wantErr bool
+	}{
+		{"bearer header", func(r *http.Request) { r.Header.Set("Authorization", "bearer h1") }, "h1", false},
+		{"other scheme is skipped", func(r *http.Request) {
+			r.Header.Set("Authorization", "Basic dTpw")
+			r.Header.Set("X-Token", "x1")
+		}, "x1", false},
+		{"custom header", func(r *http.Request) { r.Header.Set("X-Token", "x1") }, "x1", false},
+		{"cookie", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "access_token", Value: "c1"}) }, "c1", false},
+		{"query", func(r *http.Request) { r.URL.RawQuery = "token=q1" }, "q1", false},
+		{"malformed header falls through", func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer")
+			r.URL.RawQuery = "token=q1"
+		}, "q1", false},
+		{"malformed header only", func(r *http.Request) { r.Header.Set("Authorization", "Bearer") }, "", true},
+		{"none", func(r *http.Request) {}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			tt.request(r)
+			got, err := ExtractToken(r, sources)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("ExtractToken() = %q, %v, want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetJWTTokenSourcesConfig(t *testing.T) {
+	conf := FluentLoggerConfig{}
+	conf.setJWTTokenSourcesConfig(map[string]interface{}{})
+	if !reflect.DeepEqual(conf.JWTTokenSources, defaultTokenSources) {
+		t.Errorf("default sources = %v", conf.JWTTokenSources)
+	}
+
+	conf.setJWTTokenSourcesConfig(map[string]interface{}{"jwt_token_sources": []interface{}{
+		map[string]interface{}{"cookie": "session"},
+		map[string]interface{}{"scheme": "Bearer"},
+		map[string]interface{}{"header": "X-Token"},
+		map[string]interface{}{"query": "access_token"},
+	}})
+	want := []TokenSource{{Cookie: "session"}, {Header: "X-Token"}, {Query: "access_token"}}
+	if !reflect.DeepEqual(conf.JWTTokenSources, want) {
+		t.Errorf("sources = %v, want %v", conf.JWTTokenSources, want)
+	}
+
+	if got := MaskRequestQuery("access_token=abc&page=2", conf.Mask); got != "access_token=%5BREDACTED%5D&page=2" {
+		t.Errorf("masked query = %s", got)
+	}
+	cookies := MaskCookies(http.Header{"Cookie": {"session=abc"}}, conf.Mask.rules["request.cookies"])
+	if cookies.Get("Cookie") != "session=[REDACTED]" {
+		t.Errorf("masked cookies = %v", cookies)
+	}
+}
@@ -2,7 +2,6 @@ package handler
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -13,13 +12,14 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-const emptyQty = 0
 const minTokenParts = 2
 
 type LogData struct {
 	start              time.Time
 	path               string
+	route              string
 	fulle_path         string
+	query              string
 	clientIP           string
 	host               string
 	requestMethod      string
@@ -29,12 +29,17 @@ type LogData struct {
 	responseHeaders    http.Header
 	rawResponseBody    *bytes.Buffer
 	responseBody       string
+	redactions         int
+	tag                string
+	errors             []interface{}
+	panicked           bool
 }
 
 type LogWriter struct {
 	gin.ResponseWriter
 	writer  io.Writer
 	logData LogData
+	record  *requestRecord
 }
 
 func (lw LogWriter) Write(b []byte) (int, error) {
@@ -46,24 +51,61 @@ func (lw LogWriter) GetHeaderValue(key string) string {
 }
 
 func (lw *LogWriter) SetRequestBody(c *gin.Context, conf FluentLoggerConfig) {
-	lw.logData.requestBody = MaskRequestBody(ModifyRequestBody(c, conf), conf.Mask.Request)
+	lw.logData.requestBody = lw.redact(conf, "request.body", ProjectBody(
+		MaskRequestBody(c.Request.Header.Get("Content-Type"), ModifyRequestBody(c, conf), conf.Mask),
+		conf.Projection.Rule(lw.logData.route, "request"),
+	))
 }
 
 func (lw *LogWriter) SetResponseBody(c *gin.Context, conf FluentLoggerConfig) {
 	lw.logData.responseHeaders = c.Writer.Header()
-	lw.logData.responseStatusCode = c.Writer.Status()
-	lw.logData.responseBody = MaskResponseBody(
-		ModifyResponseBody(c, lw.logData.rawResponseBody, conf), conf.Mask.Response,
-	)
+	if !lw.logData.panicked {
+		lw.logData.responseStatusCode = c.Writer.Status()
+	}
+	lw.logData.responseBody = lw.redact(conf, "response.body", ProjectBody(
+		MaskResponseBody(
+			c.Writer.Header().Get("Content-Type"), ModifyResponseBody(c, lw.logData.rawResponseBody, conf), conf.Mask,
+		),
+		conf.Projection.Rule(lw.logData.route, "response"),
+	))
+}
+
+// SetErrors captures gin errors of the request and a recovered panic.
+// A panic makes the record status 500 whatever was written before.
+func (lw *LogWriter) SetErrors(c *gin.Context, recovered interface{}, stack []byte) {
+	lw.logData.errors = makeErrors(c.Errors, recovered, stack)
+	if recovered != nil {
+		lw.logData.panicked = true
+		lw.logData.responseStatusCode = http.StatusInternalServerError
+	}
+}
+
+func (lw *LogWriter) redact(conf FluentLoggerConfig, target, text string) string {
+	redacted, count := conf.Redact.RedactBody(target, text)
+	lw.logData.redactions += count
+
+	return redacted
 }
 
 func (lw *LogWriter) MakeLogData(conf FluentLoggerConfig) map[string]interface{} {
 	data := lw.logData
 	finish := time.Now()
-	maskedRequestHeaders := MaskRequestHeaders(makeHeaders(data.requestHeaders), conf.Mask.Request)
-	maskedResponseHeader := MaskResponseHeaders(makeHeaders(data.responseHeaders), conf.Mask.Response)
-
-	return map[string]interface{}{
+	requestHeaders := makeHeaders(MaskCookies(
+		conf.Headers.Request.Filter(data.requestHeaders), conf.Mask.rules["request.cookies"],
+	))
+	responseHeaders := makeHeaders(MaskCookies(
+		conf.Headers.Response.Filter(data.responseHeaders), conf.Mask.rules["response.cookies"],
+	))
+	maskedRequestHeaders := MaskRequestHeaders(requestHeaders, conf.Mask)
+	maskedResponseHeader := MaskResponseHeaders(responseHeaders, conf.Mask)
+	query, redactions := conf.Redact.RedactQuery("request.query", MaskRequestQuery(data.query, conf.Mask))
+	redactions += data.redactions
+	redactions += conf.Redact.RedactHeaders("request.headers", maskedRequestHeaders)
+	redactions += conf.Redact.RedactHeaders("response.headers", maskedResponseHeader)
+	errs, errorRedactions := redactErrors(data.errors, conf.Redact)
+	redactions += errorRedactions
+
+	record := map[string]interface{}{
 		"start":                fmt.Sprintf("%v", data.start),
 		"finish":               fmt.Sprintf("%v", finish),
 		"path":                 data.path,
@@ -77,37 +119,82 @@ func (lw *LogWriter) MakeLogData(conf FluentLoggerConfig) map[string]interface{}
 		"response.headers":     createKeyValuePairs(maskedResponseHeader),
 		"response.body":        data.responseBody,
 	}
+	if conf.logsQuery() {
+		record["request.query"] = query
+	}
+	redactions += promoteHeaders(record, "request", data.requestHeaders, conf)
+	redactions += promoteHeaders(record, "response", data.responseHeaders, conf)
+	record["redactions"] = redactions
+	if traceID, spanID, ok := parseTraceparent(data.requestHeaders.Get("traceparent")); ok {
+		record["trace_id"] = traceID
+		record["span_id"] = spanID
+	}
+	if len(errs) > 0 {
+		record["error"] = errs
+	}
+	lw.logData.tag = lw.record.apply(record, conf.FluentTag)
+
+	return record
 }
 
-func AddJwtData(data map[string]interface{}, claimsToAdd map[string]struct{}, header string) error {
-	if header == "" || len(claimsToAdd) <= emptyQty {
-		return nil
-	}
+// Tag returns the tag to post the record with, available after MakeLogData.
+func (lw *LogWriter) Tag() string {
+	return lw.logData.tag
+}
 
-	splitHeader := strings.Split(header, " ")
+// Skipped reports whether a downstream handler asked not to log the request.
+func (lw *LogWriter) Skipped() bool {
+	return lw.record.skipped()
+}
 
-	if len(splitHeader) < minTokenParts {
-		return errors.New("wrong authorization header format")
+// AddJwtData copies configured claims of token to data and returns the
+// claims that can be trusted for further use (e.g. consumer resolution):
+// only claims of tokens verified by verifier, nil otherwise. With verifier
+// set, "jwt.verified" is added and claims of tokens failing verification
+// are dropped or only logged, depending on verifier settings. Without
+// verifier claims are only logged.
+func AddJwtData(
+	data map[string]interface{}, claimsToAdd JWTClaimsConfig, token string, verifier *JWTVerifier,
+) (jwt.MapClaims, error) {
+	if token == "" {
+		return nil, nil
 	}
 
-	token, _, err := new(jwt.Parser).ParseUnverified(splitHeader[1], jwt.MapClaims{})
-	if err != nil {
-		return err
+	var verified jwt.MapClaims
+	if verifier != nil {
+		claims, err := verifier.Verify(token)
+		data["jwt.verified"] = err == nil
+		if err != nil && verifier.Unverified == unverifiedClaimsDrop {
+			return nil, err
+		}
+		if err != nil {
+			data["jwt.error"] = err.Error()
+		}
+		verified = claims
 	}
 
-	for k, v := range token.Claims.(jwt.MapClaims) {
-		if _, ok := claimsToAdd[k]; ok {
-			data[k] = v
+	claims := verified
+	if claims == nil {
+		parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+		if err != nil {
+			return nil, err
 		}
+		claims = parsed.Claims.(jwt.MapClaims)
 	}
 
-	return nil
+	claimsToAdd.AddClaims(data, claims)
+
+	return verified, nil
 }
 
 func NewLogWriter(c *gin.Context) (*LogWriter, error) {
 	var log bytes.Buffer
 
 	full_path := ""
+	route := c.FullPath()
+	if route == "" {
+		route = c.Request.URL.Path
+	}
 	raw := c.Request.URL.RawQuery
 
 	if raw != "" {
@@ -120,13 +207,16 @@ func NewLogWriter(c *gin.Context) (*LogWriter, error) {
 		logData: LogData{
 			start:           time.Now(),
 			path:            c.Request.URL.Path,
+			route:           route,
 			fulle_path:      full_path,
+			query:           raw,
 			clientIP:        c.ClientIP(),
 			host:            c.Request.Host,
 			requestHeaders:  c.Request.Header,
 			requestMethod:   c.Request.Method,
 			rawResponseBody: &log,
 		},
+		record: recordOf(c),
 	}
 
 	c.Writer = newLogWriter
@@ -1,86 +1,269 @@
 package handler
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
 )
 
-func MaskRequestHeaders(data map[string]string, conf map[string][]string) map[string]string {
-	headers, ok := conf["request.headers"]
+func MaskRequestHeaders(data map[string]string, conf MaskConfig) map[string]string {
+	rules, ok := conf.rules["request.headers"]
 	if !ok {
 		return data
 	}
 
-	return MaskHeaders(data, headers)
+	return MaskHeaders(data, rules)
 }
 
-func MaskResponseHeaders(data map[string]string, conf map[string][]string) map[string]string {
-	headers, ok := conf["response.headers"]
+func MaskResponseHeaders(data map[string]string, conf MaskConfig) map[string]string {
+	rules, ok := conf.rules["response.headers"]
 	if !ok {
 		return data
 	}
 
-	return MaskHeaders(data, headers)
+	return MaskHeaders(data, rules)
 }
 
-func MaskHeaders(data map[string]string, conf []string) map[string]string {
-	for _, header := range conf {
-		value, ok := data[header]
-		if !ok {
-			continue
-		}
+var authSchemes = map[string]struct{}{
+	"basic":     {},
+	"bearer":    {},
+	"digest":    {},
+	"hoba":      {},
+	"mutual":    {},
+	"negotiate": {},
+	"ntlm":      {},
+	"token":     {},
+}
+
+var authParamPattern = regexp.MustCompile(`([A-Za-z0-9_-]+)=("[^"]*"|[^,\s]*)`)
 
-		splitted := strings.Split(value, " ")
-		if len(splitted) == 2 {
-			if splitted[0] == "Bearer" || splitted[0] == "Token" {
-				forJoin := []string{splitted[0], maskFormat(splitted[1])}
-				data[header] = strings.Join(forJoin, " ")
+// MaskHeaders masks header values. Header names are matched
+// case-insensitively. For "Authorization"-like values the auth scheme is
+// kept and only credentials are masked.
+func MaskHeaders(data map[string]string, rules []MaskRule) map[string]string {
+	for _, rule := range rules {
+		for header, value := range data {
+			if !strings.EqualFold(header, rule.Field) {
+				continue
 			}
-		} else {
-			joined := strings.Join(splitted, " ")
-			data[header] = maskFormat(joined)
-		}
 
+			masked, keep := maskHeaderValue(header, value, rule.strategy())
+			if !keep {
+				delete(data, header)
+				continue
+			}
+			data[header] = masked
+		}
 	}
 
 	return data
 }
 
-func MaskRequestBody(body string, conf map[string][]string) string {
-	keys, ok := conf["request.body"]
+func maskHeaderValue(header, value string, strategy MaskStrategy) (string, bool) {
+	scheme, credentials, ok := splitAuthScheme(header, value)
 	if !ok {
-		return body
+		return strategy.Mask(value)
+	}
+
+	if strings.EqualFold(scheme, "digest") || hasAuthParams(credentials) {
+		return scheme + " " + maskAuthParams(credentials, strategy), true
 	}
 
-	return MaskBody(body, keys)
+	masked, keep := strategy.Mask(credentials)
+	if !keep {
+		return "", false
+	}
+
+	return scheme + " " + masked, true
 }
 
-func MaskResponseBody(body string, conf map[string][]string) string {
-	keys, ok := conf["response.body"]
+// splitAuthScheme splits "<scheme> <credentials>" values of authorization
+// headers, or of any header when the scheme is a well-known one.
+func splitAuthScheme(header, value string) (string, string, bool) {
+	parts := strings.SplitN(strings.TrimSpace(value), " ", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return "", "", false
+	}
+
+	scheme := parts[0]
+	if strings.EqualFold(header, "Authorization") || strings.EqualFold(header, "Proxy-Authorization") {
+		return scheme, strings.TrimSpace(parts[1]), isToken(scheme)
+	}
+	if _, ok := authSchemes[strings.ToLower(scheme)]; ok {
+		return scheme, strings.TrimSpace(parts[1]), true
+	}
+
+	return "", "", false
+}
+
+func maskAuthParams(credentials string, strategy MaskStrategy) string {
+	return authParamPattern.ReplaceAllStringFunc(credentials, func(param string) string {
+		kv := strings.SplitN(param, "=", 2)
+		value := kv[1]
+		quoted := strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") && len(value) >= 2
+		if quoted {
+			value = value[1 : len(value)-1]
+		}
+
+		masked, keep := strategy.Mask(value)
+		if !keep {
+			masked = ""
+		}
+		if quoted {
+			masked = "\"" + masked + "\""
+		}
+
+		return kv[0] + "=" + masked
+	})
+}
+
+// hasAuthParams reports whether credentials are a list of auth-params
+// (`key="value", key2=value2`) rather than a single token.
+func hasAuthParams(credentials string) bool {
+	return strings.Contains(credentials, ",") && authParamPattern.MatchString(credentials)
+}
+
+func isToken(s string) bool {
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r)) {
+			return false
+		}
+	}
+
+	return s != ""
+}
+
+// MaskCookies returns a copy of headers with values of configured cookies
+// masked in "Cookie" and "Set-Cookie" headers.
+func MaskCookies(headers http.Header, rules []MaskRule) http.Header {
+	if len(rules) == 0 {
+		return headers
+	}
+
+	result := headers.Clone()
+	for header, values := range result {
+		switch http.CanonicalHeaderKey(header) {
+		case "Cookie":
+			for i, value := range values {
+				pairs := strings.Split(value, ";")
+				for j, pair := range pairs {
+					pairs[j] = maskCookiePair(pair, rules)
+				}
+				result[header][i] = strings.Join(pairs, ";")
+			}
+		case "Set-Cookie":
+			for i, value := range values {
+				attributes := strings.SplitN(value, ";", 2)
+				attributes[0] = maskCookiePair(attributes[0], rules)
+				result[header][i] = strings.Join(attributes, ";")
+			}
+		}
+	}
+
+	return result
+}
+
+func maskCookiePair(pair string, rules []MaskRule) string {
+	kv := strings.SplitN(pair, "=", 2)
+	if len(kv) != 2 {
+		return pair
+	}
+
+	rule, ok := matchNamedRule(rules, strings.TrimSpace(kv[0]))
 	if !ok {
-		return body
+		return pair
+	}
+
+	masked, keep := rule.strategy().Mask(kv[1])
+	if !keep {
+		masked = ""
 	}
 
-	return MaskBody(body, keys)
+	return kv[0] + "=" + masked
 }
 
-func MaskBody(body string, conf []string) string {
-	jsonBody, err := toJSON(body)
-	if err != nil {
-		return body
+// MaskRequestQuery masks values of configured parameters of a raw query
+// string.
+func MaskRequestQuery(query string, conf MaskConfig) string {
+	return MaskQuery(query, conf.rules["request.query"])
+}
+
+// MaskQuery masks values of query parameters named by rules, `"*"` masks
+// every parameter. Names are URL-decoded before matching, parameters
+// removed by a strategy are dropped and the others keep their encoding.
+func MaskQuery(query string, rules []MaskRule) string {
+	if len(rules) == 0 || query == "" {
+		return query
 	}
 
-	for _, key := range conf {
-		value, ok := jsonBody[key]
-		if !ok {
+	pairs := strings.Split(query, "&")
+	result := pairs[:0]
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		name, err := url.QueryUnescape(kv[0])
+		if err != nil {
+			name = kv[0]
+		}
+		rule, ok := matchNamedRule(rules, name)
+		if !ok || len(kv) != 2 {
+			result = append(result, pair)
 			continue
 		}
-		jsonBody[key] = maskFormat(fmt.Sprint(value))
+
+		value, err := url.QueryUnescape(kv[1])
+		if err != nil {
+			value = kv[1]
+		}
+		masked, keep := rule.strategy().Mask(value)
+		if keep {
+			result = append(result, kv[0]+"="+url.QueryEscape(masked))
+		}
+	}
+
+	return strings.Join(result, "&")
+}
+
+// matchNamedRule finds the rule for a cookie or query parameter name.
+func matchNamedRule(rules []MaskRule, name string) (MaskRule, bool) {
+	for _, rule := range rules {
+		if rule.Field == name || rule.Field == "*" {
+			return rule, true
+		}
+	}
+
+	return MaskRule{}, false
+}
+
+func MaskRequestBody(contentType, body string, conf MaskConfig) string {
+	return MaskBodyByContentType(contentType, body, conf.rules["request.body"])
+}
+
+func MaskResponseBody(contentType, body string, conf MaskConfig) string {
+	return MaskBodyByContentType(contentType, body, conf.rules["response.body"])
+}
+
+// MaskBody masks fields of a JSON body addressed by rules made with
+// NewMaskRule.
+func MaskBody(body string, rules []MaskRule) string {
+	if len(rules) == 0 {
+		return body
+	}
+
+	jsonBody, err := toJSONValue(body)
+	if err != nil {
+		return body
 	}
 
-	jsonString, err := toString(jsonBody)
+	masked, keep := maskValue(jsonBody, nil, rules)
+	if !keep {
+		return ""
+	}
 
+	jsonString, err := toString(masked)
 	if err != nil {
 		return body
 	}
@@ -88,29 +271,97 @@ func MaskBody(body string, conf []string) string {
 	return jsonString
 }
 
+// maskValue masks values addressed by rules. The second result is false
+// when the value itself has to be removed.
+func maskValue(value interface{}, path []PathElement, rules []MaskRule) (interface{}, bool) {
+	partial := false
+	for _, rule := range rules {
+		full, p := rule.selector.Match(path)
+		if full {
+			return maskAll(value, rule.strategy())
+		}
+		partial = partial || p
+	}
+	if !partial {
+		return value, true
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			masked, keep := maskValue(item, appendPath(path, PathElement{Key: key}), rules)
+			if !keep {
+				delete(v, key)
+				continue
+			}
+			v[key] = masked
+		}
+	case []interface{}:
+		result := v[:0]
+		for i, item := range v {
+			masked, keep := maskValue(item, appendPath(path, PathElement{Index: i, IsIndex: true}), rules)
+			if keep {
+				result = append(result, masked)
+			}
+		}
+		return result, true
+	}
+
+	return value, true
+}
+
+// maskAll masks every scalar of value with strategy keeping the document
+// structure. Numbers and booleans become masked strings, nulls stay untouched.
+func maskAll(value interface{}, strategy MaskStrategy) (interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		size := len(v)
+		for key, item := range v {
+			masked, keep := maskAll(item, strategy)
+			if !keep {
+				delete(v, key)
+				continue
+			}
+			v[key] = masked
+		}
+		return v, size == 0 || len(v) > 0
+	case []interface{}:
+		size := len(v)
+		result := v[:0]
+		for _, item := range v {
+			if masked, keep := maskAll(item, strategy); keep {
+				result = append(result, masked)
+			}
+		}
+		return result, size == 0 || len(result) > 0
+	case nil:
+		return nil, true
+	case json.Number:
+		return strategy.Mask(v.String())
+	}
+
+	return strategy.Mask(fmt.Sprint(value))
+}
+
 func maskFormat(s string) string {
 	var formatted string
 
 	runes := []rune(s)
 
-	if len(s) >= 11 {
+	if len(runes) >= 11 {
 		formatted = fmt.Sprint(string(runes[:4]), "...", string(runes[len(runes)-4:]))
 	} else {
-		formatted = strings.Repeat("*", len(s))
+		formatted = strings.Repeat("*", len(runes))
 	}
 
 	return formatted
 }
 
-func toJSON(data string) (map[string]interface{}, error) {
-	bufferSingleMap := make(map[string]interface{})
-	err := json.Unmarshal([]byte(data), &bufferSingleMap)
-
-	return bufferSingleMap, err
-}
-
-func toString(s map[string]interface{}) (string, error) {
-	jsonString, err := json.Marshal(s)
+func toString(v interface{}) (string, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(v)
 
-	return string(jsonString), err
+	return strings.TrimSuffix(buffer.String(), "\n"), err
 }
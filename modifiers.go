@@ -3,8 +3,10 @@ package handler
 import (
 	"bytes"
 	"fmt"
-	"github.com/gin-gonic/gin"
 	"io"
+	"mime"
+
+	"github.com/gin-gonic/gin"
 )
 
 func ModifyRequestBody(c *gin.Context, conf FluentLoggerConfig) string {
@@ -14,7 +16,7 @@ func ModifyRequestBody(c *gin.Context, conf FluentLoggerConfig) string {
 	}
 
 	if ok := checkContentLength(c.Request.ContentLength, conf); !ok {
-		return fmt.Sprintf("Content too long  \"%s\" ", c.Request.ContentLength)
+		return fmt.Sprintf("Content too long  \"%d\" ", c.Request.ContentLength)
 	}
 
 	bodyToRead, err := io.ReadAll(c.Request.Body)
@@ -56,9 +58,15 @@ func ModifyResponseBody(c *gin.Context, responseBody *bytes.Buffer, conf FluentL
 func checkContentType(contentType string, conf FluentLoggerConfig) bool {
 	if _, ok := conf.Request.allowedContentTypes[contentType]; ok {
 		return true
-	} else {
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
 		return false
 	}
+	_, ok := conf.Request.allowedContentTypes[mediaType]
+
+	return ok
 }
 
 func checkContentLength(contentLength int64, conf FluentLoggerConfig) bool {
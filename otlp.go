@@ -0,0 +1,520 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	otlpProtocolHTTP = "http/protobuf"
+	otlpProtocolGRPC = "grpc"
+
+	defaultOTLPHTTPEndpoint = "http://localhost:4318"
+	defaultOTLPGRPCEndpoint = "http://localhost:4317"
+	otlpHTTPLogsPath        = "/v1/logs"
+	otlpGRPCExportPath      = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+
+	otlpScopeName = "github.com/dmitrykaramin/krakend-fluentd-request-logger"
+)
+
+// OTLP severity numbers.
+const (
+	otlpSeverityInfo  = 9
+	otlpSeverityWarn  = 13
+	otlpSeverityError = 17
+)
+
+// record fields mapped to HTTP semantic convention attributes.
+var otlpSemanticAttributes = map[string]string{
+	"request.method":       "http.request.method",
+	"path":                 "url.path",
+	"request.query":        "url.query",
+	"response.status_code": "http.response.status_code",
+	"client_ip":            "client.address",
+}
+
+// gRPC status codes the OTLP exporter specification treats as retryable.
+var otlpRetryableGRPCCodes = map[int]bool{1: true, 4: true, 8: true, 10: true, 11: true, 14: true, 15: true}
+
+// OTLPConfig configures the OTLP logs exporter.
+type OTLPConfig struct {
+	Protocol    string
+	Endpoint    string
+	Headers     map[string]string
+	Compression string
+	Resource    map[string]string
+	TLS         *tls.Config
+	Export      ExportConfig
+}
+
+// OTLPSink exports records as OTLP log records over HTTP/protobuf or gRPC.
+// Record fields become attributes, HTTP ones named by semantic
+// conventions, and "trace_id"/"span_id" become the log record trace
+// context. Severity follows the response status.
+type OTLPSink struct {
+	*batchExporter
+	cfg      OTLPConfig
+	endpoint string
+	client   *http.Client
+}
+
+func NewOTLPSink(cfg OTLPConfig) (*OTLPSink, error) {
+	switch cfg.Protocol {
+	case "":
+		cfg.Protocol = otlpProtocolHTTP
+	case otlpProtocolHTTP, otlpProtocolGRPC:
+	default:
+		return nil, fmt.Errorf("unknown protocol '%s'", cfg.Protocol)
+	}
+	switch cfg.Compression {
+	case "", "none":
+		cfg.Compression = ""
+	case compressionGzip:
+	default:
+		return nil, fmt.Errorf("unknown compression '%s'", cfg.Compression)
+	}
+	if cfg.Resource == nil {
+		cfg.Resource = map[string]string{}
+	}
+	if cfg.Resource["service.name"] == "" {
+		cfg.Resource["service.name"] = defaultSyslogAppName
+	}
+
+	endpoint, client, err := otlpClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &OTLPSink{cfg: cfg, endpoint: endpoint, client: client}
+	s.batchExporter = newBatchExporter("OTLP", cfg.Export, s.export)
+
+	return s, nil
+}
+
+func otlpClient(cfg OTLPConfig) (string, *http.Client, error) {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = defaultOTLPHTTPEndpoint
+		if cfg.Protocol == otlpProtocolGRPC {
+			endpoint = defaultOTLPGRPCEndpoint
+		}
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return "", nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", nil, fmt.Errorf("endpoint '%s' must be http or https URL", endpoint)
+	}
+
+	if cfg.Protocol == otlpProtocolHTTP {
+		if parsed.Path == "" || parsed.Path == "/" {
+			parsed.Path = otlpHTTPLogsPath
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = cfg.TLS
+		return parsed.String(), &http.Client{Transport: transport}, nil
+	}
+
+	parsed.Path = strings.TrimSuffix(parsed.Path, "/") + otlpGRPCExportPath
+	transport := &http2.Transport{TLSClientConfig: cfg.TLS}
+	if parsed.Scheme == "http" {
+		// gRPC without TLS is HTTP/2 with prior knowledge
+		transport.AllowHTTP = true
+		transport.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		}
+	}
+
+	return parsed.String(), &http.Client{Transport: transport}, nil
+}
+
+func (s *OTLPSink) Close() error {
+	err := s.batchExporter.Close()
+	s.client.CloseIdleConnections()
+
+	return err
+}
+
+func (s *OTLPSink) export(ctx context.Context, entries []exportEntry) error {
+	payload := encodeOTLPLogs(s.cfg.Resource, entries)
+	compressed := false
+	if s.cfg.Compression == compressionGzip {
+		gzipped, err := gzipBytes(payload)
+		if err != nil {
+			return err
+		}
+		payload, compressed = gzipped, true
+	}
+
+	if s.cfg.Protocol == otlpProtocolGRPC {
+		return s.exportGRPC(ctx, payload, compressed)
+	}
+
+	return s.exportHTTP(ctx, payload, compressed)
+}
+
+func (s *OTLPSink) exportHTTP(ctx context.Context, payload []byte, compressed bool) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	if compressed {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range s.cfg.Headers {
+		request.Header.Set(k, v)
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return retryableError{err: err}
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+
+	err = fmt.Errorf("OTLP export failed with status %d: %s", response.StatusCode, otlpStatusMessage(body))
+	if isRetryableHTTPStatus(response.StatusCode) {
+		return retryableError{err: err, after: retryAfter(response.Header)}
+	}
+
+	return err
+}
+
+func (s *OTLPSink) exportGRPC(ctx context.Context, payload []byte, compressed bool) error {
+	frame := make([]byte, 5, 5+len(payload))
+	if compressed {
+		frame[0] = 1
+	}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	frame = append(frame, payload...)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+	if compressed {
+		request.Header.Set("Grpc-Encoding", "gzip")
+	}
+	for k, v := range s.cfg.Headers {
+		request.Header.Set(strings.ToLower(k), v)
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return retryableError{err: err}
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("OTLP export failed with HTTP status %d", response.StatusCode)
+		if isRetryableHTTPStatus(response.StatusCode) {
+			return retryableError{err: err}
+		}
+		return err
+	}
+
+	// trailers-only responses carry the status in headers
+	status := response.Trailer.Get("Grpc-Status")
+	message := response.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = response.Header.Get("Grpc-Status"), response.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return errors.New("OTLP export response has no gRPC status")
+	}
+	if code == 0 {
+		return nil
+	}
+
+	if unescaped, err := url.PathUnescape(message); err == nil {
+		message = unescaped
+	}
+	err = fmt.Errorf("OTLP export failed with gRPC status %d: %s", code, message)
+	if otlpRetryableGRPCCodes[code] {
+		return retryableError{err: err}
+	}
+
+	return err
+}
+
+func isRetryableHTTPStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// retryAfter reads Retry-After header given in seconds or as HTTP date.
+func retryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+
+	return 0
+}
+
+// otlpStatusMessage returns the message of a google.rpc.Status body or
+// the body itself if it is not one.
+func otlpStatusMessage(body []byte) string {
+	b := body
+	for len(b) > 0 {
+		number, wireType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			break
+		}
+		b = b[n:]
+		if number == 2 && wireType == protowire.BytesType {
+			message, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				break
+			}
+			return string(message)
+		}
+		n = protowire.ConsumeFieldValue(number, wireType, b)
+		if n < 0 {
+			break
+		}
+		b = b[n:]
+	}
+
+	return strings.TrimSpace(string(body))
+}
+
+// encodeOTLPLogs encodes ExportLogsServiceRequest with one ResourceLogs
+// holding one ScopeLogs of all entries.
+func encodeOTLPLogs(resource map[string]string, entries []exportEntry) []byte {
+	attributes := make(map[string]interface{}, len(resource))
+	for k, v := range resource {
+		attributes[k] = v
+	}
+	var resourceMessage []byte
+	for _, k := range sortedKeys(attributes) {
+		resourceMessage = protowire.AppendTag(resourceMessage, 1, protowire.BytesType)
+		resourceMessage = protowire.AppendBytes(resourceMessage, encodeKeyValue(k, resource[k]))
+	}
+
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, otlpScopeName)
+
+	var scopeLogs []byte
+	scopeLogs = protowire.AppendTag(scopeLogs, 1, protowire.BytesType)
+	scopeLogs = protowire.AppendBytes(scopeLogs, scope)
+	for _, entry := range entries {
+		scopeLogs = protowire.AppendTag(scopeLogs, 2, protowire.BytesType)
+		scopeLogs = protowire.AppendBytes(scopeLogs, encodeLogRecord(entry))
+	}
+
+	var resourceLogs []byte
+	resourceLogs = protowire.AppendTag(resourceLogs, 1, protowire.BytesType)
+	resourceLogs = protowire.AppendBytes(resourceLogs, resourceMessage)
+	resourceLogs = protowire.AppendTag(resourceLogs, 2, protowire.BytesType)
+	resourceLogs = protowire.AppendBytes(resourceLogs, scopeLogs)
+
+	var request []byte
+	request = protowire.AppendTag(request, 1, protowire.BytesType)
+
+	return protowire.AppendBytes(request, resourceLogs)
+}
+
+func encodeLogRecord(entry exportEntry) []byte {
+	status := recordStatus(entry.record)
+	severity, severityText := otlpSeverityInfo, "INFO"
+	switch statusSeverity(status) {
+	case severityError:
+		severity, severityText = otlpSeverityError, "ERROR"
+	case severityWarning:
+		severity, severityText = otlpSeverityWarn, "WARN"
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(entry.time.UnixNano()))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(severity))
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendString(b, severityText)
+	b = protowire.AppendTag(b, 5, protowire.BytesType)
+	b = protowire.AppendBytes(b, encodeAnyValue(recordSummary(entry.record)))
+
+	attributes := map[string]interface{}{"log.tag": entry.tag}
+	for k, v := range entry.record {
+		if k == "trace_id" || k == "span_id" || v == nil {
+			continue
+		}
+		if k == "host" {
+			address, port := splitServerAddress(fmt.Sprint(v))
+			attributes["server.address"] = address
+			if port > 0 {
+				attributes["server.port"] = port
+			}
+			continue
+		}
+		if name, ok := otlpSemanticAttributes[k]; ok {
+			k = name
+		}
+		attributes[k] = v
+	}
+	if status != 0 {
+		attributes["http.response.status_code"] = status
+	}
+	for _, k := range sortedKeys(attributes) {
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeKeyValue(k, attributes[k]))
+	}
+
+	if traceID, err := hex.DecodeString(fmt.Sprint(entry.record["trace_id"])); err == nil && len(traceID) == 16 {
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendBytes(b, traceID)
+	}
+	if spanID, err := hex.DecodeString(fmt.Sprint(entry.record["span_id"])); err == nil && len(spanID) == 8 {
+		b = protowire.AppendTag(b, 10, protowire.BytesType)
+		b = protowire.AppendBytes(b, spanID)
+	}
+	b = protowire.AppendTag(b, 11, protowire.Fixed64Type)
+
+	return protowire.AppendFixed64(b, uint64(entry.time.UnixNano()))
+}
+
+// splitServerAddress splits a host like "api.example.com:8443" into the
+// address and the port, 0 if the host has none.
+func splitServerAddress(host string) (string, int) {
+	address, portText, err := net.SplitHostPort(host)
+	if err != nil {
+		return host, 0
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return host, 0
+	}
+
+	return address, port
+}
+
+func encodeKeyValue(key string, value interface{}) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, key)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+
+	return protowire.AppendBytes(b, encodeAnyValue(value))
+}
+
+// encodeAnyValue encodes AnyValue, with maps as kvlist_value and slices as
+// array_value.
+func encodeAnyValue(value interface{}) []byte {
+	var b []byte
+	switch v := value.(type) {
+	case string:
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	case bool:
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case int:
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	case int64:
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	case float64:
+		b = protowire.AppendTag(b, 4, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case []interface{}:
+		var values []byte
+		for _, item := range v {
+			values = protowire.AppendTag(values, 1, protowire.BytesType)
+			values = protowire.AppendBytes(values, encodeAnyValue(item))
+		}
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, values)
+	case map[string]interface{}:
+		var values []byte
+		for _, k := range sortedKeys(v) {
+			values = protowire.AppendTag(values, 1, protowire.BytesType)
+			values = protowire.AppendBytes(values, encodeKeyValue(k, v[k]))
+		}
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, values)
+	case []byte:
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		b = protowire.AppendBytes(b, v)
+	case nil:
+	default:
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, fmt.Sprint(v))
+	}
+
+	return b
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func newOTLPSinkFromConfig(_ FluentLoggerConfig, cfg map[string]interface{}) (Sink, error) {
+	otlpConfig := OTLPConfig{}
+	for option, target := range map[string]*string{
+		"protocol":    &otlpConfig.Protocol,
+		"endpoint":    &otlpConfig.Endpoint,
+		"compression": &otlpConfig.Compression,
+	} {
+		if _, ok := cfg[option]; ok {
+			*target = ConvertToString(option, cfg)
+		}
+	}
+	otlpConfig.Headers = stringMap(cfg, "headers")
+	otlpConfig.Resource = stringMap(cfg, "resource")
+	if tlsConfigMap, ok := cfg["tls"].(map[string]interface{}); ok {
+		tlsConfig, err := parseTLSConfig(tlsConfigMap)
+		if err != nil {
+			return nil, err
+		}
+		otlpConfig.TLS = tlsConfig
+	}
+	otlpConfig.Export = parseExportConfig(cfg)
+
+	return NewOTLPSink(otlpConfig)
+}
@@ -0,0 +1,380 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoMessage decodes a protobuf message into its fields by number:
+// bytes fields as []byte, varint and fixed64 ones as uint64.
+func protoMessage(t *testing.T, b []byte) map[protowire.Number][]interface{} {
+	t.Helper()
+
+	fields := map[protowire.Number][]interface{}{}
+	for len(b) > 0 {
+		number, wireType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("malformed tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		var value interface{}
+		switch wireType {
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			value, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			value, n = protowire.ConsumeFixed64(b)
+		default:
+			t.Fatalf("field %d has unexpected wire type %d", number, wireType)
+		}
+		if n < 0 {
+			t.Fatalf("malformed field %d: %v", number, protowire.ParseError(n))
+		}
+		b = b[n:]
+		fields[number] = append(fields[number], value)
+	}
+
+	return fields
+}
+
+// protoAttributes decodes repeated KeyValue fields into a map of their
+// AnyValue messages.
+func protoAttributes(t *testing.T, keyValues []interface{}) map[string]map[protowire.Number][]interface{} {
+	t.Helper()
+
+	attributes := map[string]map[protowire.Number][]interface{}{}
+	for _, keyValue := range keyValues {
+		fields := protoMessage(t, keyValue.([]byte))
+		attributes[string(fields[1][0].([]byte))] = protoMessage(t, fields[2][0].([]byte))
+	}
+
+	return attributes
+}
+
+func TestEncodeOTLPLogs(t *testing.T) {
+	moment := time.Unix(1700000000, 5)
+	entries := []exportEntry{{
+		tag:  "access",
+		time: moment,
+		record: map[string]interface{}{
+			"request.method":       "GET",
+			"path":                 "/users",
+			"host":                 "api.example.com:8443",
+			"response.status_code": "404",
+			"trace_id":             "4bf92f3577b34da6a3ce929d0e0e4736",
+			"span_id":              "00f067aa0ba902b7",
+			"latency":              1.5,
+			"cached":               true,
+			"list":                 []interface{}{"a"},
+			"empty":                nil,
+		},
+	}}
+
+	// ExportLogsServiceRequest.resource_logs = 1
+	request := protoMessage(t, encodeOTLPLogs(map[string]string{"service.name": "gw"}, entries))
+	resourceLogs := protoMessage(t, request[1][0].([]byte))
+
+	// ResourceLogs.resource = 1, Resource.attributes = 1
+	resource := protoAttributes(t, protoMessage(t, resourceLogs[1][0].([]byte))[1])
+	if string(resource["service.name"][1][0].([]byte)) != "gw" {
+		t.Errorf("resource = %v", resource)
+	}
+
+	// ResourceLogs.scope_logs = 2, ScopeLogs.scope = 1, InstrumentationScope.name = 1
+	scopeLogs := protoMessage(t, resourceLogs[2][0].([]byte))
+	if name := protoMessage(t, scopeLogs[1][0].([]byte))[1][0].([]byte); string(name) != otlpScopeName {
+		t.Errorf("scope name = %s", name)
+	}
+
+	// ScopeLogs.log_records = 2
+	if len(scopeLogs[2]) != 1 {
+		t.Fatalf("log records = %d, want 1", len(scopeLogs[2]))
+	}
+	record := protoMessage(t, scopeLogs[2][0].([]byte))
+	for number, want := range map[protowire.Number]interface{}{
+		1:  uint64(moment.UnixNano()),                       // time_unix_nano
+		2:  uint64(otlpSeverityWarn),                        // severity_number
+		3:  []byte("WARN"),                                  // severity_text
+		9:  hexBytes(t, "4bf92f3577b34da6a3ce929d0e0e4736"), // trace_id
+		10: hexBytes(t, "00f067aa0ba902b7"),                 // span_id
+		11: uint64(moment.UnixNano()),                       // observed_time_unix_nano
+	} {
+		if len(record[number]) != 1 || !reflect.DeepEqual(record[number][0], want) {
+			t.Errorf("log record field %d = %v, want %v", number, record[number], want)
+		}
+	}
+	// body = 5, AnyValue.string_value = 1
+	if body := protoMessage(t, record[5][0].([]byte)); string(body[1][0].([]byte)) != "GET /users 404" {
+		t.Errorf("body = %v", body)
+	}
+
+	// attributes = 6
+	attributes := protoAttributes(t, record[6])
+	if _, ok := attributes["trace_id"]; ok {
+		t.Error("trace_id is an attribute")
+	}
+	if _, ok := attributes["empty"]; ok {
+		t.Error("nil value is an attribute")
+	}
+	for key, want := range map[string]struct {
+		field protowire.Number
+		value interface{}
+	}{
+		"log.tag":                   {1, []byte("access")},
+		"http.request.method":       {1, []byte("GET")},
+		"url.path":                  {1, []byte("/users")},
+		"server.address":            {1, []byte("api.example.com")},
+		"server.port":               {3, uint64(8443)},
+		"http.response.status_code": {3, uint64(404)},
+		"latency":                   {4, math.Float64bits(1.5)},
+		"cached":                    {2, uint64(1)},
+	} {
+		value := attributes[key]
+		if len(value[want.field]) != 1 || !reflect.DeepEqual(value[want.field][0], want.value) {
+			t.Errorf("attribute %s = %v, want field %d = %v", key, value, want.field, want.value)
+		}
+	}
+	// array_value = 5, ArrayValue.values = 1
+	list := protoMessage(t, attributes["list"][5][0].([]byte))
+	if item := protoMessage(t, list[1][0].([]byte)); string(item[1][0].([]byte)) != "a" {
+		t.Errorf("list attribute = %v", list)
+	}
+}
+
+func TestSplitServerAddress(t *testing.T) {
+	tests := []struct {
+		host        string
+		wantAddress string
+		wantPort    int
+	}{
+		{host: "api.example.com:8443", wantAddress: "api.example.com", wantPort: 8443},
+		{host: "api.example.com", wantAddress: "api.example.com"},
+		{host: "[::1]:80", wantAddress: "::1", wantPort: 80},
+		{host: "api:http", wantAddress: "api:http"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			address, port := splitServerAddress(tt.host)
+			if address != tt.wantAddress || port != tt.wantPort {
+				t.Errorf("splitServerAddress() = %s, %d, want %s, %d", address, port, tt.wantAddress, tt.wantPort)
+			}
+		})
+	}
+}
+
+func hexBytes(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// otlpCollector answers export requests with responses in order, the last
+// one repeated, and keeps request payloads.
+type otlpCollector struct {
+	mu        sync.Mutex
+	responses []func(w http.ResponseWriter)
+	requests  []*http.Request
+	payloads  [][]byte
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	c.mu.Lock()
+	c.requests = append(c.requests, r)
+	c.payloads = append(c.payloads, body)
+	respond := c.responses[0]
+	if len(c.responses) > 1 {
+		c.responses = c.responses[1:]
+	}
+	c.mu.Unlock()
+
+	respond(w)
+}
+
+func (c *otlpCollector) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.requests)
+}
+
+func httpStatus(status int, header ...string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		for i := 0; i+1 < len(header); i += 2 {
+			w.Header().Set(header[i], header[i+1])
+		}
+		w.WriteHeader(status)
+	}
+}
+
+func grpcStatus(code string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Grpc-Status", code)
+		w.Header().Set("Grpc-Message", "status%20"+code)
+	}
+}
+
+// exportOne posts one record through an OTLP sink and closes it.
+func exportOne(t *testing.T, cfg OTLPConfig) {
+	t.Helper()
+
+	cfg.Export = ExportConfig{
+		MaxBatchSize: 1, MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond,
+	}
+	sink, err := NewOTLPSink(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Post("access", map[string]interface{}{"path": "/"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	sink.Close()
+}
+
+func TestOTLPSinkHTTP(t *testing.T) {
+	tests := []struct {
+		name         string
+		responses    []func(w http.ResponseWriter)
+		compression  string
+		wantRequests int
+	}{
+		{name: "exported", responses: []func(http.ResponseWriter){httpStatus(200)}, wantRequests: 1},
+		{
+			name:         "retried on 503",
+			responses:    []func(http.ResponseWriter){httpStatus(503, "Retry-After", "0"), httpStatus(200)},
+			wantRequests: 2,
+		},
+		{name: "retried up to max attempts", responses: []func(http.ResponseWriter){httpStatus(429)}, wantRequests: 3},
+		{name: "not retried on 400", responses: []func(http.ResponseWriter){httpStatus(400)}, wantRequests: 1},
+		{
+			name:         "gzip",
+			responses:    []func(http.ResponseWriter){httpStatus(200)},
+			compression:  compressionGzip,
+			wantRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := &otlpCollector{responses: tt.responses}
+			server := httptest.NewServer(collector)
+			defer server.Close()
+
+			exportOne(t, OTLPConfig{
+				Endpoint: server.URL, Compression: tt.compression, Headers: map[string]string{"X-Key": "k"},
+			})
+
+			if collector.count() != tt.wantRequests {
+				t.Fatalf("requests = %d, want %d", collector.count(), tt.wantRequests)
+			}
+			request, payload := collector.requests[0], collector.payloads[0]
+			if request.URL.Path != otlpHTTPLogsPath || request.Header.Get("X-Key") != "k" ||
+				request.Header.Get("Content-Type") != "application/x-protobuf" {
+				t.Errorf("request = %s %v", request.URL.Path, request.Header)
+			}
+			if tt.compression == compressionGzip {
+				if request.Header.Get("Content-Encoding") != "gzip" {
+					t.Errorf("Content-Encoding = %q", request.Header.Get("Content-Encoding"))
+				}
+				reader, err := gzip.NewReader(bytes.NewReader(payload))
+				if err != nil {
+					t.Fatal(err)
+				}
+				payload, _ = io.ReadAll(reader)
+			}
+			if _, ok := protoMessage(t, payload)[1]; !ok {
+				t.Error("payload has no resource_logs")
+			}
+		})
+	}
+}
+
+func TestOTLPSinkGRPC(t *testing.T) {
+	tests := []struct {
+		name         string
+		responses    []func(w http.ResponseWriter)
+		wantRequests int
+	}{
+		{name: "exported", responses: []func(http.ResponseWriter){grpcStatus("0")}, wantRequests: 1},
+		{
+			name:         "retried on UNAVAILABLE",
+			responses:    []func(http.ResponseWriter){grpcStatus("14"), grpcStatus("0")},
+			wantRequests: 2,
+		},
+		{name: "not retried on INVALID_ARGUMENT", responses: []func(http.ResponseWriter){grpcStatus("3")}, wantRequests: 1},
+		{name: "retried on HTTP 503", responses: []func(http.ResponseWriter){httpStatus(503), grpcStatus("0")}, wantRequests: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := &otlpCollector{responses: tt.responses}
+			server := httptest.NewServer(h2c.NewHandler(collector, &http2.Server{}))
+			defer server.Close()
+
+			exportOne(t, OTLPConfig{Protocol: otlpProtocolGRPC, Endpoint: server.URL})
+
+			if collector.count() != tt.wantRequests {
+				t.Fatalf("requests = %d, want %d", collector.count(), tt.wantRequests)
+			}
+			request, frame := collector.requests[0], collector.payloads[0]
+			if request.URL.Path != otlpGRPCExportPath || request.ProtoMajor != 2 ||
+				request.Header.Get("Content-Type") != "application/grpc" {
+				t.Errorf("request = %s %s %v", request.Proto, request.URL.Path, request.Header)
+			}
+			if len(frame) < 5 || frame[0] != 0 || int(binary.BigEndian.Uint32(frame[1:5])) != len(frame)-5 {
+				t.Fatalf("gRPC frame = %x", frame)
+			}
+			if _, ok := protoMessage(t, frame[5:])[1]; !ok {
+				t.Error("payload has no resource_logs")
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"soon", 0},
+	}
+
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.value != "" {
+			header.Set("Retry-After", tt.value)
+		}
+		if got := retryAfter(header); got != tt.want {
+			t.Errorf("retryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
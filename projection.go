@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+const omittedBodyPlaceholder = "<body omitted: not JSON>"
+
+type ProjectionRule struct {
+	Fields          []string
+	Placeholder     bool
+	CaseInsensitive bool
+	selectors       []Selector
+}
+
+type ProjectionConfig struct {
+	Request   *ProjectionRule
+	Response  *ProjectionRule
+	Endpoints map[string]ProjectionConfig
+}
+
+// Rule returns the projection rule for given direction ("request" or "response"),
+// preferring an endpoint specific rule over the default one.
+func (p ProjectionConfig) Rule(endpoint, direction string) *ProjectionRule {
+	if endpointConfig, ok := p.Endpoints[endpoint]; ok {
+		if rule := endpointConfig.direction(direction); rule != nil {
+			return rule
+		}
+	}
+
+	return p.direction(direction)
+}
+
+func (p ProjectionConfig) direction(direction string) *ProjectionRule {
+	switch direction {
+	case "request":
+		return p.Request
+	case "response":
+		return p.Response
+	}
+
+	return nil
+}
+
+func ProjectBody(body string, rule *ProjectionRule) string {
+	if rule == nil || body == "" {
+		return body
+	}
+
+	value, err := toJSONValue(body)
+	if err != nil {
+		return omittedBodyPlaceholder
+	}
+
+	projected, keep := project(value, nil, rule)
+	if !keep {
+		return "{}"
+	}
+
+	jsonString, err := toString(projected)
+	if err != nil {
+		return omittedBodyPlaceholder
+	}
+
+	return jsonString
+}
+
+func project(value interface{}, path []PathElement, rule *ProjectionRule) (interface{}, bool) {
+	full, partial := matchSelectors(rule.selectors, path)
+	if full {
+		return value, true
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if !partial {
+			break
+		}
+		result := make(map[string]interface{})
+		for key, item := range v {
+			if projected, keep := project(item, appendPath(path, PathElement{Key: key}), rule); keep {
+				result[key] = projected
+			}
+		}
+		return result, true
+	case []interface{}:
+		if !partial {
+			break
+		}
+		result := make([]interface{}, 0, len(v))
+		for i, item := range v {
+			if projected, keep := project(item, appendPath(path, PathElement{Index: i, IsIndex: true}), rule); keep {
+				result = append(result, projected)
+			}
+		}
+		return result, true
+	}
+
+	if rule.Placeholder {
+		return typePlaceholder(value), true
+	}
+
+	return nil, false
+}
+
+func typePlaceholder(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "<string>"
+	case json.Number, float64:
+		return "<number>"
+	case bool:
+		return "<bool>"
+	case map[string]interface{}:
+		return "<object>"
+	case []interface{}:
+		return "<array>"
+	}
+
+	return "<null>"
+}
+
+func toJSONValue(data string) (interface{}, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewBufferString(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+
+	return value, err
+}
@@ -0,0 +1,136 @@
+package handler
+
+import "testing"
+
+func newProjectionRule(placeholder bool, fields ...string) *ProjectionRule {
+	rule := &ProjectionRule{Fields: fields, Placeholder: placeholder}
+	rule.selectors = ParseSelectors("projection", fields, false)
+
+	return rule
+}
+
+func TestProjectBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		rule *ProjectionRule
+		want string
+	}{
+		{
+			name: "no rule",
+			body: `{"a":1}`,
+			rule: nil,
+			want: `{"a":1}`,
+		},
+		{
+			name: "empty body",
+			body: "",
+			rule: newProjectionRule(false, "a"),
+			want: "",
+		},
+		{
+			name: "top level fields",
+			body: `{"id":1,"name":"x","password":"secret"}`,
+			rule: newProjectionRule(false, "id", "name"),
+			want: `{"id":1,"name":"x"}`,
+		},
+		{
+			name: "nested field keeps parents only",
+			body: `{"user":{"id":7,"email":"a@b.c"},"token":"t"}`,
+			rule: newProjectionRule(false, "user.id"),
+			want: `{"user":{"id":7}}`,
+		},
+		{
+			name: "array elements",
+			body: `{"items":[{"sku":"a","price":1},{"sku":"b","price":2}]}`,
+			rule: newProjectionRule(false, "items[*].sku"),
+			want: `{"items":[{"sku":"a"},{"sku":"b"}]}`,
+		},
+		{
+			name: "placeholders keep the shape",
+			body: `{"id":1,"name":"x","ok":true,"tags":["a"],"meta":null}`,
+			rule: newProjectionRule(true, "id"),
+			want: `{"id":1,"meta":"<null>","name":"<string>","ok":"<bool>","tags":"<array>"}`,
+		},
+		{
+			name: "nothing matches",
+			body: `"text"`,
+			rule: newProjectionRule(false, "id"),
+			want: "{}",
+		},
+		{
+			name: "not JSON",
+			body: "plain text",
+			rule: newProjectionRule(false, "id"),
+			want: omittedBodyPlaceholder,
+		},
+		{
+			name: "large numbers are kept as is",
+			body: `{"id":12345678901234567890}`,
+			rule: newProjectionRule(false, "id"),
+			want: `{"id":12345678901234567890}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ProjectBody(tt.body, tt.rule); got != tt.want {
+				t.Errorf("ProjectBody() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProjectionConfigRule(t *testing.T) {
+	defaultRequest := newProjectionRule(false, "a")
+	endpointRequest := newProjectionRule(false, "b")
+	defaultResponse := newProjectionRule(false, "c")
+	config := ProjectionConfig{
+		Request:  defaultRequest,
+		Response: defaultResponse,
+		Endpoints: map[string]ProjectionConfig{
+			"/users/:id": {Request: endpointRequest},
+		},
+	}
+
+	tests := []struct {
+		endpoint  string
+		direction string
+		want      *ProjectionRule
+	}{
+		{"/users/:id", "request", endpointRequest},
+		{"/users/:id", "response", defaultResponse},
+		{"/other", "request", defaultRequest},
+		{"/other", "unknown", nil},
+	}
+
+	for _, tt := range tests {
+		if got := config.Rule(tt.endpoint, tt.direction); got != tt.want {
+			t.Errorf("Rule(%s, %s) = %v, want %v", tt.endpoint, tt.direction, got, tt.want)
+		}
+	}
+}
+
+func TestSetProjectionConfig(t *testing.T) {
+	conf := FluentLoggerConfig{}
+	conf.setProjectionConfig(map[string]interface{}{
+		"projection": map[string]interface{}{
+			"response": map[string]interface{}{"fields": []interface{}{"ID"}, "case_insensitive": true},
+			"endpoints": map[string]interface{}{
+				"/login": map[string]interface{}{
+					"request": map[string]interface{}{"fields": []interface{}{"user"}, "placeholder": true},
+				},
+			},
+		},
+	})
+
+	if got := ProjectBody(`{"id":1,"x":2}`, conf.Projection.Rule("/", "response")); got != `{"id":1}` {
+		t.Errorf("case insensitive projection = %s", got)
+	}
+	if got := ProjectBody(`{"user":"u","password":"p"}`, conf.Projection.Rule("/login", "request")); got != `{"password":"<string>","user":"u"}` {
+		t.Errorf("endpoint projection = %s", got)
+	}
+	if rule := conf.Projection.Rule("/", "request"); rule != nil {
+		t.Errorf("unexpected request rule %v", rule)
+	}
+}
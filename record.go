@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const recordContextKey = Namespace + "/record"
+
+const suppressedBodyPlaceholder = "<body suppressed>"
+
+// requestRecord holds per-request changes of the access record made by
+// downstream handlers through AddField, SuppressBody, SetTag and SkipLog.
+type requestRecord struct {
+	mu           sync.Mutex
+	fields       map[string]interface{}
+	suppressBody bool
+	tag          string
+	skip         bool
+}
+
+func recordOf(c *gin.Context) *requestRecord {
+	if value, ok := c.Get(recordContextKey); ok {
+		if record, ok := value.(*requestRecord); ok {
+			return record
+		}
+	}
+
+	record := &requestRecord{fields: map[string]interface{}{}}
+	c.Set(recordContextKey, record)
+
+	return record
+}
+
+// AddField adds a field to the access record of the request.
+func AddField(c *gin.Context, key string, value interface{}) {
+	record := recordOf(c)
+	record.mu.Lock()
+	defer record.mu.Unlock()
+
+	record.fields[key] = value
+}
+
+// SuppressBody prevents request and response bodies of the request from being logged.
+func SuppressBody(c *gin.Context) {
+	record := recordOf(c)
+	record.mu.Lock()
+	defer record.mu.Unlock()
+
+	record.suppressBody = true
+}
+
+// SetTag overrides the tag the access record of the request is posted with.
+func SetTag(c *gin.Context, tag string) {
+	record := recordOf(c)
+	record.mu.Lock()
+	defer record.mu.Unlock()
+
+	record.tag = tag
+}
+
+// SkipLog prevents the access record of the request from being posted.
+func SkipLog(c *gin.Context) {
+	record := recordOf(c)
+	record.mu.Lock()
+	defer record.mu.Unlock()
+
+	record.skip = true
+}
+
+// apply merges changes into data and returns the tag to post data with.
+func (r *requestRecord) apply(data map[string]interface{}, defaultTag string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.suppressBody {
+		data["request.body"] = suppressedBodyPlaceholder
+		data["response.body"] = suppressedBodyPlaceholder
+	}
+	for k, v := range r.fields {
+		data[k] = v
+	}
+	if r.tag != "" {
+		return r.tag
+	}
+
+	return defaultTag
+}
+
+func (r *requestRecord) skipped() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.skip
+}
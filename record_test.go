@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/logging"
+)
+
+func TestRecordAPI(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler gin.HandlerFunc
+		want    map[string]interface{}
+		skipped bool
+	}{
+		{
+			name: "add field",
+			handler: func(c *gin.Context) {
+				AddField(c, "user.id", "42")
+				AddField(c, "path", "/overridden")
+			},
+			want: map[string]interface{}{"user.id": "42", "path": "/overridden", "tag": "krakend.access"},
+		},
+		{
+			name:    "suppress body",
+			handler: SuppressBody,
+			want: map[string]interface{}{
+				"request.body":  suppressedBodyPlaceholder,
+				"response.body": suppressedBodyPlaceholder,
+			},
+		},
+		{
+			name:    "set tag",
+			handler: func(c *gin.Context) { SetTag(c, "krakend.audit") },
+			want:    map[string]interface{}{"tag": "krakend.audit"},
+		},
+		{
+			name:    "skip log",
+			handler: SkipLog,
+			skipped: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extra, path := testConfig(t, nil)
+			_, records := serveLogged(t,
+				FluentLoggerWithConfig(logging.NoOp, extra, nil), path,
+				httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"pin":"1234"}`)),
+				tt.handler,
+				func(c *gin.Context) { c.Data(http.StatusOK, "application/json", []byte(`{"ok":true}`)) },
+			)
+
+			if tt.skipped {
+				if len(records) != 0 {
+					t.Errorf("records = %v, want none", records)
+				}
+				return
+			}
+			if len(records) != 1 {
+				t.Fatalf("records = %d, want 1", len(records))
+			}
+			for field, want := range tt.want {
+				if records[0][field] != want {
+					t.Errorf("%s = %v, want %v", field, records[0][field], want)
+				}
+			}
+		})
+	}
+}
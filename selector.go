@@ -0,0 +1,203 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type segmentKind int
+
+const (
+	keySegment segmentKind = iota
+	anyKeySegment
+	indexSegment
+	anyIndexSegment
+	descentSegment
+)
+
+type segment struct {
+	kind  segmentKind
+	key   string
+	index int
+}
+
+// PathElement is a single step of a concrete path inside a JSON document:
+// either an object key or an array index.
+type PathElement struct {
+	Key     string
+	Index   int
+	IsIndex bool
+}
+
+// Selector addresses values inside a JSON document. Supported syntax:
+// "user.password", "items[*].card.number", "items[0]", "user.*", "$..token".
+// Array elements are traversed implicitly when a key is expected,
+// so "items.sku" matches "sku" of every element of "items".
+type Selector struct {
+	raw             string
+	segments        []segment
+	caseInsensitive bool
+}
+
+func (s Selector) String() string {
+	return s.raw
+}
+
+func ParseSelector(raw string, caseInsensitive bool) (Selector, error) {
+	selector := Selector{raw: raw, caseInsensitive: caseInsensitive}
+	rest := strings.TrimSpace(raw)
+	rest = strings.TrimPrefix(rest, "$")
+	if rest == "" {
+		return selector, errors.New("empty selector")
+	}
+
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			selector.segments = append(selector.segments, segment{kind: descentSegment})
+			rest = rest[2:]
+			if rest == "" || rest[0] == '.' {
+				return selector, fmt.Errorf("selector '%s': key expected after '..'", raw)
+			}
+		case rest[0] == '.':
+			rest = rest[1:]
+			if rest == "" || rest[0] == '.' || rest[0] == '[' {
+				return selector, fmt.Errorf("selector '%s': key expected after '.'", raw)
+			}
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return selector, fmt.Errorf("selector '%s': unclosed '['", raw)
+			}
+			seg, err := parseBracket(rest[1:end])
+			if err != nil {
+				return selector, fmt.Errorf("selector '%s': %v", raw, err)
+			}
+			selector.segments = append(selector.segments, seg)
+			rest = rest[end+1:]
+		default:
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			key := rest[:end]
+			if key == "*" {
+				selector.segments = append(selector.segments, segment{kind: anyKeySegment})
+			} else {
+				selector.segments = append(selector.segments, segment{kind: keySegment, key: key})
+			}
+			rest = rest[end:]
+		}
+	}
+
+	return selector, nil
+}
+
+func parseBracket(content string) (segment, error) {
+	content = strings.TrimSpace(content)
+	if content == "*" {
+		return segment{kind: anyIndexSegment}, nil
+	}
+	if len(content) >= 2 && (content[0] == '\'' || content[0] == '"') && content[len(content)-1] == content[0] {
+		return segment{kind: keySegment, key: content[1 : len(content)-1]}, nil
+	}
+
+	index, err := strconv.Atoi(content)
+	if err != nil || index < 0 {
+		return segment{}, fmt.Errorf("wrong index '%s'", content)
+	}
+
+	return segment{kind: indexSegment, index: index}, nil
+}
+
+// ParseSelectors parses all raw selectors, reporting and skipping invalid ones.
+func ParseSelectors(key string, raw []string, caseInsensitive bool) []Selector {
+	selectors := make([]Selector, 0, len(raw))
+	for _, r := range raw {
+		selector, err := ParseSelector(r, caseInsensitive)
+		if err != nil {
+			printOutConfigError(key, err)
+			continue
+		}
+		selectors = append(selectors, selector)
+	}
+
+	return selectors
+}
+
+// Match reports whether the selector addresses exactly the given path
+// (full) and whether it may address something below it (partial). The
+// zero Selector matches nothing.
+func (s Selector) Match(path []PathElement) (full bool, partial bool) {
+	if len(s.segments) == 0 {
+		return false, false
+	}
+
+	return s.match(s.segments, path)
+}
+
+func (s Selector) match(segments []segment, path []PathElement) (bool, bool) {
+	if len(path) == 0 {
+		return len(segments) == 0, len(segments) > 0
+	}
+	if len(segments) == 0 {
+		return false, false
+	}
+
+	seg := segments[0]
+	element := path[0]
+
+	switch seg.kind {
+	case descentSegment:
+		full, partial := s.match(segments[1:], path)
+		deeperFull, deeperPartial := s.match(segments, path[1:])
+		return full || deeperFull, partial || deeperPartial
+	case keySegment, anyKeySegment:
+		if element.IsIndex {
+			return s.match(segments, path[1:])
+		}
+		if seg.kind == anyKeySegment || s.keyEqual(seg.key, element.Key) {
+			return s.match(segments[1:], path[1:])
+		}
+	case anyIndexSegment:
+		if element.IsIndex {
+			return s.match(segments[1:], path[1:])
+		}
+	case indexSegment:
+		if element.IsIndex && element.Index == seg.index {
+			return s.match(segments[1:], path[1:])
+		}
+	}
+
+	return false, false
+}
+
+func (s Selector) keyEqual(expected, actual string) bool {
+	if s.caseInsensitive {
+		return strings.EqualFold(expected, actual)
+	}
+
+	return expected == actual
+}
+
+func matchSelectors(selectors []Selector, path []PathElement) (full bool, partial bool) {
+	for _, selector := range selectors {
+		f, p := selector.Match(path)
+		full = full || f
+		partial = partial || p
+		if full {
+			return full, partial
+		}
+	}
+
+	return full, partial
+}
+
+func appendPath(path []PathElement, element PathElement) []PathElement {
+	result := make([]PathElement, len(path), len(path)+1)
+	copy(result, path)
+
+	return append(result, element)
+}
@@ -0,0 +1,119 @@
+package handler
+
+import "testing"
+
+func TestParseSelectorErrors(t *testing.T) {
+	for _, raw := range []string{"", "$", "a..", "a.", "a.[0]", "a[0", "a[x]", "a[-1]", "$...a"} {
+		if _, err := ParseSelector(raw, false); err == nil {
+			t.Errorf("ParseSelector(%q) expected an error", raw)
+		}
+	}
+}
+
+func TestSelectorMatch(t *testing.T) {
+	key := func(k string) PathElement { return PathElement{Key: k} }
+	index := func(i int) PathElement { return PathElement{Index: i, IsIndex: true} }
+
+	tests := []struct {
+		selector        string
+		caseInsensitive bool
+		path            []PathElement
+		full            bool
+		partial         bool
+	}{
+		{"user.password", false, []PathElement{key("user"), key("password")}, true, false},
+		{"user.password", false, []PathElement{key("user")}, false, true},
+		{"user.password", false, []PathElement{key("user"), key("name")}, false, false},
+		{"$.user.password", false, []PathElement{key("user"), key("password")}, true, false},
+		{"User.Password", false, []PathElement{key("user"), key("password")}, false, false},
+		{"User.Password", true, []PathElement{key("user"), key("password")}, true, false},
+		{"items[*].card.number", false, []PathElement{key("items"), index(3), key("card"), key("number")}, true, false},
+		{"items[*].card.number", false, []PathElement{key("items"), key("card")}, false, false},
+		{"items[0]", false, []PathElement{key("items"), index(0)}, true, false},
+		{"items[0]", false, []PathElement{key("items"), index(1)}, false, false},
+		{"items.sku", false, []PathElement{key("items"), index(2), key("sku")}, true, false},
+		{"user.*", false, []PathElement{key("user"), key("anything")}, true, false},
+		{"$..token", false, []PathElement{key("a"), index(0), key("b"), key("token")}, true, true},
+		{"$..token", false, []PathElement{key("token")}, true, true},
+		{"$..token", false, []PathElement{key("a")}, false, true},
+		{"a['b.c']", false, []PathElement{key("a"), key("b.c")}, true, false},
+	}
+
+	for _, tt := range tests {
+		selector, err := ParseSelector(tt.selector, tt.caseInsensitive)
+		if err != nil {
+			t.Fatalf("ParseSelector(%q): %v", tt.selector, err)
+		}
+		full, partial := selector.Match(tt.path)
+		if full != tt.full || partial != tt.partial {
+			t.Errorf("%q.Match(%v) = %v, %v, want %v, %v", tt.selector, tt.path, full, partial, tt.full, tt.partial)
+		}
+	}
+}
+
+func TestMaskBodySelectors(t *testing.T) {
+	strategy, _ := newRedactStrategy(map[string]interface{}{"replacement": "***"})
+	rules := func(fields ...string) []MaskRule {
+		result := make([]MaskRule, 0, len(fields))
+		for _, field := range fields {
+			selector, err := ParseSelector(field, false)
+			if err != nil {
+				t.Fatalf("ParseSelector(%q): %v", field, err)
+			}
+			result = append(result, MaskRule{Field: field, Strategy: strategy, selector: selector})
+		}
+		return result
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		fields []string
+		want   string
+	}{
+		{
+			name:   "top level field",
+			body:   `{"password":"p","user":"u"}`,
+			fields: []string{"password"},
+			want:   `{"password":"***","user":"u"}`,
+		},
+		{
+			name:   "array elements",
+			body:   `{"items":[{"card":{"number":"4111"}},{"card":{"number":"5500"}}]}`,
+			fields: []string{"items[*].card.number"},
+			want:   `{"items":[{"card":{"number":"***"}},{"card":{"number":"***"}}]}`,
+		},
+		{
+			name:   "single index",
+			body:   `{"items":["a","b"]}`,
+			fields: []string{"items[1]"},
+			want:   `{"items":["a","***"]}`,
+		},
+		{
+			name:   "recursive descent",
+			body:   `{"a":{"token":"x","b":[{"token":"y"}]}}`,
+			fields: []string{"$..token"},
+			want:   `{"a":{"b":[{"token":"***"}],"token":"***"}}`,
+		},
+		{
+			name:   "whole object keeps structure",
+			body:   `{"card":{"number":4111,"cvv":"123","holder":null}}`,
+			fields: []string{"card"},
+			want:   `{"card":{"cvv":"***","holder":null,"number":"***"}}`,
+		},
+		{
+			name:   "not JSON",
+			body:   "password=p",
+			fields: []string{"password"},
+			want:   "password=p",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MaskBody(tt.body, rules(tt.fields...)); got != tt.want {
+				t.Errorf("MaskBody() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
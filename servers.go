@@ -0,0 +1,239 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	balancingRoundRobin   = "round_robin"
+	balancingLeastPending = "least_pending"
+
+	defaultServerWeight     = 1
+	defaultServerBackoff    = time.Second
+	defaultServerMaxBackoff = time.Minute
+)
+
+// ForwardServer is one fluentd aggregator of "servers" list. Standby
+// servers receive records only while no primary server is available.
+type ForwardServer struct {
+	Host       string
+	Port       int
+	Network    string
+	SocketPath string
+	Weight     int
+	Standby    bool
+}
+
+// ForwardBalancing configures how records are spread across servers and
+// how long a failed server is left alone before it is tried again.
+type ForwardBalancing struct {
+	Strategy   string
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+type forwardNode struct {
+	client  *ForwardClient
+	name    string
+	weight  int
+	standby bool
+	pending int64
+
+	// guarded by ForwardPool.mu
+	current  int
+	failures int
+	retryAt  time.Time
+}
+
+// ForwardPool posts records to one of several forward servers. Primary
+// servers are preferred, standby ones are used while all primaries are
+// failing. A failed server is retried after exponential backoff, so
+// traffic returns to primaries as soon as they recover.
+type ForwardPool struct {
+	nodes     []*forwardNode
+	balancing ForwardBalancing
+	mu        sync.Mutex
+}
+
+// NewForwardPool makes a client for every server, taking connection
+// settings other than the address from base.
+func NewForwardPool(base ForwardConfig, servers []ForwardServer, balancing ForwardBalancing) (*ForwardPool, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no forward servers configured")
+	}
+	if balancing.Strategy == "" {
+		balancing.Strategy = balancingRoundRobin
+	}
+	if balancing.Backoff <= 0 {
+		balancing.Backoff = defaultServerBackoff
+	}
+	if balancing.MaxBackoff < balancing.Backoff {
+		balancing.MaxBackoff = defaultServerMaxBackoff
+	}
+
+	pool := &ForwardPool{balancing: balancing}
+	for _, server := range servers {
+		cfg := base
+		cfg.Host, cfg.Port = server.Host, server.Port
+		cfg.Network, cfg.SocketPath = server.Network, server.SocketPath
+		client := NewForwardClient(cfg)
+
+		weight := server.Weight
+		if weight <= 0 {
+			weight = defaultServerWeight
+		}
+		_, address := client.cfg.address()
+		pool.nodes = append(pool.nodes, &forwardNode{
+			client:  client,
+			name:    address,
+			weight:  weight,
+			standby: server.Standby,
+		})
+	}
+
+	return pool, nil
+}
+
+func (p *ForwardPool) Post(tag string, record map[string]interface{}) error {
+	return p.try(func(client *ForwardClient) error {
+		return client.Post(tag, record)
+	})
+}
+
+func (p *ForwardPool) postChunk(chunk *forwardChunk) error {
+	return p.try(func(client *ForwardClient) error {
+		return client.postChunk(chunk)
+	})
+}
+
+// try calls post with clients of available servers until one succeeds.
+func (p *ForwardPool) try(post func(client *ForwardClient) error) error {
+	candidates := p.candidates()
+	if len(candidates) == 0 {
+		return errors.New("no forward server available")
+	}
+
+	var err error
+	for _, node := range candidates {
+		atomic.AddInt64(&node.pending, 1)
+		err = post(node.client)
+		atomic.AddInt64(&node.pending, -1)
+
+		p.report(node, err)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("all forward servers failed, last error: %v", err)
+}
+
+func (p *ForwardPool) Close() error {
+	for _, node := range p.nodes {
+		node.client.Close()
+	}
+
+	return nil
+}
+
+// candidates returns available servers in the order they should be tried:
+// primaries picked by the balancing strategy first, then standbys.
+func (p *ForwardPool) candidates() []*forwardNode {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var primaries, standbys []*forwardNode
+	for _, node := range p.nodes {
+		if node.failures > 0 && now.Before(node.retryAt) {
+			continue
+		}
+		if node.standby {
+			standbys = append(standbys, node)
+		} else {
+			primaries = append(primaries, node)
+		}
+	}
+
+	return append(p.order(primaries), p.order(standbys)...)
+}
+
+func (p *ForwardPool) order(nodes []*forwardNode) []*forwardNode {
+	if len(nodes) < 2 {
+		return nodes
+	}
+
+	first := 0
+	switch p.balancing.Strategy {
+	case balancingLeastPending:
+		first = leastPending(nodes)
+	default:
+		first = smoothWeightedRoundRobin(nodes)
+	}
+
+	ordered := make([]*forwardNode, 0, len(nodes))
+	ordered = append(ordered, nodes[first])
+	ordered = append(ordered, nodes[:first]...)
+
+	return append(ordered, nodes[first+1:]...)
+}
+
+// smoothWeightedRoundRobin picks the node as nginx does: every node gains
+// its weight, the one with the highest current weight is chosen and loses
+// the total.
+func smoothWeightedRoundRobin(nodes []*forwardNode) int {
+	total, best := 0, 0
+	for i, node := range nodes {
+		node.current += node.weight
+		total += node.weight
+		if node.current > nodes[best].current {
+			best = i
+		}
+	}
+	nodes[best].current -= total
+
+	return best
+}
+
+// leastPending picks the node with the fewest in-flight posts per weight.
+func leastPending(nodes []*forwardNode) int {
+	best := 0
+	bestPending := atomic.LoadInt64(&nodes[0].pending)
+	for i, node := range nodes[1:] {
+		pending := atomic.LoadInt64(&node.pending)
+		if pending*int64(nodes[best].weight) < bestPending*int64(node.weight) {
+			best, bestPending = i+1, pending
+		}
+	}
+
+	return best
+}
+
+// report updates health of node after a post.
+func (p *ForwardPool) report(node *forwardNode, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		if node.failures > 0 {
+			fmt.Printf("krakend-fluentd-request-logger: forward server %s recovered \n", node.name)
+		}
+		node.failures = 0
+		return
+	}
+
+	node.failures++
+	backoff := p.balancing.Backoff
+	for i := 1; i < node.failures && backoff < p.balancing.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.balancing.MaxBackoff {
+		backoff = p.balancing.MaxBackoff
+	}
+	node.retryAt = time.Now().Add(backoff)
+	fmt.Printf("krakend-fluentd-request-logger: forward server %s failed, retry in %v: %v \n", node.name, backoff, err)
+}
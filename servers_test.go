@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testNodes(weights ...int) []*forwardNode {
+	nodes := make([]*forwardNode, len(weights))
+	for i, weight := range weights {
+		nodes[i] = &forwardNode{name: string(rune('a' + i)), weight: weight}
+	}
+
+	return nodes
+}
+
+func TestSmoothWeightedRoundRobin(t *testing.T) {
+	tests := []struct {
+		weights []int
+		want    string
+	}{
+		{[]int{1, 1, 1}, "abcabc"},
+		{[]int{5, 1, 1}, "aabacaa"},
+		{[]int{2, 1}, "abaaba"},
+	}
+
+	for _, tt := range tests {
+		nodes := testNodes(tt.weights...)
+		got := ""
+		for range tt.want {
+			got += nodes[smoothWeightedRoundRobin(nodes)].name
+		}
+		if got != tt.want {
+			t.Errorf("weights %v: picked %s, want %s", tt.weights, got, tt.want)
+		}
+	}
+}
+
+func TestLeastPending(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		pending []int64
+		want    int
+	}{
+		{"equal weights", []int{1, 1, 1}, []int64{3, 1, 2}, 1},
+		{"ties go to the first", []int{1, 1}, []int64{2, 2}, 0},
+		{"pending per weight", []int{4, 1}, []int64{6, 2}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes := testNodes(tt.weights...)
+			for i, pending := range tt.pending {
+				nodes[i].pending = pending
+			}
+			if got := leastPending(nodes); got != tt.want {
+				t.Errorf("leastPending() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardPoolCandidates(t *testing.T) {
+	pool := &ForwardPool{
+		nodes:     testNodes(1, 1, 1),
+		balancing: ForwardBalancing{Strategy: balancingRoundRobin, Backoff: time.Minute, MaxBackoff: time.Hour},
+	}
+	pool.nodes[2].standby = true
+
+	names := func() string {
+		result := ""
+		for _, node := range pool.candidates() {
+			result += node.name
+		}
+		return result
+	}
+
+	if got := names(); got != "abc" {
+		t.Errorf("candidates = %s, want abc", got)
+	}
+	if got := names(); got != "bac" {
+		t.Errorf("candidates = %s, want bac", got)
+	}
+
+	pool.report(pool.nodes[0], errors.New("down"))
+	pool.report(pool.nodes[1], errors.New("down"))
+	if got := names(); got != "c" {
+		t.Errorf("candidates with failed primaries = %s, want c", got)
+	}
+
+	pool.nodes[0].retryAt = time.Now()
+	pool.report(pool.nodes[1], nil)
+	if got := names(); got != "abc" && got != "bac" {
+		t.Errorf("candidates after recovery = %s, want primaries then standby", got)
+	}
+}
+
+func TestForwardPoolBackoff(t *testing.T) {
+	pool := &ForwardPool{
+		nodes:     testNodes(1),
+		balancing: ForwardBalancing{Backoff: time.Second, MaxBackoff: 5 * time.Second},
+	}
+	node := pool.nodes[0]
+
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		pool.report(node, errors.New("down"))
+		backoff := time.Until(node.retryAt)
+		if backoff > want || backoff < want-time.Second/2 {
+			t.Errorf("failure %d: backoff %v, want %v", node.failures, backoff, want)
+		}
+	}
+
+	pool.report(node, nil)
+	if node.failures != 0 {
+		t.Errorf("failures after success = %d, want 0", node.failures)
+	}
+}
+
+func TestForwardPoolFailover(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	server := newFakeFluentd(t, "")
+	host, port, _ := net.SplitHostPort(server.listener.Addr().String())
+	livePort, _ := strconv.Atoi(port)
+
+	pool, err := NewForwardPool(ForwardConfig{Timeout: time.Second}, []ForwardServer{
+		{Host: "127.0.0.1", Port: closedPort},
+		{Host: host, Port: livePort, Standby: true},
+	}, ForwardBalancing{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	if err := pool.Post("access", map[string]interface{}{"n": 1}); err != nil {
+		t.Fatalf("Post() error = %v", err)
+	}
+	message := <-server.messages
+	if !reflect.DeepEqual(message[2], map[string]interface{}{"n": int64(1)}) {
+		t.Errorf("record = %v", message[2])
+	}
+	if pool.nodes[0].failures != 1 || pool.nodes[1].failures != 0 {
+		t.Errorf("failures = %d, %d, want 1, 0", pool.nodes[0].failures, pool.nodes[1].failures)
+	}
+
+	if _, err := NewForwardPool(ForwardConfig{}, nil, ForwardBalancing{}); err == nil {
+		t.Error("NewForwardPool() without servers succeeded")
+	}
+}
@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fluent/fluent-logger-golang/fluent"
+)
+
+// Sink is a destination access records are posted to.
+type Sink interface {
+	Post(tag string, record map[string]interface{}) error
+	Close() error
+}
+
+type fluentSink struct {
+	logger *fluent.Fluent
+}
+
+func (s fluentSink) Post(tag string, record map[string]interface{}) error {
+	return s.logger.Post(tag, record)
+}
+
+func (s fluentSink) Close() error {
+	return s.logger.Close()
+}
+
+// usesForwardClient tells if "fluent_config" needs features the fluentd
+// logger lacks.
+func (f FluentLoggerConfig) usesForwardClient() bool {
+	return len(f.ForwardServers) > 0 || f.ForwardTLS != nil || f.ForwardSecurity != nil ||
+		f.ForwardBatch != nil || f.ForwardDelivery != nil
+}
+
+// NewFluentSink makes the sink configured in "fluent_config": the forward
+// client, or a pool of them for a "servers" list, optionally batching
+// records, when TLS, shared key authentication, several servers, batching
+// or delivery guarantees are required, the fluentd logger otherwise.
+// Delivery config, "request_ack" and "async" always turn batching on.
+// Failing to connect is not an error: both reconnect on next records.
+func NewFluentSink(conf FluentLoggerConfig) (Sink, error) {
+	if !conf.usesForwardClient() {
+		logger, err := fluent.New(conf.FluentConfig)
+		if logger == nil {
+			return nil, err
+		}
+		if err != nil {
+			printOutError("fluentd connection", err, "%s failed, reconnecting on next record: %v \n")
+		}
+		return fluentSink{logger: logger}, nil
+	}
+
+	delivery := DeliveryConfig{}
+	switch {
+	case conf.ForwardDelivery != nil:
+		delivery = *conf.ForwardDelivery
+	case conf.FluentConfig.RequestAck:
+		delivery = DeliveryConfig{Mode: deliveryAtLeastOnce, MaxAttempts: defaultDeliveryMaxAttempts}
+	}
+
+	forwardConfig := ForwardConfig{
+		Host:               conf.FluentConfig.FluentHost,
+		Port:               conf.FluentConfig.FluentPort,
+		Network:            conf.FluentConfig.FluentNetwork,
+		SocketPath:         conf.FluentConfig.FluentSocketPath,
+		Timeout:            conf.FluentConfig.Timeout,
+		WriteTimeout:       conf.FluentConfig.WriteTimeout,
+		TagPrefix:          conf.FluentConfig.TagPrefix,
+		SubSecondPrecision: conf.FluentConfig.SubSecondPrecision,
+		AckTimeout:         delivery.AckTimeout,
+		TLS:                conf.ForwardTLS,
+		Security:           conf.ForwardSecurity,
+	}
+
+	var sink interface {
+		Sink
+		chunkSender
+	}
+	if len(conf.ForwardServers) > 0 {
+		pool, err := NewForwardPool(forwardConfig, conf.ForwardServers, conf.ForwardBalancing)
+		if err != nil {
+			return nil, err
+		}
+		sink = pool
+	} else {
+		sink = NewForwardClient(forwardConfig)
+	}
+
+	if conf.ForwardBatch != nil || delivery.Mode != "" {
+		batch := BatchConfig{}
+		if conf.ForwardBatch != nil {
+			batch = *conf.ForwardBatch
+		}
+		return NewForwardBatcher(sink, forwardConfig, batch, delivery), nil
+	}
+	if conf.FluentConfig.Async {
+		batch, delivery := asyncBatchConfig(conf.FluentConfig)
+		return NewForwardBatcher(sink, forwardConfig, batch, delivery), nil
+	}
+
+	return sink, nil
+}
+
+// asyncBatchConfig maps "async" options of the fluentd logger to batching:
+// "buffer_limit" bounds records waiting to be sent and retry options set
+// delivery attempts and waits between them.
+func asyncBatchConfig(fluentConfig fluent.Config) (BatchConfig, DeliveryConfig) {
+	batch := BatchConfig{}
+	if fluentConfig.BufferLimit > 0 {
+		batch.MaxRecords = defaultBatchMaxRecords
+		if fluentConfig.BufferLimit < batch.MaxRecords {
+			batch.MaxRecords = fluentConfig.BufferLimit
+		}
+		batch.QueueSize = (fluentConfig.BufferLimit + batch.MaxRecords - 1) / batch.MaxRecords
+	}
+
+	delivery := DeliveryConfig{
+		MaxAttempts:  fluentConfig.MaxRetry,
+		RetryWait:    time.Duration(fluentConfig.RetryWait) * time.Millisecond,
+		MaxRetryWait: time.Duration(fluentConfig.MaxRetryWait) * time.Millisecond,
+	}
+
+	return batch, delivery
+}
+
+// multiSink posts every record to all its sinks.
+type multiSink []Sink
+
+func (m multiSink) Post(tag string, record map[string]interface{}) error {
+	var errs []string
+	for _, sink := range m {
+		if err := sink.Post(tag, record); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func (m multiSink) Close() error {
+	var errs []string
+	for _, sink := range m {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+var sinkFactories = map[string]func(conf FluentLoggerConfig, cfg map[string]interface{}) (Sink, error){
+	"fluentd": func(conf FluentLoggerConfig, _ map[string]interface{}) (Sink, error) {
+		return NewFluentSink(conf)
+	},
+	"file":   newFileSinkFromConfig,
+	"stdout": newStreamSinkFromConfig,
+	"syslog": newSyslogSinkFromConfig,
+	"gelf":   newGELFSinkFromConfig,
+	"otlp":   newOTLPSinkFromConfig,
+
+	"elasticsearch": newElasticsearchSinkFromConfig,
+	"loki":          newLokiSinkFromConfig,
+	"splunk":        newSplunkSinkFromConfig,
+}
+
+// NewSink makes sinks listed in "sinks" config section, or the fluentd
+// sink when there is no such section.
+func NewSink(conf FluentLoggerConfig) (Sink, error) {
+	if len(conf.sinksConfig) == 0 {
+		return NewFluentSink(conf)
+	}
+
+	var sinks multiSink
+	for i, sinkConfig := range conf.sinksConfig {
+		sinkType := ConvertToString("type", sinkConfig)
+		factory, ok := sinkFactories[sinkType]
+		if !ok {
+			sinks.Close()
+			return nil, fmt.Errorf("sinks[%d]: unknown type '%s'", i, sinkType)
+		}
+		sink, err := factory(conf, sinkConfig)
+		if err != nil {
+			sinks.Close()
+			return nil, fmt.Errorf("sinks[%d] '%s': %v", i, sinkType, err)
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+
+	return sinks, nil
+}
+
+func newFileSinkFromConfig(_ FluentLoggerConfig, cfg map[string]interface{}) (Sink, error) {
+	fileConfig := FileSinkConfig{TagField: "tag"}
+	if _, ok := cfg["path"]; ok {
+		fileConfig.Path = ConvertToString("path", cfg)
+	}
+	if _, ok := cfg["max_size"]; ok {
+		fileConfig.MaxSize = int64(ConvertToInt("max_size", cfg))
+	}
+	if _, ok := cfg["rotate_interval"]; ok {
+		fileConfig.RotateInterval = ConvertToDuration("rotate_interval", cfg)
+	}
+	if _, ok := cfg["max_files"]; ok {
+		fileConfig.MaxFiles = ConvertToInt("max_files", cfg)
+	}
+	if _, ok := cfg["compress"]; ok {
+		fileConfig.Compress = ConvertToBool("compress", cfg)
+	}
+	if _, ok := cfg["tag_field"]; ok {
+		fileConfig.TagField = ConvertToString("tag_field", cfg)
+	}
+
+	return NewFileSink(fileConfig)
+}
@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+const defaultMaskStrategy = "partial"
+
+// MaskStrategy transforms a value selected for masking. Returning false
+// as the second value removes the field from the record.
+type MaskStrategy interface {
+	Mask(value string) (string, bool)
+}
+
+type MaskStrategyFunc func(value string) (string, bool)
+
+func (f MaskStrategyFunc) Mask(value string) (string, bool) {
+	return f(value)
+}
+
+// MaskStrategyFactory builds a strategy from its config object
+// (the "strategies" entry without the "type" key being interpreted).
+type MaskStrategyFactory func(cfg map[string]interface{}) (MaskStrategy, error)
+
+var (
+	maskStrategiesMu sync.RWMutex
+	maskStrategies   = map[string]MaskStrategyFactory{
+		"partial":   newPartialStrategy,
+		"redact":    newRedactStrategy,
+		"keep_last": newKeepLastStrategy,
+		"sha256":    newSHA256Strategy,
+		"hmac":      newHMACStrategy,
+		"remove":    newRemoveStrategy,
+	}
+)
+
+// RegisterMaskStrategy makes a custom strategy type available in config.
+// It must be called before the logging middleware is created.
+func RegisterMaskStrategy(name string, factory MaskStrategyFactory) {
+	maskStrategiesMu.Lock()
+	defer maskStrategiesMu.Unlock()
+
+	maskStrategies[name] = factory
+}
+
+func NewMaskStrategy(strategyType string, cfg map[string]interface{}) (MaskStrategy, error) {
+	maskStrategiesMu.RLock()
+	factory, ok := maskStrategies[strategyType]
+	maskStrategiesMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown mask strategy type '%s'", strategyType)
+	}
+	if cfg == nil {
+		cfg = map[string]interface{}{}
+	}
+
+	return factory(cfg)
+}
+
+var partialStrategy = MaskStrategyFunc(func(value string) (string, bool) {
+	return maskFormat(value), true
+})
+
+func newPartialStrategy(_ map[string]interface{}) (MaskStrategy, error) {
+	return partialStrategy, nil
+}
+
+func newRedactStrategy(cfg map[string]interface{}) (MaskStrategy, error) {
+	replacement := "[REDACTED]"
+	if _, ok := cfg["replacement"]; ok {
+		replacement = ConvertToString("replacement", cfg)
+	}
+
+	return MaskStrategyFunc(func(_ string) (string, bool) {
+		return replacement, true
+	}), nil
+}
+
+func newKeepLastStrategy(cfg map[string]interface{}) (MaskStrategy, error) {
+	n := 4
+	if _, ok := cfg["n"]; ok {
+		n = ConvertToInt("n", cfg)
+	}
+	if n < 0 {
+		return nil, errors.New("'n' must not be negative")
+	}
+
+	return MaskStrategyFunc(func(value string) (string, bool) {
+		runes := []rune(value)
+		if len(runes) <= n {
+			return "****", true
+		}
+
+		return "****" + string(runes[len(runes)-n:]), true
+	}), nil
+}
+
+func newSHA256Strategy(cfg map[string]interface{}) (MaskStrategy, error) {
+	prefix := ""
+	if _, ok := cfg["prefix"]; ok {
+		prefix = ConvertToString("prefix", cfg)
+	}
+
+	return MaskStrategyFunc(func(value string) (string, bool) {
+		sum := sha256.Sum256([]byte(value))
+		return prefix + hex.EncodeToString(sum[:]), true
+	}), nil
+}
+
+func newHMACStrategy(cfg map[string]interface{}) (MaskStrategy, error) {
+	secret, err := readSecret(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := ""
+	if _, ok := cfg["prefix"]; ok {
+		prefix = ConvertToString("prefix", cfg)
+	}
+
+	return MaskStrategyFunc(func(value string) (string, bool) {
+		return prefix + hmacSHA256(secret, value), true
+	}), nil
+}
+
+func newRemoveStrategy(_ map[string]interface{}) (MaskStrategy, error) {
+	return MaskStrategyFunc(func(_ string) (string, bool) {
+		return "", false
+	}), nil
+}
+
+// readSecret reads a key from the environment variable named by
+// "secret_env", falling back to the literal "secret" value.
+func readSecret(cfg map[string]interface{}) ([]byte, error) {
+	if env, ok := cfg["secret_env"]; ok {
+		name := fmt.Sprintf("%v", env)
+		secret := os.Getenv(name)
+		if secret == "" {
+			return nil, fmt.Errorf("environment variable '%s' is empty", name)
+		}
+		return []byte(secret), nil
+	}
+
+	if secret, ok := cfg["secret"]; ok {
+		return []byte(fmt.Sprintf("%v", secret)), nil
+	}
+
+	return nil, errors.New("no 'secret_env' or 'secret' key found")
+}
+
+func hmacSHA256(secret []byte, value string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(value))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseMaskStrategies builds named strategies from the "mask.strategies" object.
+func parseMaskStrategies(cfg map[string]interface{}) map[string]MaskStrategy {
+	result := map[string]MaskStrategy{}
+	for name, strategyConfig := range cfg {
+		key := strings.Join([]string{"mask.strategies", name}, ".")
+		strategyConfigMap, ok := strategyConfig.(map[string]interface{})
+		if !ok {
+			printOutConfigError(key, errors.New("can't convert config to right type"))
+			continue
+		}
+
+		strategy, err := NewMaskStrategy(fmt.Sprintf("%v", strategyConfigMap["type"]), strategyConfigMap)
+		if err != nil {
+			printOutConfigError(key, err)
+			continue
+		}
+		result[name] = strategy
+	}
+
+	return result
+}
+
+// resolveMaskStrategy returns a named strategy, a built-in strategy with
+// default options, or redaction when nothing matches.
+func resolveMaskStrategy(key string, ref interface{}, named map[string]MaskStrategy) MaskStrategy {
+	var (
+		strategy MaskStrategy
+		err      error
+	)
+
+	switch r := ref.(type) {
+	case string:
+		if named, ok := named[r]; ok {
+			return named
+		}
+		strategy, err = NewMaskStrategy(r, nil)
+	case map[string]interface{}:
+		strategy, err = NewMaskStrategy(fmt.Sprintf("%v", r["type"]), r)
+	default:
+		err = errors.New("strategy should be a name or an object")
+	}
+
+	if err != nil {
+		printOutConfigError(key, err)
+		strategy, _ = newRedactStrategy(nil)
+	}
+
+	return strategy
+}
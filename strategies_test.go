@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMaskStrategies(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		cfg      map[string]interface{}
+		value    string
+		want     string
+		keep     bool
+	}{
+		{"partial long", "partial", nil, "4111111111111111", "4111...1111", true},
+		{"partial short", "partial", nil, "secret", "******", true},
+		{"redact", "redact", nil, "secret", "[REDACTED]", true},
+		{"redact replacement", "redact", map[string]interface{}{"replacement": "<x>"}, "secret", "<x>", true},
+		{"keep last", "keep_last", nil, "4111111111111111", "****1111", true},
+		{"keep last n", "keep_last", map[string]interface{}{"n": 2}, "123456", "****56", true},
+		{"keep last too short", "keep_last", nil, "123", "****", true},
+		{
+			"sha256", "sha256", map[string]interface{}{"prefix": "sha256:"}, "abc",
+			"sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", true,
+		},
+		{
+			"hmac", "hmac", map[string]interface{}{"secret": "key"}, "The quick brown fox jumps over the lazy dog",
+			"f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8", true,
+		},
+		{"remove", "remove", nil, "secret", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy, err := NewMaskStrategy(tt.strategy, tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, keep := strategy.Mask(tt.value)
+			if got != tt.want || keep != tt.keep {
+				t.Errorf("Mask(%q) = %q, %v, want %q, %v", tt.value, got, keep, tt.want, tt.keep)
+			}
+		})
+	}
+}
+
+func TestNewMaskStrategyErrors(t *testing.T) {
+	tests := []struct {
+		strategy string
+		cfg      map[string]interface{}
+	}{
+		{"unknown", nil},
+		{"keep_last", map[string]interface{}{"n": -1}},
+		{"hmac", nil},
+		{"hmac", map[string]interface{}{"secret_env": "KRAKEND_FLUENTD_TEST_UNSET"}},
+	}
+
+	os.Unsetenv("KRAKEND_FLUENTD_TEST_UNSET")
+	for _, tt := range tests {
+		if _, err := NewMaskStrategy(tt.strategy, tt.cfg); err == nil {
+			t.Errorf("NewMaskStrategy(%s, %v) expected an error", tt.strategy, tt.cfg)
+		}
+	}
+}
+
+func TestHMACStrategySecretEnv(t *testing.T) {
+	os.Setenv("KRAKEND_FLUENTD_TEST_SECRET", "key")
+	defer os.Unsetenv("KRAKEND_FLUENTD_TEST_SECRET")
+
+	strategy, err := NewMaskStrategy("hmac", map[string]interface{}{"secret_env": "KRAKEND_FLUENTD_TEST_SECRET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	literal, _ := NewMaskStrategy("hmac", map[string]interface{}{"secret": "key"})
+
+	fromEnv, _ := strategy.Mask("value")
+	fromLiteral, _ := literal.Mask("value")
+	if fromEnv != fromLiteral {
+		t.Errorf("secret_env and secret give different results: %s, %s", fromEnv, fromLiteral)
+	}
+}
+
+func TestRegisterMaskStrategy(t *testing.T) {
+	RegisterMaskStrategy("test_upper", func(_ map[string]interface{}) (MaskStrategy, error) {
+		return MaskStrategyFunc(func(value string) (string, bool) {
+			return strings.ToUpper(value), true
+		}), nil
+	})
+
+	strategy := resolveMaskStrategy("test", "test_upper", nil)
+	if got, _ := strategy.Mask("abc"); got != "ABC" {
+		t.Errorf("registered strategy = %s, want ABC", got)
+	}
+}
+
+func TestResolveMaskStrategy(t *testing.T) {
+	named := parseMaskStrategies(map[string]interface{}{
+		"card":   map[string]interface{}{"type": "keep_last", "n": 4},
+		"broken": map[string]interface{}{"type": "unknown"},
+	})
+	if _, ok := named["broken"]; ok {
+		t.Error("strategy of unknown type should be skipped")
+	}
+
+	tests := []struct {
+		name string
+		ref  interface{}
+		want string
+	}{
+		{"named", "card", "****5678"},
+		{"built-in", "sha256", "ef797c8118f02dfb649607dd5d3f8c7623048c9c063d532cc95c5ed7a898a64f"},
+		{"inline", map[string]interface{}{"type": "redact", "replacement": "x"}, "x"},
+		{"unknown falls back to redaction", "unknown", "[REDACTED]"},
+		{"wrong type falls back to redaction", 42, "[REDACTED]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := resolveMaskStrategy("test", tt.ref, named).Mask("12345678"); got != tt.want {
+				t.Errorf("Mask() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetMaskConfigStrategies(t *testing.T) {
+	conf := FluentLoggerConfig{}
+	conf.setMaskConfig(map[string]interface{}{
+		"mask": map[string]interface{}{
+			"default_strategy": "redact",
+			"strategies": map[string]interface{}{
+				"last4": map[string]interface{}{"type": "keep_last"},
+			},
+			"request": map[string]interface{}{
+				"body": []interface{}{
+					"password",
+					map[string]interface{}{"field": "card", "strategy": "last4"},
+					map[string]interface{}{"field": "token", "strategy": "remove"},
+				},
+			},
+		},
+	})
+
+	got := MaskBody(`{"password":"p","card":"4111111111111111","token":"t","user":"u"}`, conf.Mask.rules["request.body"])
+	want := `{"card":"****1111","password":"[REDACTED]","user":"u"}`
+	if got != want {
+		t.Errorf("MaskBody() = %s, want %s", got, want)
+	}
+	if fields := conf.Mask.Request["request.body"]; len(fields) != 3 {
+		t.Errorf("Request fields = %v", fields)
+	}
+}
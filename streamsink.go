@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	streamFormatJSON   = "json"
+	streamFormatLogfmt = "logfmt"
+)
+
+// StreamSink writes every record as one JSON or logfmt line to a stream,
+// usually stdout or stderr collected by a container platform. Each line is
+// written with a single Write under a mutex, so lines of concurrent
+// requests never interleave.
+type StreamSink struct {
+	writer   io.Writer
+	format   string
+	tagField string
+	mu       sync.Mutex
+}
+
+func NewStreamSink(writer io.Writer, format, tagField string) (*StreamSink, error) {
+	switch format {
+	case "":
+		format = streamFormatJSON
+	case streamFormatJSON, streamFormatLogfmt:
+	default:
+		return nil, fmt.Errorf("unknown format '%s'", format)
+	}
+
+	return &StreamSink{writer: writer, format: format, tagField: tagField}, nil
+}
+
+func (s *StreamSink) Post(tag string, record map[string]interface{}) error {
+	record = taggedRecord(record, s.tagField, tag)
+
+	var (
+		line []byte
+		err  error
+	)
+	if s.format == streamFormatLogfmt {
+		line = encodeLogfmtLine(record)
+	} else {
+		line, err = encodeJSONLine(record)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.writer.Write(line)
+
+	return err
+}
+
+func (s *StreamSink) Close() error {
+	return nil
+}
+
+// encodeLogfmtLine encodes record as key=value pairs sorted by key. Nested
+// values are written as JSON.
+func encodeLogfmtLine(record map[string]interface{}) []byte {
+	keys := make([]string, 0, len(record))
+	for k := range record {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var builder strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			builder.WriteByte(' ')
+		}
+		builder.WriteString(logfmtKey(k))
+		builder.WriteByte('=')
+		builder.WriteString(logfmtValue(record[k]))
+	}
+	builder.WriteByte('\n')
+
+	return []byte(builder.String())
+}
+
+func logfmtKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' {
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+func logfmtValue(value interface{}) string {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		s = v
+	case bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return fmt.Sprint(v)
+	case map[string]interface{}, []interface{}:
+		encoded, err := toString(v)
+		if err != nil {
+			encoded = fmt.Sprint(v)
+		}
+		s = encoded
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	if s == "" || strings.ContainsAny(s, " =\"\\\t\r\n") {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
+
+func newStreamSinkFromConfig(_ FluentLoggerConfig, cfg map[string]interface{}) (Sink, error) {
+	var writer io.Writer = os.Stdout
+	if _, ok := cfg["stream"]; ok {
+		switch stream := ConvertToString("stream", cfg); stream {
+		case "stdout":
+		case "stderr":
+			writer = os.Stderr
+		default:
+			return nil, fmt.Errorf("unknown stream '%s'", stream)
+		}
+	}
+
+	format := ""
+	if _, ok := cfg["format"]; ok {
+		format = ConvertToString("format", cfg)
+	}
+	tagField := "tag"
+	if _, ok := cfg["tag_field"]; ok {
+		tagField = ConvertToString("tag_field", cfg)
+	}
+
+	return NewStreamSink(writer, format, tagField)
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestStreamSink(t *testing.T) {
+	record := map[string]interface{}{
+		"path":    "/users",
+		"status":  200,
+		"ok":      true,
+		"message": `say "hi"`,
+		"empty":   "",
+		"nested":  map[string]interface{}{"a": "<b>"},
+		"key =x":  nil,
+	}
+
+	tests := []struct {
+		name     string
+		format   string
+		tagField string
+		want     string
+	}{
+		{
+			name:     "json",
+			format:   "",
+			tagField: "tag",
+			want: `{"empty":"","key =x":null,"message":"say \"hi\"","nested":{"a":"<b>"},"ok":true,` +
+				`"path":"/users","status":200,"tag":"access"}` + "\n",
+		},
+		{
+			name:   "logfmt",
+			format: streamFormatLogfmt,
+			want: `empty="" key__x= message="say \"hi\"" nested="{\"a\":\"<b>\"}" ok=true path=/users status=200` +
+				"\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			sink, err := NewStreamSink(&buffer, tt.format, tt.tagField)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sink.Post("access", record); err != nil {
+				t.Fatal(err)
+			}
+			if got := buffer.String(); got != tt.want {
+				t.Errorf("line = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := NewStreamSink(&bytes.Buffer{}, "xml", ""); err == nil {
+		t.Error("NewStreamSink() with unknown format succeeded")
+	}
+}
+
+func TestStreamSinkConcurrentLines(t *testing.T) {
+	var buffer bytes.Buffer
+	sink, _ := NewStreamSink(&buffer, streamFormatLogfmt, "")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sink.Post("access", map[string]interface{}{"message": strings.Repeat("x", 100)})
+		}()
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(buffer.String(), "\n"), "\n")
+	if len(lines) != 50 {
+		t.Fatalf("lines = %d, want 50", len(lines))
+	}
+	for _, line := range lines {
+		if line != "message="+strings.Repeat("x", 100) {
+			t.Errorf("interleaved line %q", line)
+		}
+	}
+}
+
+func TestNewStreamSinkFromConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     map[string]interface{}
+		wantErr bool
+	}{
+		{name: "defaults", cfg: map[string]interface{}{}},
+		{name: "stderr logfmt", cfg: map[string]interface{}{"stream": "stderr", "format": "logfmt"}},
+		{name: "unknown stream", cfg: map[string]interface{}{"stream": "file"}, wantErr: true},
+		{name: "unknown format", cfg: map[string]interface{}{"format": "xml"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newStreamSinkFromConfig(FluentLoggerConfig{}, tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newStreamSinkFromConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package handler
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	syslogRFC5424 = "rfc5424"
+	syslogRFC3164 = "rfc3164"
+
+	syslogFramingOctetCounting  = "octet_counting"
+	syslogFramingNonTransparent = "non_transparent"
+
+	defaultSyslogFacility = 16 // local0
+	defaultSyslogAppName  = "krakend"
+	defaultSyslogSDID     = "access@32473"
+
+	rfc5424Timestamp = "2006-01-02T15:04:05.000000Z07:00"
+	rfc3164Timestamp = "Jan _2 15:04:05"
+)
+
+const (
+	severityError   = 3
+	severityWarning = 4
+	severityInfo    = 6
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// SyslogConfig configures the syslog sink. Network is "udp", "tcp", "tls"
+// or "unix"; for "unix" Address is a socket path like "/dev/log".
+// Timeout bounds both dialing and writing a message.
+type SyslogConfig struct {
+	Network  string
+	Address  string
+	Format   string
+	Framing  string
+	Facility int
+	AppName  string
+	Hostname string
+	SDID     string
+	Timeout  time.Duration
+	TLS      *tls.Config
+}
+
+// SyslogSink sends records as syslog messages. RFC 5424 messages carry the
+// record as structured data and a short summary as the message; RFC 3164
+// ones carry the record as JSON. Severity follows the response status:
+// error for 5xx, warning for 4xx, informational otherwise.
+type SyslogSink struct {
+	cfg  SyslogConfig
+	conn *sinkConn
+}
+
+func NewSyslogSink(cfg SyslogConfig) (*SyslogSink, error) {
+	switch cfg.Network {
+	case "udp", "tcp", "tls", "unix":
+	default:
+		return nil, fmt.Errorf("unknown network '%s'", cfg.Network)
+	}
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("no 'address' found")
+	}
+	switch cfg.Format {
+	case "":
+		cfg.Format = syslogRFC5424
+	case syslogRFC5424, syslogRFC3164:
+	default:
+		return nil, fmt.Errorf("unknown format '%s'", cfg.Format)
+	}
+	switch cfg.Framing {
+	case "":
+		cfg.Framing = syslogFramingOctetCounting
+	case syslogFramingOctetCounting, syslogFramingNonTransparent:
+	default:
+		return nil, fmt.Errorf("unknown framing '%s'", cfg.Framing)
+	}
+	if cfg.AppName == "" {
+		cfg.AppName = defaultSyslogAppName
+	}
+	if cfg.Hostname == "" {
+		cfg.Hostname, _ = os.Hostname()
+	}
+	if cfg.SDID == "" {
+		cfg.SDID = defaultSyslogSDID
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultForwardTimeout
+	}
+
+	s := &SyslogSink{cfg: cfg}
+	s.conn = newSinkConn(s.dial, s.cfg.Timeout)
+
+	return s, nil
+}
+
+func (s *SyslogSink) Post(tag string, record map[string]interface{}) error {
+	var message []byte
+	if s.cfg.Format == syslogRFC3164 {
+		message = s.formatRFC3164(tag, record, time.Now())
+	} else {
+		message = s.formatRFC5424(tag, record, time.Now())
+	}
+
+	return s.conn.write(func(conn net.Conn) error {
+		_, err := conn.Write(s.frame(message, conn))
+		return err
+	}, nil)
+}
+
+func (s *SyslogSink) Close() error {
+	return s.conn.Close()
+}
+
+// frame makes the message fit stream transports: octet-counting
+// ("LEN SP MSG") or newline terminated messages. Datagrams go as is.
+func (s *SyslogSink) frame(message []byte, conn net.Conn) []byte {
+	switch network := conn.RemoteAddr().Network(); {
+	case network == "udp" || network == "unixgram":
+		return message
+	case s.cfg.Framing == syslogFramingOctetCounting && network != "unix":
+		return append([]byte(strconv.Itoa(len(message))+" "), message...)
+	}
+
+	return append(message, '\n')
+}
+
+// dial connects to a unix socket as datagram one first, as "/dev/log"
+// usually is, then as stream one.
+func (s *SyslogSink) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: s.cfg.Timeout}
+	switch s.cfg.Network {
+	case "tls":
+		return tls.DialWithDialer(dialer, "tcp", s.cfg.Address, s.cfg.TLS)
+	case "unix":
+		conn, err := dialer.Dial("unixgram", s.cfg.Address)
+		if err != nil {
+			conn, err = dialer.Dial("unix", s.cfg.Address)
+		}
+		return conn, err
+	}
+
+	return dialer.Dial(s.cfg.Network, s.cfg.Address)
+}
+
+func (s *SyslogSink) priority(record map[string]interface{}) int {
+	return s.cfg.Facility*8 + statusSeverity(recordStatus(record))
+}
+
+// formatRFC5424 makes
+// "<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD-ID param="value" ...] MSG".
+func (s *SyslogSink) formatRFC5424(tag string, record map[string]interface{}, t time.Time) []byte {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "<%d>1 %s %s %s %d %s ",
+		s.priority(record),
+		t.Format(rfc5424Timestamp),
+		syslogHeaderField(s.cfg.Hostname, 255),
+		syslogHeaderField(s.cfg.AppName, 48),
+		os.Getpid(),
+		syslogHeaderField(tag, 32),
+	)
+
+	keys := make([]string, 0, len(record))
+	for k := range record {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	builder.WriteString("[" + s.cfg.SDID)
+	for _, k := range keys {
+		if record[k] == nil {
+			continue
+		}
+		builder.WriteString(" " + sdParamName(k) + `="` + sdParamValue(recordValueString(record[k])) + `"`)
+	}
+	builder.WriteString("] ")
+	builder.WriteString(recordSummary(record))
+
+	return []byte(builder.String())
+}
+
+// formatRFC3164 makes "<PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG" with
+// the record as JSON in MSG.
+func (s *SyslogSink) formatRFC3164(_ string, record map[string]interface{}, t time.Time) []byte {
+	message, err := toString(record)
+	if err != nil {
+		message = recordSummary(record)
+	}
+
+	return []byte(fmt.Sprintf("<%d>%s %s %s[%d]: %s",
+		s.priority(record),
+		t.Format(rfc3164Timestamp),
+		syslogHeaderField(s.cfg.Hostname, 255),
+		rfc3164Tag(s.cfg.AppName),
+		os.Getpid(),
+		message,
+	))
+}
+
+// syslogHeaderField makes value a valid RFC 5424 header field: printable
+// US-ASCII without spaces, at most max characters, "-" if empty.
+func syslogHeaderField(value string, max int) string {
+	value = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, value)
+	if len(value) > max {
+		value = value[:max]
+	}
+	if value == "" {
+		return "-"
+	}
+
+	return value
+}
+
+func sdParamName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, name)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+
+	return name
+}
+
+func sdParamValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// rfc3164Tag keeps up to 32 alphanumeric characters of the tag.
+func rfc3164Tag(tag string) string {
+	tag = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, tag)
+	if len(tag) > 32 {
+		tag = tag[:32]
+	}
+
+	return tag
+}
+
+// recordValueString writes nested values as JSON and others as is.
+func recordValueString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case map[string]interface{}, []interface{}:
+		if encoded, err := toString(v); err == nil {
+			return encoded
+		}
+	}
+
+	return fmt.Sprint(value)
+}
+
+// recordStatus returns the response status of the record, 0 if unknown.
+func recordStatus(record map[string]interface{}) int {
+	status, err := strconv.Atoi(fmt.Sprint(record["response.status_code"]))
+	if err != nil {
+		return 0
+	}
+
+	return status
+}
+
+func statusSeverity(status int) int {
+	switch {
+	case status >= http.StatusInternalServerError:
+		return severityError
+	case status >= http.StatusBadRequest:
+		return severityWarning
+	}
+
+	return severityInfo
+}
+
+// recordSummary makes "METHOD path status" line of the record, with "-"
+// for missing fields.
+func recordSummary(record map[string]interface{}) string {
+	fields := make([]string, 0, 3)
+	for _, field := range []string{"request.method", "path", "response.status_code"} {
+		value, ok := record[field]
+		if !ok || value == nil {
+			value = "-"
+		}
+		fields = append(fields, fmt.Sprint(value))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+func newSyslogSinkFromConfig(_ FluentLoggerConfig, cfg map[string]interface{}) (Sink, error) {
+	syslogConfig := SyslogConfig{Facility: defaultSyslogFacility}
+	for option, target := range map[string]*string{
+		"network":  &syslogConfig.Network,
+		"address":  &syslogConfig.Address,
+		"format":   &syslogConfig.Format,
+		"framing":  &syslogConfig.Framing,
+		"app_name": &syslogConfig.AppName,
+		"hostname": &syslogConfig.Hostname,
+		"sd_id":    &syslogConfig.SDID,
+	} {
+		if _, ok := cfg[option]; ok {
+			*target = ConvertToString(option, cfg)
+		}
+	}
+	if _, ok := cfg["facility"]; ok {
+		facility := ConvertToString("facility", cfg)
+		code, ok := syslogFacilities[facility]
+		if !ok {
+			return nil, fmt.Errorf("unknown facility '%s'", facility)
+		}
+		syslogConfig.Facility = code
+	}
+	if _, ok := cfg["timeout"]; ok {
+		syslogConfig.Timeout = ConvertToDuration("timeout", cfg)
+	}
+	if tlsConfigMap, ok := cfg["tls"].(map[string]interface{}); ok {
+		tlsConfig, err := parseTLSConfig(tlsConfigMap)
+		if err != nil {
+			return nil, err
+		}
+		syslogConfig.TLS = tlsConfig
+	}
+
+	return NewSyslogSink(syslogConfig)
+}
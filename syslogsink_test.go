@@ -0,0 +1,246 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var syslogTestTime = time.Date(2024, 3, 5, 7, 8, 9, 123456000, time.UTC)
+
+func newTestSyslogSink(t *testing.T, cfg SyslogConfig) *SyslogSink {
+	t.Helper()
+
+	if cfg.Network == "" {
+		cfg.Network = "udp"
+	}
+	if cfg.Address == "" {
+		cfg.Address = "127.0.0.1:514"
+	}
+	cfg.Hostname = "gw"
+	sink, err := NewSyslogSink(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sink
+}
+
+func TestSDParamValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{`plain`, `plain`},
+		{`say "hi"`, `say \"hi\"`},
+		{`C:\path`, `C:\\path`},
+		{`[a]`, `[a\]`},
+		{`\"]`, `\\\"\]`},
+	}
+
+	for _, tt := range tests {
+		if got := sdParamValue(tt.value); got != tt.want {
+			t.Errorf("sdParamValue(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSyslogFormatRFC5424(t *testing.T) {
+	sink := newTestSyslogSink(t, SyslogConfig{Facility: 16})
+	record := map[string]interface{}{
+		"request.method":       "GET",
+		"path":                 `/a"b]c\d`,
+		"response.status_code": "503",
+		"param=name]":          "v",
+		"nested":               map[string]interface{}{"k": "v"},
+		"skipped":              nil,
+	}
+
+	want := fmt.Sprintf(`<131>1 2024-03-05T07:08:09.123456Z gw krakend %d access [access@32473 `+
+		`nested="{\"k\":\"v\"}" param_name_="v" path="/a\"b\]c\\d" request.method="GET" `+
+		`response.status_code="503"] GET /a"b]c\d 503`, os.Getpid())
+	if got := string(sink.formatRFC5424("access", record, syslogTestTime)); got != want {
+		t.Errorf("formatRFC5424() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestSyslogFormatRFC3164(t *testing.T) {
+	sink := newTestSyslogSink(t, SyslogConfig{Facility: 4, AppName: "kra-kend.gw", Format: syslogRFC3164})
+	record := map[string]interface{}{"path": "/", "response.status_code": 404}
+
+	want := fmt.Sprintf(`<36>Mar  5 07:08:09 gw krakendgw[%d]: {"path":"/","response.status_code":404}`, os.Getpid())
+	if got := string(sink.formatRFC3164("access", record, syslogTestTime)); got != want {
+		t.Errorf("formatRFC3164() = %s, want %s", got, want)
+	}
+}
+
+func TestStatusSeverity(t *testing.T) {
+	tests := []struct {
+		record map[string]interface{}
+		want   int
+	}{
+		{map[string]interface{}{"response.status_code": "200"}, severityInfo},
+		{map[string]interface{}{"response.status_code": 302}, severityInfo},
+		{map[string]interface{}{"response.status_code": "404"}, severityWarning},
+		{map[string]interface{}{"response.status_code": "500"}, severityError},
+		{map[string]interface{}{}, severityInfo},
+	}
+
+	for _, tt := range tests {
+		if got := statusSeverity(recordStatus(tt.record)); got != tt.want {
+			t.Errorf("severity of %v = %d, want %d", tt.record, got, tt.want)
+		}
+	}
+}
+
+func TestSyslogSinkTCPOctetCounting(t *testing.T) {
+	tests := []struct {
+		name    string
+		framing string
+	}{
+		{name: "octet counting", framing: syslogFramingOctetCounting},
+		{name: "non-transparent", framing: syslogFramingNonTransparent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			received := make(chan string, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				received <- readSyslogFrames(conn, tt.framing, 2)
+			}()
+
+			sink := newTestSyslogSink(t, SyslogConfig{
+				Network: "tcp", Address: listener.Addr().String(), Framing: tt.framing,
+			})
+			defer sink.Close()
+			for _, path := range []string{"/first", "/second\nline"} {
+				if err := sink.Post("access", map[string]interface{}{"path": path}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			select {
+			case frames := <-received:
+				if tt.framing == syslogFramingOctetCounting {
+					if !strings.Contains(frames, `path="/first"`) || !strings.Contains(frames, "/second\nline") {
+						t.Errorf("frames = %q", frames)
+					}
+				} else if !strings.Contains(frames, `path="/first"`) {
+					t.Errorf("frames = %q", frames)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no messages received")
+			}
+		})
+	}
+}
+
+// readSyslogFrames reads count frames and returns them joined with "|".
+// Octet-counted frames are checked to be exactly as long as announced.
+func readSyslogFrames(conn net.Conn, framing string, count int) string {
+	reader := bufio.NewReader(conn)
+	var frames []string
+	for len(frames) < count {
+		if framing != syslogFramingOctetCounting {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return err.Error()
+			}
+			frames = append(frames, strings.TrimSuffix(line, "\n"))
+			continue
+		}
+
+		length, err := reader.ReadString(' ')
+		if err != nil {
+			return err.Error()
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			return err.Error()
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return err.Error()
+		}
+		if !strings.HasPrefix(string(frame), "<") {
+			return "frame does not start with PRI: " + string(frame)
+		}
+		frames = append(frames, string(frame))
+	}
+
+	return strings.Join(frames, "|")
+}
+
+func TestSyslogSinkUnixgram(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink := newTestSyslogSink(t, SyslogConfig{Network: "unix", Address: path, Facility: defaultSyslogFacility})
+	defer sink.Close()
+	if err := sink.Post("access", map[string]interface{}{"path": "/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 4096)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datagram := string(buffer[:n])
+	if !strings.HasPrefix(datagram, "<134>1 ") || strings.HasSuffix(datagram, "\n") {
+		t.Errorf("datagram = %q, want an unframed RFC 5424 message", datagram)
+	}
+}
+
+func TestNewSyslogSinkFromConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     map[string]interface{}
+		wantErr bool
+	}{
+		{name: "udp", cfg: map[string]interface{}{"network": "udp", "address": "127.0.0.1:514", "facility": "auth"}},
+		{name: "unknown network", cfg: map[string]interface{}{"network": "http", "address": "x"}, wantErr: true},
+		{name: "no address", cfg: map[string]interface{}{"network": "udp"}, wantErr: true},
+		{
+			name:    "unknown facility",
+			cfg:     map[string]interface{}{"network": "udp", "address": "x", "facility": "local9"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown framing",
+			cfg:     map[string]interface{}{"network": "tcp", "address": "x", "framing": "none"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newSyslogSinkFromConfig(FluentLoggerConfig{}, tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newSyslogSinkFromConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package handler
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// retryDeliverer is what a retryWorker sends items with: forward chunks
+// for ForwardBatcher, batches of records for exporting sinks.
+type retryDeliverer interface {
+	// take removes buffered items to send on flush.
+	take() []interface{}
+	// attempt sends an item. A failure worth retrying returns the item to
+	// retry, possibly narrowed, and the delay the server asked for; retry
+	// is nil if the item failed for good.
+	attempt(item interface{}) (retry interface{}, after time.Duration, err error)
+	// drop handles an item given up after err.
+	drop(item interface{}, err error)
+}
+
+// retryPolicy sets the attempts an item gets and the waits between them:
+// the wait starts at initialWait and doubles up to maxWait, if set. With
+// jitter each wait is picked between its half and itself. At most
+// maxRetries items wait for a retry at once.
+type retryPolicy struct {
+	maxAttempts int
+	initialWait time.Duration
+	maxWait     time.Duration
+	jitter      bool
+	maxRetries  int
+}
+
+// deliveryRetry is an item with its attempts made so far, the wait of the
+// next retry and the time of the next attempt.
+type deliveryRetry struct {
+	item    interface{}
+	attempt int
+	wait    time.Duration
+	at      time.Time
+}
+
+// retryWorker sends queued items and items flushed every flushInterval in
+// the background. Failed items wait for their next attempt while the
+// worker keeps taking new ones; on close every item gets one last attempt
+// without waiting.
+type retryWorker struct {
+	deliverer     retryDeliverer
+	flushInterval time.Duration
+	policy        retryPolicy
+	counters      *DeliveryCounters
+
+	queue chan interface{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newRetryWorker(
+	deliverer retryDeliverer, queueSize int, flushInterval time.Duration, policy retryPolicy,
+	counters *DeliveryCounters,
+) *retryWorker {
+	w := &retryWorker{
+		deliverer:     deliverer,
+		flushInterval: flushInterval,
+		policy:        policy,
+		counters:      counters,
+		queue:         make(chan interface{}, queueSize),
+		done:          make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.run()
+
+	return w
+}
+
+// enqueue hands an item to the worker, false if the queue is full.
+func (w *retryWorker) enqueue(item interface{}) bool {
+	select {
+	case w.queue <- item:
+		return true
+	default:
+		return false
+	}
+}
+
+// close makes the last attempts and stops the worker.
+func (w *retryWorker) close() {
+	close(w.done)
+	w.wg.Wait()
+}
+
+func (w *retryWorker) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+	retryTimer := time.NewTimer(time.Hour)
+	retryTimer.Stop()
+	defer retryTimer.Stop()
+
+	var retries []*deliveryRetry
+	for {
+		select {
+		case item := <-w.queue:
+			retries = w.send(w.newRetry(item), retries, false)
+		case <-ticker.C:
+			for _, item := range w.deliverer.take() {
+				retries = w.send(w.newRetry(item), retries, false)
+			}
+		case <-retryTimer.C:
+			now := time.Now()
+			waiting := retries[:0:0]
+			var due []*deliveryRetry
+			for _, retry := range retries {
+				if now.Before(retry.at) {
+					waiting = append(waiting, retry)
+				} else {
+					due = append(due, retry)
+				}
+			}
+			retries = waiting
+			for _, retry := range due {
+				retries = w.send(retry, retries, false)
+			}
+		case <-w.done:
+			for len(w.queue) > 0 {
+				w.send(w.newRetry(<-w.queue), nil, true)
+			}
+			for _, item := range w.deliverer.take() {
+				w.send(w.newRetry(item), nil, true)
+			}
+			for _, retry := range retries {
+				w.send(retry, nil, true)
+			}
+			return
+		}
+
+		if !retryTimer.Stop() {
+			select {
+			case <-retryTimer.C:
+			default:
+			}
+		}
+		if next := nextRetry(retries); next != nil {
+			retryTimer.Reset(time.Until(next.at))
+		}
+	}
+}
+
+func nextRetry(retries []*deliveryRetry) *deliveryRetry {
+	var next *deliveryRetry
+	for _, retry := range retries {
+		if next == nil || retry.at.Before(next.at) {
+			next = retry
+		}
+	}
+
+	return next
+}
+
+func (w *retryWorker) newRetry(item interface{}) *deliveryRetry {
+	return &deliveryRetry{item: item, wait: w.policy.initialWait}
+}
+
+// send makes a delivery attempt and, if it fails with a retryable error,
+// adds the item to retries to be tried again after its wait, or the delay
+// the server asked for if it is longer. Items out of attempts, failed on
+// the last attempt, failed for good or not fitting in retries are dropped.
+func (w *retryWorker) send(retry *deliveryRetry, retries []*deliveryRetry, last bool) []*deliveryRetry {
+	if retry.attempt > 0 {
+		atomic.AddInt64(&w.counters.Retries, 1)
+	}
+	retry.attempt++
+
+	next, after, err := w.deliverer.attempt(retry.item)
+	if err == nil {
+		atomic.AddInt64(&w.counters.SentChunks, 1)
+		return retries
+	}
+	if next != nil {
+		retry.item = next
+	}
+
+	if next != nil && !last && retry.attempt < w.policy.maxAttempts && len(retries) < w.policy.maxRetries {
+		wait := retry.wait
+		if w.policy.jitter {
+			wait = retry.wait/2 + time.Duration(rand.Int63n(int64(retry.wait/2)+1)) //nolint:gosec
+		}
+		if after > wait {
+			wait = after
+		}
+		retry.at = time.Now().Add(wait)
+		if retry.wait *= 2; w.policy.maxWait > 0 && retry.wait > w.policy.maxWait {
+			retry.wait = w.policy.maxWait
+		}
+		return append(retries, retry)
+	}
+	atomic.AddInt64(&w.counters.FailedChunks, 1)
+	w.deliverer.drop(retry.item, err)
+
+	return retries
+}